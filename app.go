@@ -29,8 +29,13 @@ const (
 type FileLoader struct {
 	http.Handler
 	FilePrefix string
+	// 直接打开的微信目录用 \InPlace\<账号> 访问
+	inPlaceName string
+	inPlaceRoot string
 }
 
+const inPlacePrefix = "InPlace"
+
 func NewFileLoader(prefix string) *FileLoader {
 	mime.AddExtensionType(".mp3", "audio/mpeg")
 	return &FileLoader{FilePrefix: prefix}
@@ -41,28 +46,35 @@ func (h *FileLoader) SetFilePrefix(prefix string) {
 	log.Println("SetFilePrefix", h.FilePrefix)
 }
 
+func (h *FileLoader) SetInPlaceRoot(acountName string, root string) {
+	h.inPlaceName = acountName
+	h.inPlaceRoot = root
+	log.Println("SetInPlaceRoot", acountName, root)
+}
+
 func (h *FileLoader) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	requestedFilename := h.FilePrefix + "\\" + strings.TrimPrefix(req.URL.Path, "/")
+	if len(h.inPlaceRoot) > 0 {
+		relPath := strings.ReplaceAll(strings.TrimLeft(req.URL.Path, "/\\"), "/", "\\")
+		if after, ok := strings.CutPrefix(relPath, inPlacePrefix+"\\"+h.inPlaceName+"\\"); ok {
+			requestedFilename = h.inPlaceRoot + "\\" + after
+		}
+	}
 
-	file, err := os.Open(requestedFilename)
+	// 加密的导出在解锁后按块解密
+	file, err := wechat.OpenBackupFile(requestedFilename)
 	if err != nil {
 		http.Error(res, fmt.Sprintf("Could not load file %s", requestedFilename), http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		http.Error(res, "Could not retrieve file info", http.StatusInternalServerError)
-		return
-	}
-
-	fileSize := fileInfo.Size()
+	fileSize := file.Size()
 	rangeHeader := req.Header.Get("Range")
 	if rangeHeader == "" {
 		// 无 Range 请求，直接返回整个文件
 		res.Header().Set("Content-Length", strconv.FormatInt(fileSize, 10))
-		http.ServeContent(res, req, requestedFilename, fileInfo.ModTime(), file)
+		http.ServeContent(res, req, requestedFilename, file.ModTime(), file)
 		return
 	}
 
@@ -131,6 +143,8 @@ type WeChatInfo struct {
 	Version    string `json:"Version"`
 	Is64Bits   bool   `json:"Is64Bits"`
 	DBKey      string `json:"DBkey"`
+	// 找不到key时前端可以显示每种特征匹配到哪一步
+	KeyReport *wechat.KeySearchReport `json:"KeyReport"`
 }
 
 type WeChatInfoList struct {
@@ -169,9 +183,22 @@ func NewApp() *App {
 		log.Println("not config exist")
 	}
 	log.Printf("default: %s users: %v\n", a.defaultUser, a.users)
+	// KeySignatures.json放在程序目录下, 不依赖启动时的当前目录
+	if exePath, err := os.Executable(); err == nil {
+		signaturePath := filepath.Join(filepath.Dir(exePath), wechat.KeySignatureFile)
+		if _, err := os.Stat(signaturePath); err == nil {
+			err = wechat.LoadKeySignatures(signaturePath)
+			log.Println("LoadKeySignatures:", signaturePath, err)
+		}
+	}
 	if len(a.users) == 0 {
 		a.firstStart = true
 	}
+	if store, err := wechat.OpenKeyStore(wechat.DefaultKeyStorePath(), ""); err == nil {
+		wechat.SetDefaultKeyStore(store)
+	} else {
+		log.Println("OpenKeyStore:", err)
+	}
 
 	return a
 }
@@ -191,6 +218,7 @@ func (a *App) shutdown(ctx context.Context) {
 		a.provider.WechatWechatDataProviderClose()
 		a.provider = nil
 	}
+	wechat.LockAllBackups()
 	log.Printf("App Version %s exit!", appVersion)
 }
 
@@ -213,6 +241,7 @@ func (a *App) GetWeChatAllInfo() string {
 		info.Version = a.infoList.Info[i].Version
 		info.Is64Bits = a.infoList.Info[i].Is64Bits
 		info.DBKey = a.infoList.Info[i].DBKey
+		info.KeyReport = a.infoList.Info[i].KeyReport
 		infoList.Info = append(infoList.Info, info)
 		infoList.Total += 1
 		log.Printf("ProcessID %d, FilePath %s, AcountName %s, Version %s, Is64Bits %t", info.ProcessID, info.FilePath, info.AcountName, info.Version, info.Is64Bits)
@@ -224,6 +253,15 @@ func (a *App) GetWeChatAllInfo() string {
 }
 
 func (a *App) ExportWeChatAllData(full bool, acountName string) {
+	a.exportWeChatAllData(full, acountName, "")
+}
+
+// ExportWeChatAllDataWithPassword 导出后用密码加密导出目录
+func (a *App) ExportWeChatAllDataWithPassword(full bool, acountName string, password string) {
+	a.exportWeChatAllData(full, acountName, password)
+}
+
+func (a *App) exportWeChatAllData(full bool, acountName string, password string) {
 
 	if a.provider != nil {
 		a.provider.WechatWechatDataProviderClose()
@@ -253,6 +291,19 @@ func (a *App) ExportWeChatAllData(full bool, acountName string) {
 		}
 
 		expPath := prefixExportPath + pInfo.AcountName
+		if err := wechat.CheckBackupPassword(expPath, password); err != nil && len(password) > 0 {
+			close(progress)
+			runtime.EventsEmit(a.ctx, "exportData", fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v\"}", err))
+			return
+		}
+		// 没有密码没法和原来加密的数据合并, 不能悄悄删掉加密的导出, 要先解锁或者换一个导出目录
+		if len(password) == 0 && wechat.IsBackupEncrypted(expPath) {
+			close(progress)
+			runtime.EventsEmit(a.ctx, "exportData", fmt.Sprintf("{\"status\":\"error\", \"result\":\"%s is encrypted, export with its password\"}", pInfo.AcountName))
+			return
+		}
+		wechat.LockBackup(expPath)
+
 		_, err = os.Stat(expPath)
 		if err == nil {
 			if !full {
@@ -267,13 +318,36 @@ func (a *App) ExportWeChatAllData(full bool, acountName string) {
 			os.Mkdir(expPath, os.ModeDir)
 		}
 
-		go wechat.ExportWeChatAllData(*pInfo, expPath, progress)
+		if len(password) > 0 {
+			go wechat.ExportWeChatAllDataWithPassword(*pInfo, expPath, password, progress)
+		} else {
+			go wechat.ExportWeChatAllData(*pInfo, expPath, progress)
+		}
 
 		for p := range progress {
 			log.Println(p)
 			runtime.EventsEmit(a.ctx, "exportData", p)
 		}
 
+		if len(password) > 0 {
+			encProgress := make(chan string)
+			encErr := make(chan error, 1)
+			go func() {
+				encErr <- wechat.EncryptBackup(expPath, password, encProgress)
+			}()
+			for p := range encProgress {
+				log.Println(p)
+				runtime.EventsEmit(a.ctx, "exportData", p)
+			}
+			if err := <-encErr; err != nil {
+				log.Println("EncryptBackup failed:", err)
+				runtime.EventsEmit(a.ctx, "exportData", fmt.Sprintf("{\"status\":\"error\", \"result\":\"encrypt backup failed: %v\"}", err))
+			}
+			if err := wechat.UnlockBackup(expPath, password); err != nil {
+				log.Println("UnlockBackup failed:", err)
+			}
+		}
+
 		a.defaultUser = pInfo.AcountName
 		hasUser := false
 		for _, user := range a.users {
@@ -290,7 +364,7 @@ func (a *App) ExportWeChatAllData(full bool, acountName string) {
 }
 
 func (a *App) createWechatDataProvider(resPath string, prefix string) error {
-	if a.provider != nil && a.provider.SelfInfo != nil && filepath.Base(resPath) == a.provider.SelfInfo.UserName {
+	if a.provider != nil && !a.provider.IsInPlace && a.provider.SelfInfo != nil && filepath.Base(resPath) == a.provider.SelfInfo.UserName {
 		log.Println("WechatDataProvider not need create:", a.provider.SelfInfo.UserName)
 		return nil
 	}
@@ -313,6 +387,38 @@ func (a *App) createWechatDataProvider(resPath string, prefix string) error {
 	return nil
 }
 
+// WechatOpenAccountInPlace 不导出, 用找到的key直接打开正在登录的微信账号目录查看, 成功返回空字符串
+func (a *App) WechatOpenAccountInPlace(acountName string) string {
+	if a.infoList == nil {
+		return "no wechat account, call GetWeChatAllInfo first"
+	}
+
+	for i := range a.infoList.Info {
+		info := &a.infoList.Info[i]
+		if info.AcountName != acountName || len(info.DBKey) == 0 {
+			continue
+		}
+
+		if a.provider != nil {
+			a.provider.WechatWechatDataProviderClose()
+			a.provider = nil
+		}
+		prefixPath := "\\" + inPlacePrefix + "\\" + acountName
+		provider, err := wechat.CreateWechatDataProviderInPlace(info.FilePath, info.DBKey, prefixPath)
+		if err != nil {
+			log.Println("CreateWechatDataProviderInPlace failed:", info.FilePath, err)
+			return err.Error()
+		}
+		a.provider = provider
+		a.FLoader.SetInPlaceRoot(acountName, info.FilePath)
+		infoJson, _ := json.Marshal(a.provider.SelfInfo)
+		runtime.EventsEmit(a.ctx, "selfInfo", string(infoJson))
+		return ""
+	}
+
+	return fmt.Sprintf("no key of %s", acountName)
+}
+
 func (a *App) WeChatInit() {
 
 	if a.firstInit {
@@ -351,6 +457,22 @@ func (a *App) GetWechatSessionList(pageIndex int, pageSize int) string {
 	return string(listStr)
 }
 
+func (a *App) GetWechatAllSessionList(pageIndex int, pageSize int) string {
+	if a.provider == nil {
+		log.Println("provider not init")
+		return "{\"Total\":0}"
+	}
+	log.Printf("pageIndex: %d\n", pageIndex)
+	list, err := a.provider.WeChatGetAllSessionList(pageIndex, pageSize)
+	if err != nil {
+		return "{\"Total\":0}"
+	}
+
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatAllSessionList:", list.Total)
+	return string(listStr)
+}
+
 func (a *App) GetWechatContactList(pageIndex int, pageSize int) string {
 	if a.provider == nil {
 		log.Println("provider not init")
@@ -367,6 +489,84 @@ func (a *App) GetWechatContactList(pageIndex int, pageSize int) string {
 	return string(listStr)
 }
 
+func (a *App) GetWechatContactProfile(userName string) string {
+	if a.provider == nil || userName == "" {
+		log.Println("provider not init")
+		return ""
+	}
+	profile, err := a.provider.WeChatGetContactProfile(userName)
+	if err != nil {
+		log.Println("WeChatGetContactProfile failed:", err)
+		return ""
+	}
+
+	profileStr, _ := json.Marshal(profile)
+	return string(profileStr)
+}
+
+func (a *App) GetWechatContactLabelList() string {
+	if a.provider == nil {
+		log.Println("provider not init")
+		return "{\"Total\":0, \"Labels\":[]}"
+	}
+	list, err := a.provider.WeChatGetContactLabelList()
+	if err != nil {
+		log.Println("WeChatGetContactLabelList failed:", err)
+		return "{\"Total\":0, \"Labels\":[]}"
+	}
+
+	listStr, _ := json.Marshal(list)
+	return string(listStr)
+}
+
+func (a *App) GetWechatContactListByLabel(labelId int, pageIndex int, pageSize int) string {
+	if a.provider == nil {
+		log.Println("provider not init")
+		return "{\"Total\":0}"
+	}
+	list, err := a.provider.WeChatGetContactListByLabel(labelId, pageIndex, pageSize)
+	if err != nil {
+		log.Println("WeChatGetContactListByLabel failed:", err)
+		return "{\"Total\":0}"
+	}
+
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatContactListByLabel:", labelId, list.Total)
+	return string(listStr)
+}
+
+func (a *App) GetWechatContactListByCategory(category string, pageIndex int, pageSize int) string {
+	if a.provider == nil {
+		log.Println("provider not init")
+		return "{\"Total\":0}"
+	}
+	list, err := a.provider.WeChatGetContactListByCategory(category, pageIndex, pageSize)
+	if err != nil {
+		log.Println("WeChatGetContactListByCategory failed:", err)
+		return "{\"Total\":0}"
+	}
+
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatContactListByCategory:", category, list.Total)
+	return string(listStr)
+}
+
+func (a *App) GetWechatSearchContacts(query string) string {
+	if a.provider == nil {
+		log.Println("provider not init")
+		return "{\"Total\":0, \"Users\":[]}"
+	}
+	list, err := a.provider.WeChatSearchContacts(query)
+	if err != nil {
+		log.Println("WeChatSearchContacts failed:", err)
+		return "{\"Total\":0, \"Users\":[]}"
+	}
+
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatSearchContacts:", query, list.Total)
+	return string(listStr)
+}
+
 func (a *App) GetWechatMessageListByTime(userName string, time int64, pageSize int, direction string) string {
 	log.Println("GetWechatMessageListByTime:", userName, pageSize, time, direction)
 	if len(userName) == 0 {
@@ -445,6 +645,491 @@ func (a *App) GetWechatMessageDate(userName string) string {
 	return string(messageDataStr)
 }
 
+func (a *App) GetWechatMessageContext(userName string, msgSvrId string, before int, after int) string {
+	log.Println("GetWechatMessageContext:", userName, msgSvrId, before, after)
+	if a.provider == nil || len(userName) == 0 || len(msgSvrId) == 0 {
+		return "{\"Index\":-1, \"Total\":0, \"Rows\":[]}"
+	}
+
+	msgContext, err := a.provider.WeChatGetMessageContext(userName, msgSvrId, before, after)
+	if err != nil {
+		log.Println("WeChatGetMessageContext failed:", err)
+		return "{\"Index\":-1, \"Total\":0, \"Rows\":[]}"
+	}
+	msgContextStr, _ := json.Marshal(msgContext)
+	log.Println("GetWechatMessageContext:", msgContext.Total, msgContext.Index)
+
+	return string(msgContextStr)
+}
+
+func (a *App) GetWechatMessageBySvrId(userName string, msgSvrId string) string {
+	log.Println("GetWechatMessageBySvrId:", userName, msgSvrId)
+	if a.provider == nil || len(msgSvrId) == 0 {
+		return ""
+	}
+
+	message, err := a.provider.WeChatGetMessageBySvrId(userName, msgSvrId)
+	if err != nil {
+		log.Println("WeChatGetMessageBySvrId failed:", err)
+		return ""
+	}
+	messageStr, _ := json.Marshal(message)
+
+	return string(messageStr)
+}
+
+func (a *App) GetWechatPaymentLedger(userName string, startTime int64, endTime int64) string {
+	log.Println("GetWechatPaymentLedger:", userName, startTime, endTime)
+	if a.provider == nil {
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+
+	ledger, err := a.provider.WeChatGetPaymentLedger(userName, startTime, endTime)
+	if err != nil {
+		log.Println("WeChatGetPaymentLedger failed:", err)
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+	ledgerStr, _ := json.Marshal(ledger)
+	log.Println("GetWechatPaymentLedger:", ledger.Total, ledger.TotalIn, ledger.TotalOut, ledger.PendingIn, ledger.PendingOut, ledger.NoAmount)
+
+	return string(ledgerStr)
+}
+
+func (a *App) ExportWechatPaymentLedger(userName string, startTime int64, endTime int64) string {
+	if a.provider == nil {
+		return "provider not init"
+	}
+
+	savePath, err := runtime.SaveFileDialog(a.ctx, runtime.SaveDialogOptions{
+		DefaultFilename: "payment_ledger.csv",
+		Title:           "选择保存路径",
+	})
+	if err != nil {
+		log.Println("SaveFileDialog:", err)
+		return err.Error()
+	}
+
+	if savePath == "" {
+		return ""
+	}
+
+	if !utils.PathIsCanWriteFile(filepath.Dir(savePath)) {
+		errStr := "Path Is Can't Write File: " + filepath.Dir(savePath)
+		log.Println(errStr)
+		return errStr
+	}
+
+	err = a.provider.WeChatExportPaymentLedger(userName, startTime, endTime, savePath)
+	if err != nil {
+		log.Println("WeChatExportPaymentLedger failed:", err)
+		return err.Error()
+	}
+
+	return ""
+}
+
+func (a *App) GetWechatCallHistory(userName string) string {
+	log.Println("GetWechatCallHistory:", userName)
+	if a.provider == nil {
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+
+	history, err := a.provider.WeChatGetCallHistory(userName)
+	if err != nil {
+		log.Println("WeChatGetCallHistory failed:", err)
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+	historyStr, _ := json.Marshal(history)
+	log.Println("GetWechatCallHistory:", history.Total, history.TotalDuration)
+
+	return string(historyStr)
+}
+
+func (a *App) ExportWechatCallHistory(userName string, format string) string {
+	if a.provider == nil {
+		return "provider not init"
+	}
+	if format != "ics" {
+		format = "csv"
+	}
+
+	savePath, err := runtime.SaveFileDialog(a.ctx, runtime.SaveDialogOptions{
+		DefaultFilename: "call_history." + format,
+		Title:           "选择保存路径",
+	})
+	if err != nil {
+		log.Println("SaveFileDialog:", err)
+		return err.Error()
+	}
+
+	if savePath == "" {
+		return ""
+	}
+
+	if !utils.PathIsCanWriteFile(filepath.Dir(savePath)) {
+		errStr := "Path Is Can't Write File: " + filepath.Dir(savePath)
+		log.Println(errStr)
+		return errStr
+	}
+
+	err = a.provider.WeChatExportCallHistory(userName, savePath, format)
+	if err != nil {
+		log.Println("WeChatExportCallHistory failed:", err)
+		return err.Error()
+	}
+
+	return ""
+}
+
+func (a *App) GetWechatLocationList(userName string) string {
+	log.Println("GetWechatLocationList:", userName)
+	if a.provider == nil {
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+
+	list, err := a.provider.WeChatGetLocationList(userName)
+	if err != nil {
+		log.Println("WeChatGetLocationList failed:", err)
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatLocationList:", list.Total)
+
+	return string(listStr)
+}
+
+func (a *App) ExportWechatLocations(userName string, format string) string {
+	if a.provider == nil {
+		return "provider not init"
+	}
+	if format != "kml" {
+		format = "geojson"
+	}
+
+	savePath, err := runtime.SaveFileDialog(a.ctx, runtime.SaveDialogOptions{
+		DefaultFilename: "locations." + format,
+		Title:           "选择保存路径",
+	})
+	if err != nil {
+		log.Println("SaveFileDialog:", err)
+		return err.Error()
+	}
+
+	if savePath == "" {
+		return ""
+	}
+
+	if !utils.PathIsCanWriteFile(filepath.Dir(savePath)) {
+		errStr := "Path Is Can't Write File: " + filepath.Dir(savePath)
+		log.Println(errStr)
+		return errStr
+	}
+
+	err = a.provider.WeChatExportLocations(userName, savePath, format)
+	if err != nil {
+		log.Println("WeChatExportLocations failed:", err)
+		return err.Error()
+	}
+
+	return ""
+}
+
+func (a *App) ExportWechatVCard(scope string, target string) string {
+	if a.provider == nil {
+		return "provider not init"
+	}
+
+	savePath, err := runtime.SaveFileDialog(a.ctx, runtime.SaveDialogOptions{
+		DefaultFilename: "contacts.vcf",
+		Title:           "选择保存路径",
+	})
+	if err != nil {
+		log.Println("SaveFileDialog:", err)
+		return err.Error()
+	}
+
+	if savePath == "" {
+		return ""
+	}
+
+	if !utils.PathIsCanWriteFile(filepath.Dir(savePath)) {
+		errStr := "Path Is Can't Write File: " + filepath.Dir(savePath)
+		log.Println(errStr)
+		return errStr
+	}
+
+	_, err = a.provider.WeChatExportVCard(scope, target, savePath)
+	if err != nil {
+		log.Println("WeChatExportVCard failed:", err)
+		return err.Error()
+	}
+
+	return ""
+}
+
+// GetWechatSnsTimeline time和feedKey传上一页返回的NextCreateTime和NextFeedKey, 第一页都为空
+func (a *App) GetWechatSnsTimeline(userName string, time int64, feedKey string, pageSize int) string {
+	log.Println("GetWechatSnsTimeline:", userName, time, feedKey, pageSize)
+	if a.provider == nil {
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+
+	sns, err := a.provider.WeChatGetSnsProvider()
+	if err != nil {
+		log.Println("WeChatGetSnsProvider failed:", err)
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+
+	list, err := sns.SnsGetTimeline(userName, time, feedKey, pageSize)
+	if err != nil {
+		log.Println("SnsGetTimeline failed:", err)
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatSnsTimeline:", list.Total)
+
+	return string(listStr)
+}
+
+func (a *App) ExportWechatSnsTimeline(userName string, format string) string {
+	if a.provider == nil {
+		return "provider not init"
+	}
+	if format != "html" {
+		format = "json"
+	}
+
+	sns, err := a.provider.WeChatGetSnsProvider()
+	if err != nil {
+		log.Println("WeChatGetSnsProvider failed:", err)
+		return err.Error()
+	}
+
+	savePath, err := runtime.SaveFileDialog(a.ctx, runtime.SaveDialogOptions{
+		DefaultFilename: "sns." + format,
+		Title:           "选择保存路径",
+	})
+	if err != nil {
+		log.Println("SaveFileDialog:", err)
+		return err.Error()
+	}
+
+	if savePath == "" {
+		return ""
+	}
+
+	if !utils.PathIsCanWriteFile(filepath.Dir(savePath)) {
+		errStr := "Path Is Can't Write File: " + filepath.Dir(savePath)
+		log.Println(errStr)
+		return errStr
+	}
+
+	err = sns.SnsExportTimeline(userName, savePath, format)
+	if err != nil {
+		log.Println("SnsExportTimeline failed:", err)
+		return err.Error()
+	}
+
+	return ""
+}
+
+func (a *App) GetWechatFavoriteList(favType int, tag string, pageIndex int, pageSize int) string {
+	log.Println("GetWechatFavoriteList:", favType, tag, pageIndex, pageSize)
+	if a.provider == nil {
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+
+	fav, err := a.provider.WeChatGetFavoriteProvider()
+	if err != nil {
+		log.Println("WeChatGetFavoriteProvider failed:", err)
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+
+	list, err := fav.FavGetList(favType, tag, pageIndex, pageSize)
+	if err != nil {
+		log.Println("FavGetList failed:", err)
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatFavoriteList:", list.Total)
+
+	return string(listStr)
+}
+
+func (a *App) SearchWechatFavorite(keyWord string) string {
+	if a.provider == nil {
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+
+	fav, err := a.provider.WeChatGetFavoriteProvider()
+	if err != nil {
+		log.Println("WeChatGetFavoriteProvider failed:", err)
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+
+	list, err := fav.FavSearch(keyWord)
+	if err != nil {
+		log.Println("FavSearch failed:", err)
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("SearchWechatFavorite:", keyWord, list.Total)
+
+	return string(listStr)
+}
+
+func (a *App) GetWechatFavoriteTagList() string {
+	if a.provider == nil {
+		return "{\"Total\":0, \"Tags\":[]}"
+	}
+
+	fav, err := a.provider.WeChatGetFavoriteProvider()
+	if err != nil {
+		log.Println("WeChatGetFavoriteProvider failed:", err)
+		return "{\"Total\":0, \"Tags\":[]}"
+	}
+
+	list, err := fav.FavGetTagList()
+	if err != nil {
+		log.Println("FavGetTagList failed:", err)
+		return "{\"Total\":0, \"Tags\":[]}"
+	}
+	listStr, _ := json.Marshal(list)
+
+	return string(listStr)
+}
+
+func (a *App) ExportWechatFavorite(path string) string {
+	if a.provider == nil || path == "" {
+		return "invaild params"
+	}
+
+	if !utils.PathIsCanWriteFile(path) {
+		log.Println("PathIsCanWriteFile: " + path)
+		return "PathIsCanWriteFile: " + path
+	}
+
+	fav, err := a.provider.WeChatGetFavoriteProvider()
+	if err != nil {
+		log.Println("WeChatGetFavoriteProvider failed:", err)
+		return err.Error()
+	}
+
+	exPath := path + "\\" + "wechatFavorite_" + a.provider.SelfInfo.UserName
+	err = fav.FavExport(exPath)
+	if err != nil {
+		log.Println("FavExport failed:", err)
+		return "FavExport failed:" + err.Error()
+	}
+
+	return ""
+}
+
+func (a *App) GetWechatPublicAccountList() string {
+	if a.provider == nil {
+		return "{\"Total\":0, \"Users\":[]}"
+	}
+
+	list, err := a.provider.WeChatGetPublicAccountList()
+	if err != nil {
+		log.Println("WeChatGetPublicAccountList failed:", err)
+		return "{\"Total\":0, \"Users\":[]}"
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatPublicAccountList:", list.Total)
+
+	return string(listStr)
+}
+
+func (a *App) GetWechatArticleList(userName string, time int64, pageSize int) string {
+	log.Println("GetWechatArticleList:", userName, time, pageSize)
+	if a.provider == nil {
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+
+	list, err := a.provider.WeChatGetArticleList(userName, time, pageSize)
+	if err != nil {
+		log.Println("WeChatGetArticleList failed:", err)
+		return "{\"Total\":0, \"Rows\":[]}"
+	}
+	listStr, _ := json.Marshal(list)
+	log.Println("GetWechatArticleList:", list.Total)
+
+	return string(listStr)
+}
+
+func (a *App) ExportWechatReadingList(userName string, format string) string {
+	if a.provider == nil {
+		return "provider not init"
+	}
+	if format != "html" {
+		format = "md"
+	}
+
+	savePath, err := runtime.SaveFileDialog(a.ctx, runtime.SaveDialogOptions{
+		DefaultFilename: "reading_list." + format,
+		Title:           "选择保存路径",
+	})
+	if err != nil {
+		log.Println("SaveFileDialog:", err)
+		return err.Error()
+	}
+
+	if savePath == "" {
+		return ""
+	}
+
+	if !utils.PathIsCanWriteFile(filepath.Dir(savePath)) {
+		errStr := "Path Is Can't Write File: " + filepath.Dir(savePath)
+		log.Println(errStr)
+		return errStr
+	}
+
+	err = a.provider.WeChatExportReadingList(userName, savePath, format)
+	if err != nil {
+		log.Println("WeChatExportReadingList failed:", err)
+		return err.Error()
+	}
+
+	return ""
+}
+
+func (a *App) GetWeChatBackupIsLocked(acountName string) bool {
+	return wechat.IsBackupLocked(a.FLoader.FilePrefix + "\\User\\" + acountName)
+}
+
+// UnlockWeChatBackup 解锁加密的导出, 成功返回空字符串
+func (a *App) UnlockWeChatBackup(acountName string, password string) string {
+	resPath := a.FLoader.FilePrefix + "\\User\\" + acountName
+	if err := wechat.UnlockBackup(resPath, password); err != nil {
+		log.Println("UnlockBackup failed:", err)
+		return err.Error()
+	}
+
+	a.scanAccountByPath(a.FLoader.FilePrefix)
+	return ""
+}
+
+// UnlockKeyStore 用口令打开保存数据库key的keystore, 成功返回空字符串
+func (a *App) UnlockKeyStore(passphrase string) string {
+	store, err := wechat.OpenKeyStore(wechat.DefaultKeyStorePath(), passphrase)
+	if err != nil {
+		log.Println("OpenKeyStore failed:", err)
+		return err.Error()
+	}
+	wechat.SetDefaultKeyStore(store)
+	return ""
+}
+
+func (a *App) LockWeChatBackup(acountName string) {
+	resPath := a.FLoader.FilePrefix + "\\User\\" + acountName
+	if a.provider != nil && a.provider.SelfInfo != nil && a.provider.SelfInfo.UserName == acountName {
+		a.provider.WechatWechatDataProviderClose()
+		a.provider = nil
+	}
+	wechat.LockBackup(resPath)
+}
+
 func (a *App) setCurrentConfig() {
 	viper.Set(configDefaultUserKey, a.defaultUser)
 	viper.Set(configUsersKey, a.users)
@@ -481,6 +1166,11 @@ func (a *App) OpenFileOrExplorer(filePath string, explorer bool) string {
 	// log.Println("OpenFileOrExplorer:", filePath)
 
 	path := a.FLoader.FilePrefix + filePath
+	if !explorer {
+		if plainPath, err := wechat.BackupPlainFilePath(path); err == nil {
+			path = plainPath
+		}
+	}
 	err := utils.OpenFileOrExplorer(path, explorer)
 	if err != nil {
 		return "{\"result\": \"OpenFileOrExplorer failed\", \"status\":\"failed\"}"
@@ -706,7 +1396,7 @@ func (a *App) SaveFileDialog(file string, alisa string) string {
 		return errStr
 	}
 
-	_, err = utils.CopyFile(filePath, savePath)
+	_, err = wechat.CopyBackupFile(filePath, savePath)
 	if err != nil {
 		log.Println("Error CopyFile", filePath, savePath, err)
 		return err.Error()
@@ -31,6 +31,7 @@ const (
 	Wechat_Message_Type_Misc       = 49
 	Wechat_Message_Type_Voip       = 50
 	Wechat_Message_Type_System     = 10000
+	Wechat_Message_Type_SysNotice  = 10002
 )
 
 const (
@@ -57,6 +58,8 @@ type Dialogue struct {
 	Speaker string `json:"speaker"`
 	Text    string `json:"text"`
 	Time    string `json:"time"`
+	// 合并转发的聊天记录, 嵌套的记录在里层的records里
+	Records []Dialogue `json:"records,omitempty"`
 }
 
 type ChatSession struct {
@@ -89,6 +92,7 @@ type WeChatMessage struct {
 	} `json:"userInfo"`
 	// 添加用于存储解析后的文件路径
 	bytesExtra []byte
+	compressContent []byte
 }
 
 type Contact struct {
@@ -743,6 +747,13 @@ func (ce *ChatExtractor) GetMessageText(msg WeChatMessage) string {
 		case Wechat_Misc_Message_CustomEmoji, Wechat_Misc_Message_ShareEmoji:
 			return "[自定义表情]"
 		case Wechat_Misc_Message_ForwardMessage:
+			// 展开合并转发的聊天记录
+			if content, err := wechat.UncompressContent(msg.compressContent); err == nil {
+				info := wechat.ParseForwardInfo(string(content))
+				if len(info.Items) > 0 {
+					return fmt.Sprintf("[转发消息] %s\n%s", info.Title, strings.TrimRight(wechat.ForwardInfoText(&info, "    "), "\n"))
+				}
+			}
 			// 使用解析后的路径
 			if msg.ThumbPath != "" {
 				return fmt.Sprintf("[转发消息] %s %s", msg.Content, msg.ThumbPath)
@@ -777,8 +788,15 @@ func (ce *ChatExtractor) GetMessageText(msg WeChatMessage) string {
 		}
 	case Wechat_Message_Type_Voip:
 		return "[通话]"
-	case Wechat_Message_Type_System:
-		return "[系统消息] " + msg.Content
+	case Wechat_Message_Type_System, Wechat_Message_Type_SysNotice:
+		info := wechat.ParseSystemInfo(msg.Content, func(userName string) string {
+			if userName == ce.SelfWxId {
+				return "我"
+			}
+			nickName, _ := ce.GetUserInfo(userName)
+			return nickName
+		})
+		return "[系统消息] " + info.Text
 	default:
 		return msg.Content
 	}
@@ -830,6 +848,7 @@ func (ce *ChatExtractor) GetAllMessages() ([]WeChatMessage, error) {
 			msg.Content = strContent
 			msg.IsChatRoom = strings.HasSuffix(strTalker, "@chatroom")
 			msg.bytesExtra = bytesExtra
+			msg.compressContent = compressContent
 
 			// 解析BytesExtra获取文件路径
 			ce.parseBytesExtra(&msg)
@@ -895,6 +914,7 @@ func (ce *ChatExtractor) ExtractChatHistory() ([]ChatSession, error) {
 			Speaker: speaker,
 			Text:    text,
 			Time:    timeStr,
+			Records: forwardDialogues(msg),
 		})
 	}
 
@@ -907,6 +927,37 @@ func (ce *ChatExtractor) ExtractChatHistory() ([]ChatSession, error) {
 	return []ChatSession{session}, nil
 }
 
+// 合并转发消息里的聊天记录转成对话, 不是合并转发时返回nil
+func forwardDialogues(msg WeChatMessage) []Dialogue {
+	if msg.Type != Wechat_Message_Type_Misc || msg.SubType != Wechat_Misc_Message_ForwardMessage {
+		return nil
+	}
+	content, err := wechat.UncompressContent(msg.compressContent)
+	if err != nil {
+		return nil
+	}
+	info := wechat.ParseForwardInfo(string(content))
+	return forwardItemDialogues(info.Items)
+}
+
+func forwardItemDialogues(items []wechat.WeChatMessage) []Dialogue {
+	var dialogues []Dialogue
+	for i := range items {
+		item := &items[i]
+		dialogue := Dialogue{
+			Index:   i + 1,
+			Speaker: item.UserInfo.NickName,
+			Text:    wechat.ForwardItemText(item),
+			Time:    formatTime(item.CreateTime),
+		}
+		if item.Type == wechat.Wechat_Message_Type_Misc && item.SubType == wechat.Wechat_Misc_Message_ForwardMessage {
+			dialogue.Records = forwardItemDialogues(item.ForwardInfo.Items)
+		}
+		dialogues = append(dialogues, dialogue)
+	}
+	return dialogues
+}
+
 // 获取所有联系人
 func getAllContacts(microMsgDB *sql.DB, dataPath string) ([]Contact, error) {
 	var contacts []Contact
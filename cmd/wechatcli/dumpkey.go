@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"wechatDataBackup/pkg/wechat"
+)
+
+// dumpKeyCommand 从离线的内存转储里找数据库key, 不需要在Windows上运行
+func dumpKeyCommand(args []string) error {
+	flags := flag.NewFlagSet("dumpkey", flag.ExitOnError)
+	dumpPath := flags.String("dump", "", "微信进程的minidump或原始内存文件")
+	dbPath := flags.String("db", "", "拷贝出来的Media.db或MicroMsg.db, 用来校验key")
+	baseAddr := flags.String("base", "0", "原始内存文件开始的地址, minidump不需要")
+	moduleBase := flags.String("module-base", "", "WeChatWin.dll的基址, 原始内存默认等于-base")
+	moduleSize := flags.Uint("module-size", 0, "WeChatWin.dll的大小, 原始内存默认到文件结尾")
+	is32Bits := flags.Bool("32bit", false, "原始内存是32位微信的")
+	keyFile := flags.String("keyfile", "", "找到的key保存到这个文件")
+	signatures := flags.String("signatures", "", "找key的特征文件, 默认用内置的特征")
+	flags.Parse(args)
+
+	if len(*dumpPath) == 0 || len(*dbPath) == 0 {
+		flags.Usage()
+		return fmt.Errorf("-dump and -db are required")
+	}
+
+	if len(*signatures) > 0 {
+		if err := wechat.LoadKeySignatures(*signatures); err != nil {
+			return fmt.Errorf("load %s failed: %v", *signatures, err)
+		}
+	}
+
+	base, err := strconv.ParseUint(*baseAddr, 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid -base %s", *baseAddr)
+	}
+	dump, err := wechat.OpenMemoryDump(*dumpPath, base, !*is32Bits)
+	if err != nil {
+		return err
+	}
+	defer dump.Close()
+
+	info := wechat.WeChatInfo{}
+	if len(dump.Modules) == 0 {
+		// 原始内存没有模块列表
+		info.DllBaseAddr = uintptr(base)
+		if len(*moduleBase) > 0 {
+			addr, err := strconv.ParseUint(*moduleBase, 0, 64)
+			if err != nil {
+				return fmt.Errorf("invalid -module-base %s", *moduleBase)
+			}
+			info.DllBaseAddr = uintptr(addr)
+		}
+		fileInfo, err := os.Stat(*dumpPath)
+		if err != nil {
+			return err
+		}
+		// WeChatWin.dll必须完整地在原始内存的范围里
+		end := base + uint64(fileInfo.Size())
+		if uint64(info.DllBaseAddr) < base || uint64(info.DllBaseAddr) >= end {
+			return fmt.Errorf("-module-base 0x%X not in dump range 0x%X-0x%X", info.DllBaseAddr, base, end)
+		}
+		size := uint64(*moduleSize)
+		if size == 0 {
+			size = min(end-uint64(info.DllBaseAddr), 0xFFFFFFFF)
+		}
+		if size > end-uint64(info.DllBaseAddr) || size > 0xFFFFFFFF {
+			return fmt.Errorf("-module-size 0x%X exceeds dump range", size)
+		}
+		info.DllBaseSize = uint32(size)
+	}
+
+	key, report, err := wechat.GetWeChatKeyFromDump(dump, &info, *dbPath)
+	if report != nil {
+		fmt.Println(report)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("key:", key)
+	if len(*keyFile) > 0 {
+		return os.WriteFile(*keyFile, []byte(key), 0600)
+	}
+	return nil
+}
+
+// signaturesCommand 输出内置的找key特征, 改好后用dumpkey -signatures或放到程序目录下的KeySignatures.json
+func signaturesCommand(args []string) error {
+	flags := flag.NewFlagSet("signatures", flag.ExitOnError)
+	outPath := flags.String("out", "", "保存到这个文件, 默认输出到标准输出")
+	flags.Parse(args)
+
+	data, err := json.MarshalIndent(wechat.GetKeySignatures(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if len(*outPath) > 0 {
+		return os.WriteFile(*outPath, data, 0644)
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"wechatDataBackup/pkg/wechat"
+)
+
+type progressMsg struct {
+	Status   string                `json:"status"`
+	Result   string                `json:"result"`
+	Progress int                   `json:"progress"`
+	Report   *wechat.DecryptReport `json:"report"`
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [options]\n\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "commands:\n")
+	fmt.Fprintf(os.Stderr, "  decrypt    用已知的key离线解密账号目录下的数据库\n")
+	fmt.Fprintf(os.Stderr, "  dumpkey    从微信进程的内存转储里找数据库key\n")
+	fmt.Fprintf(os.Stderr, "  signatures 输出找key的特征, 可以修改后给dumpkey使用\n")
+	fmt.Fprintf(os.Stderr, "  keys       查看或删除keystore里保存的key\n")
+}
+
+func main() {
+	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "decrypt":
+		err = decryptCommand(os.Args[2:])
+	case "dumpkey":
+		err = dumpKeyCommand(os.Args[2:])
+	case "signatures":
+		err = signaturesCommand(os.Args[2:])
+	case "keys":
+		err = keysCommand(os.Args[2:])
+	case "-h", "--help", "help":
+		usage()
+		return
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func readKey(key, keyFile string) (string, error) {
+	if len(key) == 0 && len(keyFile) > 0 {
+		buf, err := os.ReadFile(keyFile)
+		if err != nil {
+			return "", err
+		}
+		key = string(buf)
+	}
+
+	key = strings.TrimSpace(key)
+	if len(key) == 0 {
+		return "", fmt.Errorf("-key or -keyfile is required")
+	}
+	return key, nil
+}
+
+func decryptCommand(args []string) error {
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	accountPath := flags.String("path", "", "微信账号目录, 例如 \"WeChat Files/wxid_xxx\"")
+	key := flags.String("key", "", "数据库key(64位十六进制)")
+	keyFile := flags.String("keyfile", "", "保存key的文件")
+	outPath := flags.String("out", ".", "导出根目录, 数据会放在 <out>/User/<wxid> 下")
+	wxid := flags.String("wxid", "", "账号名, 默认取账号目录名")
+	password := flags.String("password", "", "解密后用这个密码加密导出目录(导出数据本地加密)")
+	badPage := flags.String("badpage", "zero", "HMAC校验失败的页: zero写全0, fail直接失败")
+	integrity := flags.Bool("integrity", true, "解密后执行PRAGMA integrity_check")
+	keyStorePath := flags.String("keystore", wechat.DefaultKeyStorePath(), "保存key的keystore, 没有-key和-keyfile时从这里取")
+	keyStorePass := flags.String("keystore-pass", "", "keystore的口令, 为空时用系统的保护方式")
+	saveKey := flags.Bool("save-key", true, "解密成功后把key保存到keystore")
+	force := flags.Bool("force", false, "导出目录不是之前的导出, 或者不带密码覆盖加密的导出时也继续, 会删除原有数据")
+	flags.Parse(args)
+
+	if len(*accountPath) == 0 {
+		flags.Usage()
+		return fmt.Errorf("-path is required")
+	}
+
+	var err error
+	opts := wechat.DefaultDecryptOptions
+	opts.IntegrityCheck = *integrity
+	if opts.BadPage, err = wechat.ParseBadPagePolicy(*badPage); err != nil {
+		return err
+	}
+
+	info := wechat.WeChatInfo{}
+	info.FilePath = filepath.Clean(*accountPath)
+	info.AcountName = *wxid
+	if len(info.AcountName) == 0 {
+		info.AcountName = filepath.Base(info.FilePath)
+	}
+
+	store, storeErr := wechat.OpenKeyStore(*keyStorePath, *keyStorePass)
+	if len(*key) == 0 && len(*keyFile) == 0 {
+		if storeErr != nil {
+			return fmt.Errorf("-key or -keyfile is required, open keystore failed: %v", storeErr)
+		}
+		// keystore里的key取出时已经用账号目录下的数据库重新校验过
+		if info.DBKey, err = store.LoadKey(info.AcountName, info.FilePath); err != nil {
+			return fmt.Errorf("-key or -keyfile is required, no usable key of %s in keystore: %v", info.AcountName, err)
+		}
+		fmt.Println("use key from keystore:", store.Path())
+	} else {
+		if info.DBKey, err = readKey(*key, *keyFile); err != nil {
+			return err
+		}
+		if storeErr != nil && *saveKey {
+			fmt.Fprintln(os.Stderr, "warning: open keystore failed:", storeErr)
+		}
+	}
+
+	expPath := filepath.Join(*outPath, "User", info.AcountName)
+	if err := wechat.CheckBackupPassword(expPath, *password); err != nil && len(*password) > 0 {
+		return err
+	}
+	if err := prepareExportPath(expPath, len(*password) > 0, *force); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(expPath, os.ModePerm); err != nil {
+		return err
+	}
+	if len(*password) > 0 {
+		// 数据库解密后直接加密写入, 其它文件最后再加密
+		if err := opts.SetBackupPassword(expPath, *password); err != nil {
+			return err
+		}
+	}
+
+	progress := make(chan string)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- wechat.DecryptWeChatDataBase(info, expPath, opts, progress)
+	}()
+
+	// 数据库解密只占整体导出进度的前20%
+	_, corrupt := printProgress(progress, 5)
+
+	// 解密失败的数量由DecryptWeChatDataBase直接返回, 不依赖解析进度信息
+	if err := <-errChan; err != nil {
+		return err
+	}
+	if *saveKey && storeErr == nil {
+		if err := store.SaveKey(&info); err != nil {
+			fmt.Fprintln(os.Stderr, "warning: save key failed:", err)
+		}
+	}
+
+	if len(*password) > 0 {
+		if err := encryptBackup(expPath, *password); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("decrypt done:", expPath)
+	if corrupt > 0 {
+		return fmt.Errorf("%d database has bad pages or failed integrity check", corrupt)
+	}
+	return nil
+}
+
+// prepareExportPath 删除上次导出的数据库准备重新解密, 不是之前的导出或者会丢掉加密的导出时需要-force
+func prepareExportPath(expPath string, hasPassword bool, force bool) error {
+	entries, err := os.ReadDir(expPath)
+	if os.IsNotExist(err) || (err == nil && len(entries) == 0) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !hasPassword && wechat.IsBackupEncrypted(expPath) {
+		if !force {
+			return fmt.Errorf("%s is an encrypted export, use -password to merge or -force to replace it", expPath)
+		}
+		// 没有密码没法和原来加密的数据合并, 全部重新导出
+		return os.RemoveAll(expPath)
+	}
+
+	_, err = os.Stat(filepath.Join(expPath, "Msg", wechat.MicroMsgDB))
+	if err != nil && !wechat.IsBackupEncrypted(expPath) && !force {
+		return fmt.Errorf("%s exists and is not an earlier export, use -force to overwrite it", expPath)
+	}
+	return os.RemoveAll(filepath.Join(expPath, "Msg"))
+}
+
+// printProgress 返回失败的数量和解密校验有问题的数据库数量
+func printProgress(progress <-chan string, scale int) (int, int) {
+	failed := 0
+	corrupt := 0
+	for p := range progress {
+		msg := progressMsg{}
+		if json.Unmarshal([]byte(p), &msg) != nil {
+			log.Println(p)
+			continue
+		}
+		if msg.Status == "error" {
+			failed += 1
+			fmt.Fprintln(os.Stderr, "error:", msg.Result)
+			continue
+		}
+		if msg.Report != nil {
+			if msg.Report.HasError() {
+				corrupt += 1
+				fmt.Fprintln(os.Stderr, "warning:", msg.Report)
+				for _, page := range msg.Report.BadPages {
+					fmt.Fprintf(os.Stderr, "  page %d offset 0x%X: %s\n", page.Page, page.Offset, page.Reason)
+				}
+			} else if msg.Report.WalFrames > 0 {
+				fmt.Println("      ", msg.Report)
+			}
+			continue
+		}
+		fmt.Printf("[%3d%%] %s\n", msg.Progress*scale, msg.Result)
+	}
+	return failed, corrupt
+}
+
+func encryptBackup(expPath string, password string) error {
+	progress := make(chan string)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- wechat.EncryptBackup(expPath, password, progress)
+	}()
+
+	failed, _ := printProgress(progress, 1)
+	if err := <-errChan; err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d file encrypt failed", failed)
+	}
+	return nil
+}
+
+func keysCommand(args []string) error {
+	flags := flag.NewFlagSet("keys", flag.ExitOnError)
+	keyStorePath := flags.String("keystore", wechat.DefaultKeyStorePath(), "保存key的keystore")
+	keyStorePass := flags.String("keystore-pass", "", "keystore的口令, 为空时用系统的保护方式")
+	deleteName := flags.String("delete", "", "删除这个账号的key")
+	flags.Parse(args)
+
+	store, err := wechat.OpenKeyStore(*keyStorePath, *keyStorePass)
+	if err != nil {
+		return err
+	}
+	if len(*deleteName) > 0 {
+		return store.DeleteKey(*deleteName)
+	}
+
+	fmt.Println("keystore:", store.Path())
+	for _, account := range store.Accounts() {
+		status := "ok"
+		if _, err := store.LoadKey(account.AcountName, ""); err != nil {
+			status = err.Error()
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n", account.AcountName, account.Cipher,
+			time.Unix(account.Updated, 0).Format("2006-01-02 15:04:05"), account.FilePath, status)
+	}
+	return nil
+}
@@ -16,7 +16,6 @@ import (
 	"github.com/pkg/browser"
 	"github.com/shirou/gopsutil/v3/disk"
 	"golang.org/x/net/html"
-	"golang.org/x/sys/windows/registry"
 )
 
 type PathStat struct {
@@ -27,22 +26,6 @@ type PathStat struct {
 	UsedPercent float64 `json:"usedPercent"`
 }
 
-func getDefaultProgram(fileExtension string) (string, error) {
-	key, err := registry.OpenKey(registry.CLASSES_ROOT, fmt.Sprintf(`.%s`, fileExtension), registry.QUERY_VALUE)
-	if err != nil {
-		return "", err
-	}
-	defer key.Close()
-
-	// 读取默认程序关联值
-	defaultProgram, _, err := key.GetStringValue("")
-	if err != nil {
-		return "", err
-	}
-
-	return defaultProgram, nil
-}
-
 func hasDefaultProgram(fileExtension string) bool {
 	prog, err := getDefaultProgram(fileExtension)
 	if err != nil {
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package utils
+
+import "errors"
+
+func getDefaultProgram(fileExtension string) (string, error) {
+	return "", errors.New("not supported")
+}
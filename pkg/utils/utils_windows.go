@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+func getDefaultProgram(fileExtension string) (string, error) {
+	key, err := registry.OpenKey(registry.CLASSES_ROOT, fmt.Sprintf(`.%s`, fileExtension), registry.QUERY_VALUE)
+	if err != nil {
+		return "", err
+	}
+	defer key.Close()
+
+	// 读取默认程序关联值
+	defaultProgram, _, err := key.GetStringValue("")
+	if err != nil {
+		return "", err
+	}
+
+	return defaultProgram, nil
+}
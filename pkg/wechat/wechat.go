@@ -1,30 +1,24 @@
 package wechat
 
 import (
-	"bufio"
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha1"
-	"database/sql"
-	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
-	"unsafe"
 
 	"github.com/git-jiadong/go-lame"
 	"github.com/git-jiadong/go-silk"
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/shirou/gopsutil/v3/process"
-	"golang.org/x/sys/windows"
 )
 
 type WeChatInfo struct {
@@ -36,6 +30,8 @@ type WeChatInfo struct {
 	DllBaseAddr uintptr
 	DllBaseSize uint32
 	DBKey       string
+	// 从内存找key的过程, 找不到key时可以看每种特征走到哪一步
+	KeyReport *KeySearchReport
 }
 
 type WeChatInfoList struct {
@@ -54,24 +50,29 @@ type wechatHeadImgMSG struct {
 	Buf      []byte
 }
 
-func GetWeChatAllInfo() *WeChatInfoList {
-	list := GetWeChatInfo()
+func ExportWeChatAllData(info WeChatInfo, expPath string, progress chan<- string) {
+	exportWeChatAllData(info, expPath, DefaultDecryptOptions, progress)
+}
 
-	for i := range list.Info {
-		list.Info[i].DBKey = GetWeChatKey(&list.Info[i])
+// ExportWeChatAllDataWithPassword 数据库直接加密导出, 图片语音等文件导出时还是明文, 导出后要再调用EncryptBackup加密
+func ExportWeChatAllDataWithPassword(info WeChatInfo, expPath string, password string, progress chan<- string) {
+	opts := DefaultDecryptOptions
+	if err := opts.SetBackupPassword(expPath, password); err != nil {
+		progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v\"}", err)
+		close(progress)
+		return
 	}
-
-	return list
+	exportWeChatAllData(info, expPath, opts, progress)
 }
 
-func ExportWeChatAllData(info WeChatInfo, expPath string, progress chan<- string) {
+func exportWeChatAllData(info WeChatInfo, expPath string, opts DecryptOptions, progress chan<- string) {
 	defer close(progress)
 	fileInfo, err := os.Stat(info.FilePath)
 	if err != nil || !fileInfo.IsDir() {
 		progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%s error\"}", info.FilePath)
 		return
 	}
-	if !exportWeChatDateBase(info, expPath, progress) {
+	if _, ok := exportWeChatDateBase(info, expPath, opts, progress); !ok {
 		return
 	}
 
@@ -81,6 +82,36 @@ func ExportWeChatAllData(info WeChatInfo, expPath string, progress chan<- string
 	exportWeChatHeadImage(info, expPath, progress)
 }
 
+// DecryptWeChatDataBase 不需要微信进程, 用已知的key把账号目录下Msg里的数据库解密到expPath, 目录结构和ExportWeChatAllData一样
+func DecryptWeChatDataBase(info WeChatInfo, expPath string, opts DecryptOptions, progress chan<- string) error {
+	defer close(progress)
+	msgPath := filepath.Join(info.FilePath, "Msg")
+	fileInfo, err := os.Stat(msgPath)
+	if err != nil || !fileInfo.IsDir() {
+		progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%s error\"}", info.FilePath)
+		return fmt.Errorf("%s not exist", msgPath)
+	}
+
+	dbKey, err := hex.DecodeString(info.DBKey)
+	if err != nil || len(dbKey) != keySize {
+		return fmt.Errorf("invalid key: %s", info.DBKey)
+	}
+
+	if !checkDataBaseKey(filepath.Join(msgPath, MicroMsgDB), dbKey) {
+		return errors.New("incorrect key")
+	}
+
+	failed, ok := exportWeChatDateBase(info, expPath, opts, progress)
+	if !ok {
+		return errors.New("export DataBase failed")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d database decrypt failed", failed)
+	}
+
+	return nil
+}
+
 func exportWeChatHeadImage(info WeChatInfo, expPath string, progress chan<- string) {
 	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Head Image\", \"progress\": 81}"
 
@@ -109,12 +140,12 @@ func exportWeChatHeadImage(info WeChatInfo, expPath string, progress chan<- stri
 				break
 			}
 
-			db, err := sql.Open("sqlite3", miscDBPath)
+			db, err := openBackupDataBase(miscDBPath)
 			if err != nil {
 				log.Printf("open %s failed: %v\n", miscDBPath, err)
 				break
 			}
-			defer db.Close()
+			defer closeDataBase(db)
 
 			err = db.QueryRow("select count(*) from ContactHeadImg1;").Scan(&fileNumber)
 			if err != nil {
@@ -234,12 +265,12 @@ func exportWeChatVoice(info WeChatInfo, expPath string, progress chan<- string)
 				break
 			}
 
-			db, err := sql.Open("sqlite3", mediaMSGDB)
+			db, err := openBackupDataBase(mediaMSGDB)
 			if err != nil {
 				log.Printf("open %s failed: %v\n", mediaMSGDB, err)
 				continue
 			}
-			defer db.Close()
+			defer closeDataBase(db)
 
 			rows, err := db.Query("select Key, Reserved0, Buf from Media;")
 			if err != nil {
@@ -310,8 +341,9 @@ func exportWeChatVideoAndFile(info WeChatInfo, expPath string, progress chan<- s
 	videoRootPath := info.FilePath + "\\FileStorage\\Video"
 	fileRootPath := info.FilePath + "\\FileStorage\\File"
 	cacheRootPath := info.FilePath + "\\FileStorage\\Cache"
+	emotionRootPath := info.FilePath + "\\FileStorage\\CustomEmotion"
 
-	rootPaths := []string{videoRootPath, fileRootPath, cacheRootPath}
+	rootPaths := []string{videoRootPath, fileRootPath, cacheRootPath, emotionRootPath}
 
 	handleNumber := int64(0)
 	fileNumber := int64(0)
@@ -494,25 +526,45 @@ func exportWeChatBat(info WeChatInfo, expPath string, progress chan<- string) {
 	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat Dat end\", \"progress\": 40}"
 }
 
-func exportWeChatDateBase(info WeChatInfo, expPath string, progress chan<- string) bool {
+// progressError 错误信息里可能有Windows路径的反斜杠, 用json.Marshal转义
+func progressError(result string) string {
+	resultJson, _ := json.Marshal(result)
+	return fmt.Sprintf("{\"status\":\"error\", \"result\":%s}", resultJson)
+}
+
+// exportWeChatDateBase 返回解密失败的数据库数量, 没能开始解密时返回false
+func exportWeChatDateBase(info WeChatInfo, expPath string, opts DecryptOptions, progress chan<- string) (int, bool) {
 
 	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat DateBase start\", \"progress\": 1}"
 
 	dbKey, err := hex.DecodeString(info.DBKey)
 	if err != nil {
 		log.Println("DecodeString:", err)
-		progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v\"}", err)
-		return false
+		progress <- progressError(err.Error())
+		return 0, false
+	}
+	if len(dbKey) != keySize {
+		reason := "key not found"
+		reportJson := []byte("null")
+		if info.KeyReport != nil {
+			reason += ": " + info.KeyReport.Reason
+			reportJson, _ = json.Marshal(info.KeyReport)
+		}
+		log.Println(reason)
+		reasonJson, _ := json.Marshal(reason)
+		progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":%s, \"keyReport\": %s}", reasonJson, reportJson)
+		return 0, false
 	}
 
 	handleNumber := int64(0)
-	fileNumber := getPathFileNumber(info.FilePath+"\\Msg", ".db")
+	failedNumber := int64(0)
+	fileNumber := getPathFileNumber(filepath.Join(info.FilePath, "Msg"), ".db")
 	var wg sync.WaitGroup
 	var reportWg sync.WaitGroup
 	quitChan := make(chan struct{})
 	taskChan := make(chan [2]string, 20)
 	go func() {
-		err = filepath.Walk(info.FilePath+"\\Msg", func(path string, finfo os.FileInfo, err error) error {
+		err = filepath.Walk(filepath.Join(info.FilePath, "Msg"), func(path string, finfo os.FileInfo, err error) error {
 			if err != nil {
 				log.Printf("filepath.Walk：%v\n", err)
 				return err
@@ -521,7 +573,7 @@ func exportWeChatDateBase(info WeChatInfo, expPath string, progress chan<- strin
 				expFile := expPath + path[len(info.FilePath):]
 				_, err := os.Stat(filepath.Dir(expFile))
 				if err != nil {
-					os.MkdirAll(filepath.Dir(expFile), 0644)
+					os.MkdirAll(filepath.Dir(expFile), os.ModePerm)
 				}
 
 				task := [2]string{path, expFile}
@@ -532,12 +584,17 @@ func exportWeChatDateBase(info WeChatInfo, expPath string, progress chan<- strin
 		})
 		if err != nil {
 			log.Println("filepath.Walk:", err)
-			progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v\"}", err)
+			progress <- progressError(err.Error())
 		}
 		close(taskChan)
 	}()
 
-	for i := 1; i < 20; i++ {
+	// 多个数据库同时解密, 每个数据库的解密协程按同时处理的文件数分摊CPU, 避免开出几百个协程
+	fileWorkers := 19
+	if opts.Workers <= 0 {
+		opts.Workers = max(1, runtime.NumCPU()/max(1, min(fileWorkers, int(fileNumber))))
+	}
+	for i := 0; i < fileWorkers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
@@ -545,10 +602,19 @@ func exportWeChatDateBase(info WeChatInfo, expPath string, progress chan<- strin
 				if filepath.Base(task[0]) == "xInfo.db" {
 					copyFile(task[0], task[1])
 				} else {
-					err = DecryptDataBase(task[0], dbKey, task[1])
+					report, err := DecryptDataBaseWithReport(task[0], dbKey, task[1], opts)
 					if err != nil {
 						log.Println("DecryptDataBase:", err)
-						progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%s %v\"}", task[0], err)
+						atomic.AddInt64(&failedNumber, 1)
+						progress <- progressError(fmt.Sprintf("%s %v", task[0], err))
+					} else {
+						// 每个数据库的校验结果放在report里
+						if report.HasError() {
+							log.Println("DecryptDataBase:", report)
+						}
+						reportJson, _ := json.Marshal(report)
+						filePercent := float64(atomic.LoadInt64(&handleNumber)) / float64(fileNumber)
+						progress <- fmt.Sprintf("{\"status\":\"processing\", \"result\":\"decrypt %s\", \"progress\": %d, \"report\": %s}", filepath.Base(task[0]), int(1+filePercent*(20-1)), reportJson)
 					}
 				}
 				atomic.AddInt64(&handleNumber, 1)
@@ -577,281 +643,131 @@ func exportWeChatDateBase(info WeChatInfo, expPath string, progress chan<- strin
 	close(quitChan)
 	reportWg.Wait()
 	progress <- "{\"status\":\"processing\", \"result\":\"export WeChat DateBase end\", \"progress\": 20}"
-	return true
+	return int(failedNumber), true
 }
 
-func GetWeChatInfo() (list *WeChatInfoList) {
-	list = &WeChatInfoList{}
-	list.Info = make([]WeChatInfo, 0)
-	list.Total = 0
-
-	processes, err := process.Processes()
-	if err != nil {
-		log.Println("Error getting processes:", err)
-		return
-	}
-
-	for _, p := range processes {
-		name, err := p.Name()
-		if err != nil {
-			continue
-		}
-		info := WeChatInfo{}
-		if name == "WeChat.exe" {
-			info.ProcessID = uint32(p.Pid)
-			info.Is64Bits, _ = Is64BitProcess(info.ProcessID)
-			log.Println("ProcessID", info.ProcessID)
-			files, err := p.OpenFiles()
-			if err != nil {
-				log.Println("OpenFiles failed")
-				continue
-			}
-
-			for _, f := range files {
-				if strings.HasSuffix(f.Path, "\\Media.db") {
-					// fmt.Printf("opened %s\n", f.Path[4:])
-					filePath := f.Path
-					parts := strings.Split(filePath, string(filepath.Separator))
-					if len(parts) < 4 {
-						log.Println("Error filePath " + filePath)
-						break
-					}
-					info.FilePath = strings.Join(parts[:len(parts)-2], string(filepath.Separator))
-					info.AcountName = strings.Join(parts[len(parts)-3:len(parts)-2], string(filepath.Separator))
-				}
-
-			}
-
-			if len(info.FilePath) == 0 {
-				log.Println("wechat not log in")
-				continue
-			}
-
-			hModuleSnap, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPMODULE|windows.TH32CS_SNAPMODULE32, uint32(p.Pid))
-			if err != nil {
-				log.Println("CreateToolhelp32Snapshot failed", err)
-				continue
-			}
-			defer windows.CloseHandle(hModuleSnap)
-
-			var me32 windows.ModuleEntry32
-			me32.Size = uint32(windows.SizeofModuleEntry32)
-
-			err = windows.Module32First(hModuleSnap, &me32)
-			if err != nil {
-				log.Println("Module32First failed", err)
-				continue
-			}
-
-			for ; err == nil; err = windows.Module32Next(hModuleSnap, &me32) {
-				if windows.UTF16ToString(me32.Module[:]) == "WeChatWin.dll" {
-					// fmt.Printf("MODULE NAME: %s\n", windows.UTF16ToString(me32.Module[:]))
-					// fmt.Printf("executable NAME: %s\n", windows.UTF16ToString(me32.ExePath[:]))
-					// fmt.Printf("base address: 0x%08X\n", me32.ModBaseAddr)
-					// fmt.Printf("base ModBaseSize: %d\n", me32.ModBaseSize)
-					info.DllBaseAddr = me32.ModBaseAddr
-					info.DllBaseSize = me32.ModBaseSize
-
-					var zero windows.Handle
-					driverPath := windows.UTF16ToString(me32.ExePath[:])
-					infoSize, err := windows.GetFileVersionInfoSize(driverPath, &zero)
-					if err != nil {
-						log.Println("GetFileVersionInfoSize failed", err)
-						break
-					}
-					versionInfo := make([]byte, infoSize)
-					if err = windows.GetFileVersionInfo(driverPath, 0, infoSize, unsafe.Pointer(&versionInfo[0])); err != nil {
-						log.Println("GetFileVersionInfo failed", err)
-						break
-					}
-					var fixedInfo *windows.VS_FIXEDFILEINFO
-					fixedInfoLen := uint32(unsafe.Sizeof(*fixedInfo))
-					err = windows.VerQueryValue(unsafe.Pointer(&versionInfo[0]), `\`, (unsafe.Pointer)(&fixedInfo), &fixedInfoLen)
-					if err != nil {
-						log.Println("VerQueryValue failed", err)
-						break
-					}
-					// fmt.Printf("%s: v%d.%d.%d.%d\n", windows.UTF16ToString(me32.Module[:]),
-					// 	(fixedInfo.FileVersionMS>>16)&0xff,
-					// 	(fixedInfo.FileVersionMS>>0)&0xff,
-					// 	(fixedInfo.FileVersionLS>>16)&0xff,
-					// 	(fixedInfo.FileVersionLS>>0)&0xff)
-
-					info.Version = fmt.Sprintf("%d.%d.%d.%d",
-						(fixedInfo.FileVersionMS>>16)&0xff,
-						(fixedInfo.FileVersionMS>>0)&0xff,
-						(fixedInfo.FileVersionLS>>16)&0xff,
-						(fixedInfo.FileVersionLS>>0)&0xff)
-					list.Info = append(list.Info, info)
-					list.Total += 1
-					break
-				}
-			}
+// hasDeviceSybmol 返回第一个出现的特征的位置和长度
+func hasDeviceSybmol(buffer []byte, sybmols [][]byte) (int, int) {
+	for _, syb := range sybmols {
+		if index := bytes.Index(buffer, syb); index != -1 {
+			return index, len(syb)
 		}
 	}
-	return
-}
 
-func Is64BitProcess(pid uint32) (bool, error) {
-	is64Bit := false
-	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_INFORMATION, false, pid)
-	if err != nil {
-		log.Println("Error opening process:", err)
-		return is64Bit, errors.New("OpenProcess failed")
-	}
-	defer windows.CloseHandle(handle)
-
-	err = windows.IsWow64Process(handle, &is64Bit)
-	if err != nil {
-		log.Println("Error IsWow64Process:", err)
-	}
-	return !is64Bit, err
+	return -1, 0
 }
 
-func GetWeChatKey(info *WeChatInfo) string {
-	mediaDB := info.FilePath + "\\Msg\\Media.db"
-	if _, err := os.Stat(mediaDB); err != nil {
-		log.Printf("open db %s error: %v", mediaDB, err)
-		return ""
-	}
-
-	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_INFORMATION|windows.PROCESS_VM_READ, false, uint32(info.ProcessID))
-	if err != nil {
-		log.Println("Error opening process:", err)
-		return ""
+// findDBKeyPtr 从后往前找后面第MarkerSlot个位置是key长度的指针, 离特征近的先返回
+func findDBKeyPtr(buffer []byte, is64Bits bool, signature *KeySignature) [][]byte {
+	keys := make([][]byte, 0)
+	step := 8
+	if !is64Bits {
+		step = 4
 	}
-	defer windows.CloseHandle(handle)
 
-	buffer := make([]byte, info.DllBaseSize)
-	err = windows.ReadProcessMemory(handle, uintptr(info.DllBaseAddr), &buffer[0], uintptr(len(buffer)), nil)
-	if err != nil {
-		log.Println("Error ReadProcessMemory:", err)
-		return ""
+	start := 0
+	if signature.MaxDistance > 0 && len(buffer) > signature.MaxDistance {
+		start = len(buffer) - signature.MaxDistance
 	}
 
-	offset := 0
-	// searchStr := []byte(info.AcountName)
-	for {
-		index := hasDeviceSybmol(buffer[offset:])
-		if index == -1 {
-			log.Println("has not DeviceSybmol")
-			break
+	markerOffset := signature.MarkerSlot * step
+	for offset := len(buffer) - step; offset-markerOffset >= start; offset -= step {
+		if readPointer(buffer[offset:offset+step]) == signature.KeyLen {
+			keys = append(keys, buffer[offset-markerOffset:offset-markerOffset+step])
 		}
-		fmt.Printf("hasDeviceSybmol: 0x%X\n", index)
-		keys := findDBKeyPtr(buffer[offset:index], info.Is64Bits)
-		// fmt.Println("keys:", keys)
-
-		key, err := findDBkey(handle, info.FilePath+"\\Msg\\Media.db", keys)
-		if err == nil {
-			// fmt.Println("key:", key)
-			return key
-		}
-
-		offset += (index + 20)
 	}
 
-	return ""
+	return keys
 }
 
-func hasDeviceSybmol(buffer []byte) int {
-	sybmols := [...][]byte{
-		{'a', 'n', 'd', 'r', 'o', 'i', 'd', 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x07, 0x00, 0x00, 0x00},
-		{'p', 'a', 'd', '-', 'a', 'n', 'd', 'r', 'o', 'i', 'd', 0x00, 0x00, 0x00, 0x00, 0x00, 0x0B, 0x00, 0x00, 0x00},
-		{'i', 'p', 'h', 'o', 'n', 'e', 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x06, 0x00, 0x00, 0x00},
-		{'i', 'p', 'a', 'd', 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00},
-		{'O', 'H', 'O', 'S', 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00},
-	}
-	for _, syb := range sybmols {
-		if index := bytes.Index(buffer, syb); index != -1 {
-			return index
-		}
-	}
-
-	return -1
+// memoryReader 按虚拟地址读取内存, 可以是运行中的进程也可以是离线的内存转储
+type memoryReader interface {
+	ReadMemory(addr uint64, buffer []byte) error
 }
 
-func findDBKeyPtr(buffer []byte, is64Bits bool) [][]byte {
-	keys := make([][]byte, 0)
-	step := 8
-	keyLen := []byte{0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-	if !is64Bits {
-		keyLen = keyLen[:4]
-		step = 4
+// searchDBKey 按版本适用的特征依次在WeChatWin.dll的内存里找指向数据库key的指针
+// profile为空时每个候选key都尝试所有加密参数
+func searchDBKey(mem memoryReader, info *WeChatInfo, dbPath string, profile *CipherProfile) (string, *KeySearchReport) {
+	report := &KeySearchReport{Version: info.Version, Results: make([]KeyStrategyResult, 0)}
+	buffer := make([]byte, info.DllBaseSize)
+	if err := mem.ReadMemory(uint64(info.DllBaseAddr), buffer); err != nil {
+		report.Reason = fmt.Sprintf("read WeChatWin.dll memory failed: %v", err)
+		return "", report
 	}
 
-	offset := len(buffer) - step
-	for {
-		if bytes.Contains(buffer[offset:offset+step], keyLen) {
-			keys = append(keys, buffer[offset-step:offset])
-		}
+	for _, signature := range keySignaturesForVersion(info.Version) {
+		result := KeyStrategyResult{Name: signature.Name}
+		offset := 0
+		for {
+			index, length := hasDeviceSybmol(buffer[offset:], signature.patterns)
+			if index == -1 {
+				break
+			}
+			result.Matches += 1
+			keys := findDBKeyPtr(buffer[offset:offset+index], info.Is64Bits, &signature)
+			result.Candidates += len(keys)
+
+			key, checked, err := findDBkey(mem, dbPath, keys, profile)
+			result.Checked += checked
+			if err == nil {
+				result.Found = true
+				report.Results = append(report.Results, result)
+				report.Strategy = signature.Name
+				return key, report
+			}
 
-		offset -= step
-		if offset <= 0 {
-			break
+			offset += (index + length)
 		}
+		report.Results = append(report.Results, result)
 	}
 
-	return keys
+	report.Reason = report.failReason()
+	return "", report
 }
 
-func findDBkey(handle windows.Handle, path string, keys [][]byte) (string, error) {
-	var keyAddrPtr uint64
-	addrBuffer := make([]byte, 0x08)
+// findDBkey 返回找到的key和实际校验过的候选key数量
+func findDBkey(mem memoryReader, path string, keys [][]byte, profile *CipherProfile) (string, int, error) {
+	checked := make(map[string]bool)
 	for _, key := range keys {
-		copy(addrBuffer, key)
-		err := binary.Read(bytes.NewReader(addrBuffer), binary.LittleEndian, &keyAddrPtr)
-		if err != nil {
-			log.Println("binary.Read:", err)
+		keyAddrPtr := readPointer(key)
+		if keyAddrPtr == 0x00 {
 			continue
 		}
-		if keyAddrPtr == 0x00 {
+		keyBuffer := make([]byte, keySize)
+		if err := mem.ReadMemory(keyAddrPtr, keyBuffer); err != nil {
 			continue
 		}
-		log.Printf("keyAddrPtr: 0x%X\n", keyAddrPtr)
-		keyBuffer := make([]byte, 0x20)
-		err = windows.ReadProcessMemory(handle, uintptr(keyAddrPtr), &keyBuffer[0], uintptr(len(keyBuffer)), nil)
-		if err != nil {
-			// fmt.Println("Error ReadProcessMemory:", err)
+		// 同一个key可能有多个指针指向它, 只校验一次
+		if checked[string(keyBuffer)] {
 			continue
 		}
-		if checkDataBaseKey(path, keyBuffer) {
-			return hex.EncodeToString(keyBuffer), nil
+		checked[string(keyBuffer)] = true
+		log.Printf("keyAddrPtr: 0x%X\n", keyAddrPtr)
+
+		if profile == nil && checkDataBaseKey(path, keyBuffer) {
+			return hex.EncodeToString(keyBuffer), len(checked), nil
+		}
+		if profile != nil && checkDataBaseKeyWithProfile(path, keyBuffer, profile) {
+			return hex.EncodeToString(keyBuffer), len(checked), nil
 		}
 	}
 
-	return "", errors.New("not found key")
+	return "", len(checked), errors.New("not found key")
 }
 
 func checkDataBaseKey(path string, password []byte) bool {
-	fp, err := os.Open(path)
-	if err != nil {
-		return false
-	}
-	defer fp.Close()
-
-	fpReader := bufio.NewReaderSize(fp, defaultPageSize*100)
-
-	buffer := make([]byte, defaultPageSize)
+	_, err := DetectCipherProfile(path, password)
+	return err == nil
+}
 
-	n, err := fpReader.Read(buffer)
-	if err != nil && n != defaultPageSize {
-		log.Println("read failed:", err, n)
+// checkDataBaseKeyWithProfile 只按指定的加密参数校验, 扫描内存找key时候选很多, 避免每个都尝试所有参数
+func checkDataBaseKeyWithProfile(path string, password []byte, profile *CipherProfile) bool {
+	page1, err := readFirstPage(path)
+	if err != nil {
+		log.Println("readFirstPage failed:", err)
 		return false
 	}
-
-	salt := buffer[:16]
-	key := pbkdf2HMAC(password, salt, defaultIter, keySize)
-
-	page1 := buffer[16:defaultPageSize]
-
-	macSalt := xorBytes(salt, 0x3a)
-	macKey := pbkdf2HMAC(key, macSalt, 2, keySize)
-
-	hashMac := hmac.New(sha1.New, macKey)
-	hashMac.Write(page1[:len(page1)-32])
-	hashMac.Write([]byte{1, 0, 0, 0})
-
-	return hmac.Equal(hashMac.Sum(nil), page1[len(page1)-32:len(page1)-12])
+	return profile.checkKey(page1, password)
 }
 
 func (info WeChatInfo) String() string {
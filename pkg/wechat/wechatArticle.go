@@ -0,0 +1,235 @@
+package wechat
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+type WeChatArticle struct {
+	Account     string `json:"Account"`
+	AccountName string `json:"AccountName"`
+	MsgSvrId    string `json:"MsgSvrId"`
+	Title       string `json:"Title"`
+	Digest      string `json:"Digest"`
+	Url         string `json:"Url"`
+	Cover       string `json:"Cover"`
+	PubTime     int64  `json:"PubTime"`
+}
+
+type WeChatArticleList struct {
+	UserName string          `json:"UserName"`
+	Total    int             `json:"Total"`
+	Rows     []WeChatArticle `json:"Rows"`
+}
+
+type WeChatPublicAccount struct {
+	WeChatUserInfo
+	ArticleCount int   `json:"ArticleCount"`
+	LastTime     int64 `json:"LastTime"`
+}
+
+type WeChatPublicAccountList struct {
+	Total int                   `json:"Total"`
+	Users []WeChatPublicAccount `json:"Users"`
+}
+
+// ParseArticleList 解析公众号推送appmsg里的mmreader, 一次推送可能有多篇文章
+func ParseArticleList(doc *etree.Document) []WeChatArticle {
+	articles := make([]WeChatArticle, 0)
+	root := NewxmlDocument(doc)
+	account := root.FindElementValue("/msg/appmsg/mmreader/publisher/username")
+	accountName := root.FindElementValue("/msg/appmsg/mmreader/publisher/nickname")
+	if len(accountName) == 0 {
+		accountName = root.FindElementValue("/msg/appmsg/mmreader/category/name")
+	}
+
+	for _, item := range doc.FindElements("/msg/appmsg/mmreader/category/item") {
+		article := WeChatArticle{Account: account, AccountName: accountName}
+		article.Title = forwardElementValue(item, "title")
+		article.Digest = forwardElementValue(item, "digest")
+		article.Url = forwardElementValue(item, "url")
+		if len(article.Url) == 0 {
+			article.Url = forwardElementValue(item, "shorturl")
+		}
+		article.Cover = forwardElementValue(item, "cover")
+		article.PubTime, _ = strconv.ParseInt(forwardElementValue(item, "pub_time"), 10, 64)
+		if len(article.Title) == 0 && len(article.Url) == 0 {
+			continue
+		}
+		articles = append(articles, article)
+	}
+
+	// 只有单篇的推送不带item
+	if len(articles) == 0 {
+		article := WeChatArticle{Account: account, AccountName: accountName}
+		article.Title = root.FindElementValue("/msg/appmsg/title")
+		article.Digest = root.FindElementValue("/msg/appmsg/des")
+		article.Url = root.FindElementValue("/msg/appmsg/url")
+		article.Cover = root.FindElementValue("/msg/appmsg/thumburl")
+		if len(article.Title) > 0 {
+			articles = append(articles, article)
+		}
+	}
+
+	return articles
+}
+
+func (P *WechatDataProvider) WeChatGetPublicAccountList() (*WeChatPublicAccountList, error) {
+	List := &WeChatPublicAccountList{}
+	List.Users = make([]WeChatPublicAccount, 0)
+	if P.publicMsgDB == nil {
+		return List, nil
+	}
+
+	querySql := fmt.Sprintf("select StrTalker, count(*), max(CreateTime) from MSG where Type=%d group by StrTalker order by max(CreateTime) desc;", Wechat_Message_Type_Misc)
+	rows, err := P.publicMsgDB.db.Query(querySql)
+	if err != nil {
+		log.Printf("%s failed %v\n", querySql, err)
+		return List, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		account := WeChatPublicAccount{}
+		var talker string
+		if err := rows.Scan(&talker, &account.ArticleCount, &account.LastTime); err != nil {
+			log.Println("rows.Scan failed", err)
+			return List, err
+		}
+
+		if info, err := P.WechatGetUserInfoByNameOnCache(talker); err == nil {
+			account.WeChatUserInfo = *info
+		} else {
+			account.UserName = talker
+		}
+		List.Users = append(List.Users, account)
+		List.Total += 1
+	}
+
+	return List, nil
+}
+
+// WeChatGetArticleList 按推送时间倒序返回createTime之前的文章, userName为空时返回全部公众号
+func (P *WechatDataProvider) WeChatGetArticleList(userName string, createTime int64, pageSize int) (*WeChatArticleList, error) {
+	List := &WeChatArticleList{UserName: userName}
+	List.Rows = make([]WeChatArticle, 0)
+	if P.publicMsgDB == nil {
+		return List, nil
+	}
+	if createTime <= 0 {
+		createTime = time.Now().Unix()
+	}
+
+	condition := fmt.Sprintf("Type=%d And CreateTime<=%d", Wechat_Message_Type_Misc, createTime)
+	if len(userName) > 0 {
+		condition += fmt.Sprintf(" And StrTalker='%s'", userName)
+	}
+	querySql := fmt.Sprintf("select localId,MsgSvrID,Type,SubType,IsSender,CreateTime,ifnull(StrTalker,'') as StrTalker, ifnull(StrContent,'') as StrContent,ifnull(CompressContent,'') as CompressContent,ifnull(BytesExtra,'') as BytesExtra from MSG Where %s order by CreateTime desc limit %d;", condition, pageSize)
+
+	rows, err := P.publicMsgDB.db.Query(querySql)
+	if err != nil {
+		log.Printf("%s failed %v\n", querySql, err)
+		return List, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg, err := P.wechatScanMessage(rows)
+		if err != nil {
+			log.Println("rows.Scan failed", err)
+			return List, err
+		}
+
+		for _, article := range msg.Articles {
+			article.MsgSvrId = msg.MsgSvrId
+			if len(article.Account) == 0 {
+				article.Account = msg.Talker
+			}
+			if len(article.AccountName) == 0 {
+				article.AccountName = P.wechatDisplayName(msg.Talker)
+			}
+			if article.PubTime == 0 {
+				article.PubTime = msg.CreateTime
+			}
+			List.Rows = append(List.Rows, article)
+			List.Total += 1
+		}
+	}
+
+	return List, nil
+}
+
+// WeChatExportReadingList 导出公众号文章列表, format为"md"或者"html"
+func (P *WechatDataProvider) WeChatExportReadingList(userName string, exportPath string, format string) error {
+	// limit -1 表示不限制条数
+	List, err := P.WeChatGetArticleList(userName, 0, -1)
+	if err != nil {
+		return err
+	}
+	articles := List.Rows
+
+	var content string
+	if format == "html" {
+		content = articleListHTML(articles)
+	} else {
+		content = articleListMarkdown(articles)
+	}
+
+	err = os.WriteFile(exportPath, []byte(content), 0644)
+	if err != nil {
+		log.Println("WriteFile failed:", err)
+	}
+	return err
+}
+
+func articleListMarkdown(articles []WeChatArticle) string {
+	var builder strings.Builder
+	builder.WriteString("# 公众号文章\n")
+	lastDay := ""
+	for _, article := range articles {
+		day := time.Unix(article.PubTime, 0).Format("2006-01-02")
+		if day != lastDay {
+			builder.WriteString("\n## " + day + "\n\n")
+			lastDay = day
+		}
+		title := strings.NewReplacer("[", "\\[", "]", "\\]").Replace(article.Title)
+		builder.WriteString(fmt.Sprintf("- [%s](%s) — %s\n", title, article.Url, article.AccountName))
+		if len(article.Digest) > 0 {
+			builder.WriteString("  > " + strings.ReplaceAll(article.Digest, "\n", " ") + "\n")
+		}
+	}
+
+	return builder.String()
+}
+
+func articleListHTML(articles []WeChatArticle) string {
+	var builder strings.Builder
+	builder.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>公众号文章</title>\n<style>\n")
+	builder.WriteString("body{max-width:720px;margin:0 auto;font-family:sans-serif;background:#f5f5f5}\n")
+	builder.WriteString(".article{display:flex;background:#fff;margin:8px 0;padding:12px;border-radius:6px}\n")
+	builder.WriteString(".article img{width:96px;height:96px;object-fit:cover;margin-left:12px}\n")
+	builder.WriteString(".body{flex:1}.digest{color:#666;font-size:14px}.info{color:#999;font-size:12px}\n")
+	builder.WriteString("</style>\n</head>\n<body>\n")
+	for _, article := range articles {
+		builder.WriteString("<div class=\"article\">\n<div class=\"body\">\n")
+		builder.WriteString(fmt.Sprintf("<div><a href=\"%s\">%s</a></div>\n", html.EscapeString(article.Url), html.EscapeString(article.Title)))
+		if len(article.Digest) > 0 {
+			builder.WriteString(fmt.Sprintf("<div class=\"digest\">%s</div>\n", html.EscapeString(article.Digest)))
+		}
+		builder.WriteString(fmt.Sprintf("<div class=\"info\">%s %s</div>\n</div>\n", html.EscapeString(article.AccountName), time.Unix(article.PubTime, 0).Format("2006-01-02 15:04")))
+		if len(article.Cover) > 0 {
+			builder.WriteString(fmt.Sprintf("<img src=\"%s\" referrerpolicy=\"no-referrer\">\n", html.EscapeString(article.Cover)))
+		}
+		builder.WriteString("</div>\n")
+	}
+	builder.WriteString("</body>\n</html>\n")
+
+	return builder.String()
+}
@@ -0,0 +1,807 @@
+package wechat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 导出数据本地加密:
+// 数据库用用户密码重新加密成SQLCipher格式, 可以直接用sqlcipher打开;
+// 其它文件用密码派生的key做AES-GCM分块加密, 文件名不变, 按块解密方便视频的Range请求
+
+const (
+	BackupEncryptFile = "BackupEncrypt.json"
+	// 加密还没有全部完成时的密码信息, 全部成功后才改名为BackupEncryptFile
+	backupEncryptPendingFile = BackupEncryptFile + ".pending"
+
+	backupFileMagic      = "WXBKENC1"
+	backupKeyIDSize      = 8
+	backupNonceSize      = 12
+	backupFileHeaderSize = len(backupFileMagic) + backupKeyIDSize + backupNonceSize + 8
+	backupChunkSize      = 64 * 1024
+	backupKdfIter        = 256000
+	// SQLITE_FCNTL_RESERVE_BYTES
+	sqliteFcntlReserveBytes = 38
+)
+
+var (
+	ErrBackupLocked   = errors.New("backup is locked")
+	ErrBackupPassword = errors.New("incorrect backup password")
+	ErrBackupReadOnly = errors.New("wechat directory is opened in place, read only")
+)
+
+type BackupEncryptInfo struct {
+	Version int    `json:"Version"`
+	Cipher  string `json:"Cipher"`
+	Salt    string `json:"Salt"`
+	Iter    int    `json:"Iter"`
+	KeyID   string `json:"KeyID"`
+}
+
+type backupKey struct {
+	resPath  string
+	password []byte
+	keyID    []byte
+	aead     cipher.AEAD
+	profile  *CipherProfile
+}
+
+var backupKeys = make(map[string]*backupKey)
+var backupKeyMtx sync.Mutex
+
+func backupEncryptInfoPath(resPath string) string {
+	return filepath.Join(resPath, BackupEncryptFile)
+}
+
+// IsBackupEncrypted 导出目录里有加密的文件, 包括加密到一半失败的导出
+func IsBackupEncrypted(resPath string) bool {
+	_, err := os.Stat(backupEncryptInfoPath(resPath))
+	if err != nil {
+		_, err = os.Stat(filepath.Join(resPath, backupEncryptPendingFile))
+	}
+	return err == nil
+}
+
+func IsBackupLocked(resPath string) bool {
+	return IsBackupEncrypted(resPath) && getBackupKey(resPath) == nil
+}
+
+func getBackupKey(resPath string) *backupKey {
+	backupKeyMtx.Lock()
+	defer backupKeyMtx.Unlock()
+	return backupKeys[filepath.Clean(resPath)]
+}
+
+// getBackupKeyByPath 查找path所在目录的key
+func getBackupKeyByPath(path string) *backupKey {
+	path = filepath.Clean(path)
+	backupKeyMtx.Lock()
+	defer backupKeyMtx.Unlock()
+	for resPath, key := range backupKeys {
+		if strings.HasPrefix(path, resPath+string(filepath.Separator)) {
+			return key
+		}
+	}
+	return nil
+}
+
+func getBackupKeyByID(keyID []byte) *backupKey {
+	backupKeyMtx.Lock()
+	defer backupKeyMtx.Unlock()
+	for _, key := range backupKeys {
+		if bytes.Equal(key.keyID, keyID) {
+			return key
+		}
+	}
+	return nil
+}
+
+func readBackupEncryptInfo(resPath string) (*BackupEncryptInfo, error) {
+	data, err := os.ReadFile(backupEncryptInfoPath(resPath))
+	if os.IsNotExist(err) {
+		data, err = os.ReadFile(filepath.Join(resPath, backupEncryptPendingFile))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := &BackupEncryptInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// newBackupKey 由密码派生文件加密的key, keyID写在每个加密文件头里, 同时用来校验密码
+func newBackupKey(resPath string, password string, info *BackupEncryptInfo) (*backupKey, error) {
+	salt, err := hex.DecodeString(info.Salt)
+	if err != nil {
+		return nil, err
+	}
+	profile, err := GetCipherProfile(info.Cipher)
+	if err != nil {
+		return nil, err
+	}
+
+	master := pbkdf2HMAC([]byte(password), salt, info.Iter, keySize, sha512.New)
+	sum := sha256.Sum256(master)
+	block, err := aes.NewCipher(master)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &backupKey{
+		resPath:  filepath.Clean(resPath),
+		password: []byte(password),
+		keyID:    sum[:backupKeyIDSize],
+		aead:     aead,
+		profile:  profile,
+	}
+	return key, nil
+}
+
+// CheckBackupPassword 校验已加密导出的密码, 没有加密时返回nil
+func CheckBackupPassword(resPath string, password string) error {
+	_, err := loadBackupKey(resPath, password)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func loadBackupKey(resPath string, password string) (*backupKey, error) {
+	info, err := readBackupEncryptInfo(resPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := newBackupKey(resPath, password, info)
+	if err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(key.keyID) != info.KeyID {
+		return nil, ErrBackupPassword
+	}
+	return key, nil
+}
+
+// prepareBackupKey 取出导出目录的key, 第一次加密时生成新的盐, 先写到BackupEncrypt.json.pending
+func prepareBackupKey(resPath string, password string) (*backupKey, error) {
+	if len(password) == 0 {
+		return nil, errors.New("empty password")
+	}
+
+	key, err := loadBackupKey(resPath, password)
+	if !os.IsNotExist(err) {
+		return key, err
+	}
+
+	salt, err := randomBytes(saltSize)
+	if err != nil {
+		return nil, err
+	}
+	info := &BackupEncryptInfo{Version: 1, Cipher: CipherProfileV3.Name, Salt: hex.EncodeToString(salt), Iter: backupKdfIter}
+	key, err = newBackupKey(resPath, password, info)
+	if err != nil {
+		return nil, err
+	}
+	info.KeyID = hex.EncodeToString(key.keyID)
+	data, _ := json.MarshalIndent(info, "", "	")
+	if err := os.WriteFile(filepath.Join(resPath, backupEncryptPendingFile), data, 0644); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// SetBackupPassword 导出时数据库解密后直接用导出目录的密码重新加密写入, 明文数据库不会落盘,
+// key同时保存在内存里, 导出过程中可以读取已经加密的数据库, 其它文件还是要导出后用EncryptBackup加密
+func (opts *DecryptOptions) SetBackupPassword(resPath string, password string) error {
+	key, err := prepareBackupKey(resPath, password)
+	if err != nil {
+		return err
+	}
+
+	backupKeyMtx.Lock()
+	backupKeys[key.resPath] = key
+	backupKeyMtx.Unlock()
+	opts.backup = key
+	return nil
+}
+
+// EncryptBackup 把导出目录下的数据库和文件用密码加密, 已经加密过的文件会跳过, 可以在增量导出后重复执行.
+// 有文件加密失败时返回错误, 密码信息留在BackupEncrypt.json.pending里, 用同一个密码重新执行会继续加密
+func EncryptBackup(resPath string, password string, progress chan<- string) error {
+	defer close(progress)
+	if len(password) == 0 {
+		return errors.New("empty password")
+	}
+
+	progress <- "{\"status\":\"processing\", \"result\":\"encrypt backup start\", \"progress\": 1}"
+	key, err := prepareBackupKey(resPath, password)
+	if err != nil {
+		progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%v\"}", err)
+		return err
+	}
+
+	// 头像是第一次打开时才从Misc.db导出的, 加密前先导出来
+	ExportWeChatHeadImage(resPath)
+
+	files := make([]string, 0)
+	for _, dir := range []string{"Msg", "FileStorage"} {
+		filepath.Walk(filepath.Join(resPath, dir), func(path string, finfo os.FileInfo, err error) error {
+			if err == nil && !finfo.IsDir() {
+				files = append(files, path)
+			}
+			return nil
+		})
+	}
+
+	failed := 0
+	for i, path := range files {
+		if strings.HasSuffix(path, ".db") {
+			err = encryptBackupDataBase(path, key)
+		} else {
+			err = encryptBackupFile(path, path, key)
+		}
+		if err != nil {
+			failed += 1
+			log.Println("encrypt failed:", path, err)
+			progress <- fmt.Sprintf("{\"status\":\"error\", \"result\":\"%s %v\"}", filepath.Base(path), err)
+		}
+		if i%100 == 0 {
+			progress <- fmt.Sprintf("{\"status\":\"processing\", \"result\":\"encrypt backup doing\", \"progress\": %d}", 1+i*98/len(files))
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files encrypt failed", failed, len(files))
+	}
+	pendingPath := filepath.Join(resPath, backupEncryptPendingFile)
+	if _, err := os.Stat(pendingPath); err == nil {
+		if err := os.Rename(pendingPath, backupEncryptInfoPath(resPath)); err != nil {
+			return err
+		}
+	}
+
+	progress <- "{\"status\":\"processing\", \"result\":\"encrypt backup end\", \"progress\": 100}"
+	return nil
+}
+
+func fileHasPrefix(path string, prefix string) bool {
+	fp, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer fp.Close()
+
+	buffer := make([]byte, len(prefix))
+	if _, err := io.ReadFull(fp, buffer); err != nil {
+		return false
+	}
+	return string(buffer) == prefix
+}
+
+// encryptBackupDataBase 原地加密数据库, 只处理明文sqlite, 不是sqlite的.db文件按普通文件加密
+func encryptBackupDataBase(path string, key *backupKey) error {
+	if fileHasPrefix(path, backupFileMagic) {
+		return nil
+	}
+	if !fileHasPrefix(path, "SQLite format 3\x00") {
+		if checkDataBaseKey(path, key.password) {
+			return nil
+		}
+		return encryptBackupFile(path, path, key)
+	}
+
+	tmpPath := path + ".enc"
+	err := EncryptDataBase(path, key.password, tmpPath, key.profile)
+	for _, profile := range CipherProfiles {
+		// 4.x的数据库保留字节更多, 直接用对应的参数加密, 解密时会自动识别
+		if !errors.Is(err, ErrPageLayout) {
+			break
+		}
+		if profile != key.profile {
+			err = EncryptDataBase(path, key.password, tmpPath, profile)
+		}
+	}
+	if errors.Is(err, ErrPageLayout) {
+		// 程序自己创建的数据库没有预留IV和HMAC的空间, 先VACUUM一份页结构一致的副本
+		vacuumPath := path + ".vacuum"
+		err = vacuumDataBase(path, vacuumPath, key.profile)
+		if err == nil {
+			err = EncryptDataBase(vacuumPath, key.password, tmpPath, key.profile)
+		}
+		os.Remove(vacuumPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// vacuumDataBase 按profile的页大小和保留字节数重建数据库
+func vacuumDataBase(path string, dstPath string, profile *CipherProfile) error {
+	if _, err := copyFile(path, dstPath); err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", dstPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// PRAGMA page_size会重置保留字节数, 要先设置页大小再设置保留字节数
+	querySql := fmt.Sprintf("PRAGMA journal_mode=DELETE;PRAGMA page_size=%d;", profile.PageSize)
+	if _, err = conn.ExecContext(context.Background(), querySql); err != nil {
+		return err
+	}
+
+	if err := setReserveBytes(conn, profile.Reserve); err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(context.Background(), "VACUUM;")
+	return err
+}
+
+// setReserveBytes 设置每页的保留字节数, 要在PRAGMA page_size之后调用
+func setReserveBytes(conn *sql.Conn, reserve int) error {
+	return conn.Raw(func(driverConn interface{}) error {
+		// go-sqlite3的SQLiteConn, 用接口判断避免直接依赖cgo才有的方法
+		sqliteConn, ok := driverConn.(interface {
+			SetFileControlInt(dbName string, op int, arg int) error
+		})
+		if !ok {
+			return errors.New("not sqlite3 conn")
+		}
+		return sqliteConn.SetFileControlInt("main", sqliteFcntlReserveBytes, reserve)
+	})
+}
+
+// encryptBackupFile 文件格式: magic | keyID | nonce | 明文长度 | 每64K明文一个GCM块
+func encryptBackupFile(path string, dstPath string, key *backupKey) error {
+	if fileHasPrefix(path, backupFileMagic) {
+		return nil
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	fileInfo, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+
+	return encryptBackupStream(bufio.NewReader(fp), fileInfo.Size(), dstPath, key)
+}
+
+// encryptBackupStream 把size字节的明文加密写到dstPath, 明文不落盘
+func encryptBackupStream(reader io.Reader, size int64, dstPath string, key *backupKey) error {
+	writer, err := newBackupFileWriter(dstPath, size, key)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		writer.abort()
+		return err
+	}
+	return writer.Close()
+}
+
+// backupFileWriter 边写边按块加密, 文件头里有明文长度, 所以要先知道大小, Close时写完的长度不对会丢弃
+type backupFileWriter struct {
+	key     *backupKey
+	outFile *os.File
+	out     *bufio.Writer
+	header  []byte
+	nonce   []byte
+	chunk   []byte
+	index   uint32
+	size    int64
+	written int64
+	tmpPath string
+	dstPath string
+}
+
+func newBackupFileWriter(dstPath string, size int64, key *backupKey) (*backupFileWriter, error) {
+	nonce, err := randomBytes(backupNonceSize)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, backupFileHeaderSize)
+	header = append(header, backupFileMagic...)
+	header = append(header, key.keyID...)
+	header = append(header, nonce...)
+	header = binary.LittleEndian.AppendUint64(header, uint64(size))
+
+	w := &backupFileWriter{key: key, header: header, nonce: nonce, size: size, dstPath: dstPath, tmpPath: dstPath + ".enc"}
+	if w.outFile, err = os.Create(w.tmpPath); err != nil {
+		return nil, err
+	}
+	w.out = bufio.NewWriter(w.outFile)
+	w.chunk = make([]byte, 0, backupChunkSize)
+	if _, err := w.out.Write(header); err != nil {
+		w.abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *backupFileWriter) Write(p []byte) (int, error) {
+	if w.written+int64(len(p)) > w.size {
+		return 0, fmt.Errorf("write %d bytes more than size %d", w.written+int64(len(p)), w.size)
+	}
+
+	n := 0
+	for n < len(p) {
+		copied := copy(w.chunk[len(w.chunk):backupChunkSize], p[n:])
+		w.chunk = w.chunk[:len(w.chunk)+copied]
+		n += copied
+		if len(w.chunk) == backupChunkSize {
+			if err := w.flushChunk(); err != nil {
+				return n, err
+			}
+		}
+	}
+	w.written += int64(n)
+	return n, nil
+}
+
+func (w *backupFileWriter) flushChunk() error {
+	_, err := w.out.Write(w.key.aead.Seal(nil, backupChunkNonce(w.nonce, w.index), w.chunk, w.header))
+	w.chunk = w.chunk[:0]
+	w.index += 1
+	return err
+}
+
+func (w *backupFileWriter) Close() error {
+	if w.written != w.size {
+		w.abort()
+		return fmt.Errorf("write %d bytes, expect %d", w.written, w.size)
+	}
+
+	var err error
+	if len(w.chunk) > 0 {
+		err = w.flushChunk()
+	}
+	if err == nil {
+		err = w.out.Flush()
+	}
+	if closeErr := w.outFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(w.tmpPath)
+		return err
+	}
+	return os.Rename(w.tmpPath, w.dstPath)
+}
+
+func (w *backupFileWriter) abort() {
+	w.outFile.Close()
+	os.Remove(w.tmpPath)
+}
+
+func backupChunkNonce(nonce []byte, index uint32) []byte {
+	chunkNonce := make([]byte, len(nonce))
+	copy(chunkNonce, nonce)
+	for i := 0; i < 4; i++ {
+		chunkNonce[len(chunkNonce)-1-i] ^= byte(index >> (8 * i))
+	}
+	return chunkNonce
+}
+
+// UnlockBackup 校验密码后把key保存在内存里, 之后CreateWechatDataProvider会把数据库直接解密到内存, OpenBackupFile按块解密文件
+func UnlockBackup(resPath string, password string) error {
+	if getBackupKey(resPath) != nil {
+		return nil
+	}
+
+	key, err := loadBackupKey(resPath, password)
+	if err != nil {
+		return err
+	}
+
+	backupKeyMtx.Lock()
+	backupKeys[key.resPath] = key
+	backupKeyMtx.Unlock()
+	log.Println("UnlockBackup:", key.resPath)
+	return nil
+}
+
+// SetDataBaseKey 直接读取微信目录里加密的数据库, key只保存在内存里, LockBackup清除
+func SetDataBaseKey(resPath string, dbKey string) error {
+	password, err := hex.DecodeString(dbKey)
+	if err != nil {
+		return err
+	}
+
+	key := &backupKey{resPath: filepath.Clean(resPath), password: password}
+	backupKeyMtx.Lock()
+	backupKeys[key.resPath] = key
+	backupKeyMtx.Unlock()
+	return nil
+}
+
+// LockBackup 清除内存里的key, 已经打开的数据库要先关闭
+func LockBackup(resPath string) {
+	backupKeyMtx.Lock()
+	delete(backupKeys, filepath.Clean(resPath))
+	backupKeyMtx.Unlock()
+}
+
+func LockAllBackups() {
+	backupKeyMtx.Lock()
+	backupKeys = make(map[string]*backupKey)
+	backupKeyMtx.Unlock()
+	os.RemoveAll(backupOpenDir())
+}
+
+// BackupDataBasePath 返回打开数据库用的目录, 加密的导出没解锁时返回ErrBackupLocked
+func BackupDataBasePath(resPath string) (string, error) {
+	if IsBackupLocked(resPath) {
+		return "", ErrBackupLocked
+	}
+	return resPath, nil
+}
+
+// syncBackupDataBase 程序会写入UserData.db之类的数据库, 关闭前把内存里的数据重新加密写回导出目录
+func syncBackupDataBase(resPath string, name string, db *sql.DB) {
+	key := getBackupKey(resPath)
+	if key == nil || key.aead == nil {
+		return
+	}
+
+	data, err := serializeDataBase(db)
+	if err != nil {
+		log.Println("serializeDataBase failed:", err)
+		return
+	}
+
+	dstPath := filepath.Join(key.resPath, "Msg", name)
+	tmpPath := dstPath + ".sync"
+	err = ErrPageLayout
+	for _, profile := range append([]*CipherProfile{key.profile}, CipherProfiles...) {
+		if !errors.Is(err, ErrPageLayout) {
+			break
+		}
+		err = encryptDataBase(bytes.NewReader(data), key.password, tmpPath, profile)
+	}
+	if err != nil {
+		log.Println("encryptDataBase failed:", err)
+		os.Remove(tmpPath)
+		return
+	}
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		log.Println("Rename failed:", err)
+	}
+}
+
+// BackupFile 读取导出目录里的文件, 加密的文件按块解密, 没加密的直接读
+type BackupFile struct {
+	file       *os.File
+	aead       cipher.AEAD
+	header     []byte
+	size       int64
+	modTime    time.Time
+	offset     int64
+	chunkIndex int64
+	chunk      []byte
+}
+
+func OpenBackupFile(path string) (*BackupFile, error) {
+	return openBackupFile(path, nil)
+}
+
+func openBackupFile(path string, key *backupKey) (*BackupFile, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	f := &BackupFile{file: fp, size: fileInfo.Size(), modTime: fileInfo.ModTime(), chunkIndex: -1}
+	header := make([]byte, backupFileHeaderSize)
+	n, _ := fp.ReadAt(header, 0)
+	if n < backupFileHeaderSize || string(header[:len(backupFileMagic)]) != backupFileMagic {
+		return f, nil
+	}
+
+	keyID := header[len(backupFileMagic) : len(backupFileMagic)+backupKeyIDSize]
+	if key == nil {
+		key = getBackupKeyByID(keyID)
+	}
+	if key == nil || !bytes.Equal(key.keyID, keyID) {
+		fp.Close()
+		return nil, ErrBackupLocked
+	}
+
+	f.aead = key.aead
+	f.header = header
+	f.size = int64(binary.LittleEndian.Uint64(header[backupFileHeaderSize-8:]))
+	return f, nil
+}
+
+func (f *BackupFile) Size() int64 {
+	return f.size
+}
+
+func (f *BackupFile) ModTime() time.Time {
+	return f.modTime
+}
+
+func (f *BackupFile) Encrypted() bool {
+	return f.aead != nil
+}
+
+func (f *BackupFile) loadChunk(index int64) error {
+	plainSize := f.size - index*backupChunkSize
+	if plainSize > backupChunkSize {
+		plainSize = backupChunkSize
+	}
+	overhead := int64(f.aead.Overhead())
+	buffer := make([]byte, plainSize+overhead)
+	offset := int64(backupFileHeaderSize) + index*(backupChunkSize+overhead)
+	if _, err := f.file.ReadAt(buffer, offset); err != nil {
+		return err
+	}
+
+	nonce := f.header[len(backupFileMagic)+backupKeyIDSize : backupFileHeaderSize-8]
+	chunk, err := f.aead.Open(buffer[:0], backupChunkNonce(nonce, uint32(index)), buffer, f.header)
+	if err != nil {
+		return err
+	}
+	f.chunk = chunk
+	f.chunkIndex = index
+	return nil
+}
+
+func (f *BackupFile) Read(p []byte) (int, error) {
+	if f.aead == nil {
+		return f.file.Read(p)
+	}
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+
+	index := f.offset / backupChunkSize
+	if index != f.chunkIndex {
+		if err := f.loadChunk(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, f.chunk[f.offset-index*backupChunkSize:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *BackupFile) Seek(offset int64, whence int) (int64, error) {
+	if f.aead == nil {
+		return f.file.Seek(offset, whence)
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *BackupFile) Close() error {
+	return f.file.Close()
+}
+
+func ReadBackupFile(path string) ([]byte, error) {
+	f, err := OpenBackupFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// WriteBackupFile 往导出目录写文件, 导出已加密时写入加密后的内容, 直接打开的微信目录不能写入
+func WriteBackupFile(resPath string, path string, data []byte) error {
+	key := getBackupKey(resPath)
+	if key == nil {
+		return os.WriteFile(path, data, 0644)
+	}
+	if key.aead == nil {
+		return ErrBackupReadOnly
+	}
+	return encryptBackupStream(bytes.NewReader(data), int64(len(data)), path, key)
+}
+
+// CopyBackupFile 从导出目录拷贝出明文文件
+func CopyBackupFile(src, dst string) (int64, error) {
+	return copyBackupFile(src, dst, nil)
+}
+
+func copyBackupFile(src, dst string, key *backupKey) (int64, error) {
+	f, err := openBackupFile(src, key)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	defer dstFile.Close()
+
+	return io.Copy(dstFile, f)
+}
+
+// BackupPlainFilePath 需要交给外部程序打开的文件, 加密时解密到临时目录.
+// 外部程序只能读明文, 这个副本会留在临时目录里直到程序退出时LockAllBackups, 每次打开用单独的目录, 同名文件不会互相覆盖
+func BackupPlainFilePath(path string) (string, error) {
+	if !fileHasPrefix(path, backupFileMagic) {
+		return path, nil
+	}
+
+	openDir := backupOpenDir()
+	if err := os.MkdirAll(openDir, 0700); err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(openDir, "")
+	if err != nil {
+		return "", err
+	}
+	dstPath := filepath.Join(dir, filepath.Base(path))
+	if _, err := CopyBackupFile(path, dstPath); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dstPath, nil
+}
+
+func backupOpenDir() string {
+	return filepath.Join(os.TempDir(), "wechatDataBackup", "open")
+}
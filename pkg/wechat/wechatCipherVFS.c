@@ -0,0 +1,181 @@
+//go:build cgo
+
+#include <stdio.h>
+#include "wechatCipherVFS.h"
+#include "_cgo_export.h"
+
+#define SQLITE_OK              0
+#define SQLITE_READONLY        8
+#define SQLITE_NOTFOUND        12
+#define SQLITE_CANTOPEN        14
+#define SQLITE_OPEN_READONLY   0x00000001
+#define SQLITE_OPEN_MAIN_DB    0x00000100
+#define SQLITE_IOCAP_IMMUTABLE 0x00002000
+
+extern int sqlite3_vfs_register(sqlite3_vfs*, int makeDflt);
+extern sqlite3_vfs *sqlite3_vfs_find(const char *zVfsName);
+
+// 只读VFS: 读取时按页解密, 不支持写入, 临时文件也不能在这个VFS上创建
+typedef struct wxcipherFile {
+	sqlite3_file base;
+	int id;
+} wxcipherFile;
+
+static sqlite3_vfs *wxcipherDefault;
+
+static int wxClose(sqlite3_file *f) {
+	wxcipherClose(((wxcipherFile*)f)->id);
+	return SQLITE_OK;
+}
+
+static int wxRead(sqlite3_file *f, void *buf, int amt, sqlite3_int64 offset) {
+	return wxcipherRead(((wxcipherFile*)f)->id, buf, amt, offset);
+}
+
+static int wxWrite(sqlite3_file *f, const void *buf, int amt, sqlite3_int64 offset) {
+	return SQLITE_READONLY;
+}
+
+static int wxTruncate(sqlite3_file *f, sqlite3_int64 size) {
+	return SQLITE_READONLY;
+}
+
+static int wxSync(sqlite3_file *f, int flags) {
+	return SQLITE_OK;
+}
+
+static int wxFileSize(sqlite3_file *f, sqlite3_int64 *size) {
+	*size = wxcipherFileSize(((wxcipherFile*)f)->id);
+	return SQLITE_OK;
+}
+
+static int wxLock(sqlite3_file *f, int lock) {
+	return SQLITE_OK;
+}
+
+static int wxCheckReservedLock(sqlite3_file *f, int *out) {
+	*out = 0;
+	return SQLITE_OK;
+}
+
+static int wxFileControl(sqlite3_file *f, int op, void *arg) {
+	return SQLITE_NOTFOUND;
+}
+
+static int wxSectorSize(sqlite3_file *f) {
+	return 4096;
+}
+
+static int wxDeviceCharacteristics(sqlite3_file *f) {
+	return SQLITE_IOCAP_IMMUTABLE;
+}
+
+static const sqlite3_io_methods wxcipherMethods = {
+	1,
+	wxClose,
+	wxRead,
+	wxWrite,
+	wxTruncate,
+	wxSync,
+	wxFileSize,
+	wxLock,
+	wxLock,
+	wxCheckReservedLock,
+	wxFileControl,
+	wxSectorSize,
+	wxDeviceCharacteristics,
+};
+
+static int wxOpen(sqlite3_vfs *vfs, const char *name, sqlite3_file *file, int flags, int *outFlags) {
+	wxcipherFile *p = (wxcipherFile*)file;
+	p->base.pMethods = 0;
+	if (name == 0 || (flags & SQLITE_OPEN_MAIN_DB) == 0) {
+		return SQLITE_CANTOPEN;
+	}
+
+	int id = wxcipherOpen((char*)name);
+	if (id < 0) {
+		return SQLITE_CANTOPEN;
+	}
+	p->id = id;
+	p->base.pMethods = &wxcipherMethods;
+	if (outFlags) {
+		*outFlags = SQLITE_OPEN_READONLY;
+	}
+	return SQLITE_OK;
+}
+
+static int wxDelete(sqlite3_vfs *vfs, const char *name, int syncDir) {
+	return SQLITE_OK;
+}
+
+static int wxAccess(sqlite3_vfs *vfs, const char *name, int flags, int *out) {
+	*out = 0;
+	return SQLITE_OK;
+}
+
+static int wxFullPathname(sqlite3_vfs *vfs, const char *name, int nOut, char *out) {
+	snprintf(out, nOut, "%s", name);
+	return SQLITE_OK;
+}
+
+static void *wxDlOpen(sqlite3_vfs *vfs, const char *filename) {
+	return wxcipherDefault->xDlOpen(wxcipherDefault, filename);
+}
+
+static void wxDlError(sqlite3_vfs *vfs, int nByte, char *errMsg) {
+	wxcipherDefault->xDlError(wxcipherDefault, nByte, errMsg);
+}
+
+static void (*wxDlSym(sqlite3_vfs *vfs, void *handle, const char *symbol))(void) {
+	return wxcipherDefault->xDlSym(wxcipherDefault, handle, symbol);
+}
+
+static void wxDlClose(sqlite3_vfs *vfs, void *handle) {
+	wxcipherDefault->xDlClose(wxcipherDefault, handle);
+}
+
+static int wxRandomness(sqlite3_vfs *vfs, int nByte, char *out) {
+	return wxcipherDefault->xRandomness(wxcipherDefault, nByte, out);
+}
+
+static int wxSleep(sqlite3_vfs *vfs, int microseconds) {
+	return wxcipherDefault->xSleep(wxcipherDefault, microseconds);
+}
+
+static int wxCurrentTime(sqlite3_vfs *vfs, double *now) {
+	return wxcipherDefault->xCurrentTime(wxcipherDefault, now);
+}
+
+static int wxGetLastError(sqlite3_vfs *vfs, int nByte, char *errMsg) {
+	return wxcipherDefault->xGetLastError(wxcipherDefault, nByte, errMsg);
+}
+
+static sqlite3_vfs wxcipherVfs = {
+	1,
+	sizeof(wxcipherFile),
+	512,
+	0,
+	"wxcipher",
+	0,
+	wxOpen,
+	wxDelete,
+	wxAccess,
+	wxFullPathname,
+	wxDlOpen,
+	wxDlError,
+	wxDlSym,
+	wxDlClose,
+	wxRandomness,
+	wxSleep,
+	wxCurrentTime,
+	wxGetLastError,
+};
+
+int wxcipherRegister(void) {
+	wxcipherDefault = sqlite3_vfs_find(0);
+	if (wxcipherDefault == 0) {
+		return SQLITE_NOTFOUND;
+	}
+	return sqlite3_vfs_register(&wxcipherVfs, 0);
+}
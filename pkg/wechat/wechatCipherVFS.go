@@ -0,0 +1,281 @@
+//go:build cgo
+
+package wechat
+
+/*
+#include "wechatCipherVFS.h"
+*/
+import "C"
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// 大的数据库不整个解密到内存, 通过只读VFS在sqlite读页的时候再解密,
+// 内存里只有sqlite自己的页缓存和-wal里已提交的页, 明文同样不会写到磁盘上
+
+const (
+	sqliteIOErrRead      = 10 | (1 << 8)
+	sqliteIOErrShortRead = 10 | (2 << 8)
+)
+
+// secureSQLiteDriver 临时表和排序只放在内存里, 避免明文落到临时文件
+const secureSQLiteDriver = "sqlite3_wechatDataBackup"
+
+func init() {
+	sql.Register(secureSQLiteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			_, err := conn.Exec("PRAGMA temp_store=MEMORY;", nil)
+			return err
+		},
+	})
+}
+
+type cipherVFSFile struct {
+	file     *os.File
+	profile  *CipherProfile
+	block    cipher.Block
+	macKey   []byte
+	size     int64
+	walPages map[uint32][]byte
+	badPage  sync.Once
+	path     string
+}
+
+var cipherVFSOnce sync.Once
+var cipherVFSErr error
+var cipherVFSIndex int
+var cipherVFSFiles = make(map[int]*cipherVFSFile)
+var cipherDataBases = make(map[*sql.DB]int)
+var cipherVFSMtx sync.RWMutex
+
+func registerCipherVFS() error {
+	cipherVFSOnce.Do(func() {
+		if rc := C.wxcipherRegister(); rc != 0 {
+			cipherVFSErr = fmt.Errorf("register cipher vfs failed: %d", int(rc))
+		}
+	})
+	return cipherVFSErr
+}
+
+// openCipherDataBase 通过只读VFS打开SQLCipher数据库, -wal里已提交的页会覆盖原来的页
+func openCipherDataBase(path string, password []byte) (*sql.DB, error) {
+	if err := registerCipherVFS(); err != nil {
+		return nil, err
+	}
+
+	page1, err := readFirstPage(path)
+	if err != nil {
+		return nil, err
+	}
+	profile := detectPageProfile(page1, password)
+	if profile == nil {
+		return nil, ErrIncorrectPassword
+	}
+	key, macKey := profile.deriveKey(password, page1[:saltSize])
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	f := &cipherVFSFile{file: fp, profile: profile, block: block, macKey: macKey, path: path}
+	f.size = stat.Size() / int64(profile.PageSize) * int64(profile.PageSize)
+	wal := &walOverlay{pageSize: profile.PageSize, size: f.size, pages: make(map[uint32][]byte)}
+	if _, err := os.Stat(path + "-wal"); err == nil {
+		frames, badPages, err := profile.mergeWal(path+"-wal", wal, block, macKey)
+		if err != nil {
+			log.Println("mergeWal failed:", path, err)
+		} else if len(badPages) > 0 {
+			log.Printf("%s: %d wal frames merged, stop at bad frame page %d\n", path, frames, badPages[0].Page)
+		}
+	}
+	f.size = wal.size
+	f.walPages = wal.pages
+
+	cipherVFSMtx.Lock()
+	cipherVFSIndex += 1
+	id := cipherVFSIndex
+	cipherVFSFiles[id] = f
+	cipherVFSMtx.Unlock()
+
+	uri := fmt.Sprintf("file:/wxcipher/%d?vfs=wxcipher&mode=ro&immutable=1", id)
+	db, err := sql.Open(secureSQLiteDriver, uri)
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		if db != nil {
+			db.Close()
+		}
+		releaseCipherFile(id)
+		return nil, err
+	}
+
+	cipherVFSMtx.Lock()
+	cipherDataBases[db] = id
+	cipherVFSMtx.Unlock()
+	return db, nil
+}
+
+// closeCipherDataBase 在数据库关闭之后释放VFS打开的文件
+func closeCipherDataBase(db *sql.DB) {
+	cipherVFSMtx.Lock()
+	id, exists := cipherDataBases[db]
+	delete(cipherDataBases, db)
+	cipherVFSMtx.Unlock()
+	if exists {
+		releaseCipherFile(id)
+	}
+}
+
+func releaseCipherFile(id int) {
+	cipherVFSMtx.Lock()
+	f := cipherVFSFiles[id]
+	delete(cipherVFSFiles, id)
+	cipherVFSMtx.Unlock()
+	if f != nil {
+		f.file.Close()
+	}
+}
+
+func getCipherFile(id C.int) *cipherVFSFile {
+	cipherVFSMtx.RLock()
+	defer cipherVFSMtx.RUnlock()
+	return cipherVFSFiles[int(id)]
+}
+
+// readPage 解密第pgno页到dst, 校验失败的页读出来是全0, 第一页开头换回sqlite的文件头, 并改成rollback journal模式
+func (f *cipherVFSFile) readPage(dst []byte, pgno uint32) error {
+	pageSize := f.profile.PageSize
+	if page, exists := f.walPages[pgno]; exists {
+		copy(dst, page)
+	} else {
+		page := make([]byte, pageSize)
+		if _, err := f.file.ReadAt(page, int64(pgno-1)*int64(pageSize)); err != nil {
+			return err
+		}
+		data := page
+		if pgno == 1 {
+			data = page[saltSize:]
+		}
+		if !f.profile.verifyPage(f.macKey, data, pgno) {
+			// 和解密到内存时的BadPageZero一样当作全0的页, 没坏的表还能查
+			f.badPage.Do(func() {
+				log.Printf("%s: page %d hmac mismatch\n", f.path, pgno)
+			})
+			clear(dst)
+		} else if pgno == 1 {
+			copy(dst, "SQLite format 3\x00")
+			f.profile.decryptPageTo(dst[saltSize:], f.block, data)
+		} else {
+			f.profile.decryptPageTo(dst, f.block, data)
+		}
+	}
+	if pgno == 1 {
+		dst[18], dst[19] = 1, 1
+	}
+	return nil
+}
+
+//export wxcipherOpen
+func wxcipherOpen(name *C.char) C.int {
+	id, err := strconv.Atoi(strings.TrimPrefix(C.GoString(name), "/wxcipher/"))
+	if err != nil || getCipherFile(C.int(id)) == nil {
+		return -1
+	}
+	return C.int(id)
+}
+
+//export wxcipherClose
+func wxcipherClose(id C.int) {
+}
+
+//export wxcipherFileSize
+func wxcipherFileSize(id C.int) C.sqlite3_int64 {
+	f := getCipherFile(id)
+	if f == nil {
+		return 0
+	}
+	return C.sqlite3_int64(f.size)
+}
+
+//export wxcipherRead
+func wxcipherRead(id C.int, buf unsafe.Pointer, amt C.int, offset C.sqlite3_int64) C.int {
+	f := getCipherFile(id)
+	if f == nil {
+		return sqliteIOErrRead
+	}
+	dst := unsafe.Slice((*byte)(buf), int(amt))
+	pos := int64(offset)
+	end := pos + int64(amt)
+	if end > f.size {
+		end = f.size
+	}
+
+	pageSize := int64(f.profile.PageSize)
+	page := make([]byte, pageSize)
+	n := 0
+	for pos < end {
+		pgno := uint32(pos/pageSize) + 1
+		if err := f.readPage(page, pgno); err != nil {
+			return sqliteIOErrRead
+		}
+		inPage := pos % pageSize
+		copied := copy(dst[n:], page[inPage:min(pageSize, inPage+end-pos)])
+		n += copied
+		pos += int64(copied)
+	}
+
+	if n < len(dst) {
+		clear(dst[n:])
+		return sqliteIOErrShortRead
+	}
+	return 0
+}
+
+// walOverlay 收集mergeWal写出的页, 不修改原文件
+type walOverlay struct {
+	pageSize int
+	size     int64
+	pages    map[uint32][]byte
+}
+
+func (w *walOverlay) Write(p []byte) (int, error) {
+	return 0, errors.New("wal overlay only support WriteAt")
+}
+
+func (w *walOverlay) WriteAt(p []byte, off int64) (int, error) {
+	if len(p) != w.pageSize || off%int64(w.pageSize) != 0 {
+		return 0, errors.New("wal overlay only support whole page")
+	}
+	w.pages[uint32(off/int64(w.pageSize))+1] = p
+	w.size = max(w.size, off+int64(len(p)))
+	return len(p), nil
+}
+
+func (w *walOverlay) Truncate(size int64) error {
+	w.size = size
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !cgo
+
+package wechat
+
+import (
+	"database/sql"
+)
+
+const secureSQLiteDriver = "sqlite3"
+
+func openCipherDataBase(path string, password []byte) (*sql.DB, error) {
+	return nil, errCipherVFSUnsupported
+}
+
+func closeCipherDataBase(db *sql.DB) {
+}
@@ -2,22 +2,406 @@ package wechat
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 )
 
 const (
 	keySize         = 32
+	saltSize        = 16
+	ivSize          = 16
 	defaultIter     = 64000
 	defaultPageSize = 4096
 )
 
+// CipherProfile 描述一种SQLCipher加密参数, 每页末尾的Reserve区依次是IV, HMAC和填充
+type CipherProfile struct {
+	Name     string
+	PageSize int
+	Iter     int
+	Reserve  int
+	Hash     func() hash.Hash
+}
+
+var (
+	// 微信3.x 对应SQLCipher 3的默认参数
+	CipherProfileV3 = CipherProfile{Name: "sqlcipher3", PageSize: defaultPageSize, Iter: defaultIter, Reserve: 48, Hash: sha1.New}
+	// 微信4.x 对应SQLCipher 4的默认参数
+	CipherProfileV4 = CipherProfile{Name: "sqlcipher4", PageSize: defaultPageSize, Iter: 256000, Reserve: 80, Hash: sha512.New}
+)
+
+// CipherProfiles 自动识别时按顺序尝试, 第一个是默认值
+var CipherProfiles = []*CipherProfile{&CipherProfileV3, &CipherProfileV4}
+
+var (
+	ErrIncorrectPassword = errors.New("incorrect password")
+	ErrPageLayout        = errors.New("page layout not match cipher profile")
+)
+
+func GetCipherProfile(name string) (*CipherProfile, error) {
+	for _, profile := range CipherProfiles {
+		if profile.Name == name {
+			return profile, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown cipher profile %s", name)
+}
+
+func (c *CipherProfile) String() string {
+	return c.Name
+}
+
+// deriveKey 由数据库key和盐计算出AES key和HMAC key
+func (c *CipherProfile) deriveKey(password []byte, salt []byte) ([]byte, []byte) {
+	key := pbkdf2HMAC(password, salt, c.Iter, keySize, c.Hash)
+	macSalt := xorBytes(salt, 0x3a)
+	macKey := pbkdf2HMAC(key, macSalt, 2, keySize, c.Hash)
+	return key, macKey
+}
+
+func (c *CipherProfile) pageMac(macKey []byte, page []byte, pgno uint32) []byte {
+	hashMac := hmac.New(c.Hash, macKey)
+	hashMac.Write(page[:len(page)-c.Reserve+ivSize])
+	hashMac.Write([]byte{byte(pgno), byte(pgno >> 8), byte(pgno >> 16), byte(pgno >> 24)})
+	return hashMac.Sum(nil)
+}
+
+// verifyPage 校验一页的HMAC, page是去掉文件头盐之后的页数据, pgno从1开始
+func (c *CipherProfile) verifyPage(macKey []byte, page []byte, pgno uint32) bool {
+	mac := c.pageMac(macKey, page, pgno)
+	macOffset := len(page) - c.Reserve + ivSize
+	return hmac.Equal(mac, page[macOffset:macOffset+len(mac)])
+}
+
+// decryptPage 解密一页, 返回的数据保留原来的Reserve区, 这样解密后的数据库页大小不变
+func (c *CipherProfile) decryptPage(block cipher.Block, page []byte) []byte {
+	decrypted := make([]byte, len(page))
+	c.decryptPageTo(decrypted, block, page)
+	return decrypted
+}
+
+func (c *CipherProfile) decryptPageTo(dst []byte, block cipher.Block, page []byte) {
+	ivOffset := len(page) - c.Reserve
+	stream := cipher.NewCBCDecrypter(block, page[ivOffset:ivOffset+ivSize])
+	stream.CryptBlocks(dst[:ivOffset], page[:ivOffset])
+	copy(dst[ivOffset:len(page)], page[ivOffset:])
+}
+
+// encryptPage 是decryptPage的逆过程, 明文页的Reserve区会被IV和HMAC覆盖
+func (c *CipherProfile) encryptPage(block cipher.Block, macKey []byte, page []byte, pgno uint32) ([]byte, error) {
+	ivOffset := len(page) - c.Reserve
+	encrypted := make([]byte, len(page))
+	iv := encrypted[ivOffset : ivOffset+ivSize]
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	stream := cipher.NewCBCEncrypter(block, iv)
+	stream.CryptBlocks(encrypted[:ivOffset], page[:ivOffset])
+	copy(encrypted[ivOffset+ivSize:], c.pageMac(macKey, encrypted, pgno))
+	return encrypted, nil
+}
+
+// checkKey 用第一页校验key是否匹配这个加密参数
+func (c *CipherProfile) checkKey(page1 []byte, password []byte) bool {
+	if len(page1) < c.PageSize {
+		return false
+	}
+	_, macKey := c.deriveKey(password, page1[:saltSize])
+	return c.verifyPage(macKey, page1[saltSize:c.PageSize], 1)
+}
+
+func readFirstPage(path string) ([]byte, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	buffer := make([]byte, defaultPageSize)
+	if _, err := io.ReadFull(fp, buffer); err != nil {
+		return nil, fmt.Errorf("read failed: %v", err)
+	}
+	return buffer, nil
+}
+
+// DetectCipherProfile 用第一页的HMAC识别数据库的加密参数, key不对时返回ErrIncorrectPassword
+func DetectCipherProfile(path string, password []byte) (*CipherProfile, error) {
+	page1, err := readFirstPage(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if profile := detectPageProfile(page1, password); profile != nil {
+		return profile, nil
+	}
+	return nil, ErrIncorrectPassword
+}
+
+type BadPagePolicy int
+
+const (
+	// 坏页写全0, 后面的页号不变, sqlite还能打开其它没坏的表
+	BadPageZero BadPagePolicy = iota
+	// 遇到坏页直接返回错误
+	BadPageFail
+)
+
+type DecryptBadPage struct {
+	Page   int    `json:"Page"`
+	Offset int64  `json:"Offset"`
+	Reason string `json:"Reason"`
+}
+
+// DecryptReport 记录每个数据库解密时的页校验结果, WalError不为空时-wal读取或解析失败, 里面最新的消息没有合并进来
+type DecryptReport struct {
+	Path      string           `json:"Path"`
+	Profile   string           `json:"Profile"`
+	Pages     int              `json:"Pages"`
+	OKPages   int              `json:"OKPages"`
+	BadPages  []DecryptBadPage `json:"BadPages"`
+	WalFrames int              `json:"WalFrames"`
+	WalError  string           `json:"WalError"`
+	Integrity string           `json:"Integrity"`
+}
+
+type DecryptOptions struct {
+	// 为空时自动识别
+	Profile        *CipherProfile
+	BadPage        BadPagePolicy
+	IntegrityCheck bool
+	// 并发解密的协程数, 0表示CPU核数
+	Workers int
+	// 不为空时解密出来的页重新加密后再写入, 见SetBackupPassword
+	backup *backupKey
+}
+
+var DefaultDecryptOptions = DecryptOptions{BadPage: BadPageZero, IntegrityCheck: true}
+
+func ParseBadPagePolicy(name string) (BadPagePolicy, error) {
+	switch name {
+	case "zero", "":
+		return BadPageZero, nil
+	case "fail":
+		return BadPageFail, nil
+	}
+	return BadPageZero, fmt.Errorf("unknown bad page policy %s", name)
+}
+
+// HasError 有坏页或者完整性检查没通过
+func (r *DecryptReport) HasError() bool {
+	return len(r.BadPages) > 0 || len(r.WalError) > 0 || (len(r.Integrity) > 0 && r.Integrity != "ok")
+}
+
+func (r *DecryptReport) String() string {
+	str := fmt.Sprintf("%s: %d/%d pages ok", filepath.Base(r.Path), r.OKPages, r.Pages)
+	if r.WalFrames > 0 {
+		str += fmt.Sprintf(", %d wal frames merged", r.WalFrames)
+	}
+	if len(r.WalError) > 0 {
+		str += ", wal not merged: " + r.WalError
+	}
+	if len(r.Integrity) > 0 {
+		str += ", integrity " + strings.ReplaceAll(r.Integrity, "\n", "; ")
+	}
+	return str
+}
+
+// DecryptDataBase 自动识别加密参数并解密数据库到expPath
 func DecryptDataBase(path string, password []byte, expPath string) error {
+	report, err := DecryptDataBaseWithReport(path, password, expPath, DecryptOptions{})
+	if err == nil && report.HasError() {
+		log.Println("DecryptDataBase:", report)
+	}
+	return err
+}
+
+func DecryptDataBaseWithProfile(path string, password []byte, expPath string, profile *CipherProfile) error {
+	_, err := DecryptDataBaseWithReport(path, password, expPath, DecryptOptions{Profile: profile})
+	return err
+}
+
+// DecryptDataBaseWithReport 解密并校验每一页的HMAC, 坏页按opts.BadPage处理, 第一页校验不过认为是key不对
+func DecryptDataBaseWithReport(path string, password []byte, expPath string, opts DecryptOptions) (*DecryptReport, error) {
+	report := &DecryptReport{Path: path, BadPages: make([]DecryptBadPage, 0)}
+	var outFile *os.File
+	err := decryptDataBase(path, password, opts, report, func() (decryptTarget, error) {
+		var err error
+		outFile, err = os.Create(expPath)
+		if err != nil || opts.backup == nil {
+			return outFile, err
+		}
+		profile, err := GetCipherProfile(report.Profile)
+		if err != nil {
+			return nil, err
+		}
+		return newCipherTarget(outFile, profile, opts.backup.password)
+	})
+	if outFile != nil {
+		outFile.Close()
+	}
+	if err != nil {
+		return report, err
+	}
+
+	if opts.IntegrityCheck && opts.backup != nil {
+		if db, err := openBackupDataBase(expPath); err != nil {
+			report.Integrity = err.Error()
+		} else {
+			report.Integrity = queryIntegrityCheck(db)
+			closeDataBase(db)
+		}
+	} else if opts.IntegrityCheck {
+		report.Integrity = dataBaseIntegrityCheck(expPath)
+	}
+	return report, nil
+}
+
+// DecryptDataBaseToMemory 和DecryptDataBaseWithReport一样, 只是解密结果放在内存里不写文件, 不做完整性检查
+func DecryptDataBaseToMemory(path string, password []byte, opts DecryptOptions) ([]byte, *DecryptReport, error) {
+	report := &DecryptReport{Path: path, BadPages: make([]DecryptBadPage, 0)}
+	mem := &memFile{}
+	err := decryptDataBase(path, password, opts, report, func() (decryptTarget, error) {
+		if info, err := os.Stat(path); err == nil {
+			mem.data = make([]byte, 0, info.Size())
+		}
+		return mem, nil
+	})
+	if err != nil {
+		return nil, report, err
+	}
+	return mem.data, report, nil
+}
+
+// cipherTarget 把解密出来的页用另一个key重新加密再写到文件里, 按整页处理, 明文不会写到文件里
+type cipherTarget struct {
+	out     *os.File
+	profile *CipherProfile
+	block   cipher.Block
+	macKey  []byte
+	salt    []byte
+	page    []byte
+	offset  int64
+}
+
+func newCipherTarget(out *os.File, profile *CipherProfile, password []byte) (*cipherTarget, error) {
+	salt, err := randomBytes(saltSize)
+	if err != nil {
+		return nil, err
+	}
+	key, macKey := profile.deriveKey(password, salt)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &cipherTarget{out: out, profile: profile, block: block, macKey: macKey, salt: salt}, nil
+}
+
+// encrypt 第一页开头的sqlite文件头换成盐
+func (t *cipherTarget) encrypt(page []byte, pgno uint32) ([]byte, error) {
+	if pgno != 1 {
+		return t.profile.encryptPage(t.block, t.macKey, page, pgno)
+	}
+	encrypted, err := t.profile.encryptPage(t.block, t.macKey, page[saltSize:], 1)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(make([]byte, 0, len(page)), t.salt...), encrypted...), nil
+}
+
+func (t *cipherTarget) Write(p []byte) (int, error) {
+	pageSize := t.profile.PageSize
+	t.page = append(t.page, p...)
+	for len(t.page) >= pageSize {
+		encrypted, err := t.encrypt(t.page[:pageSize], uint32(t.offset/int64(pageSize))+1)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := t.out.WriteAt(encrypted, t.offset); err != nil {
+			return 0, err
+		}
+		t.page = t.page[pageSize:]
+		t.offset += int64(pageSize)
+	}
+	return len(p), nil
+}
+
+func (t *cipherTarget) WriteAt(p []byte, off int64) (int, error) {
+	pageSize := t.profile.PageSize
+	if len(p) != pageSize || off%int64(pageSize) != 0 {
+		return 0, errors.New("cipher target only support whole page")
+	}
+	encrypted, err := t.encrypt(p, uint32(off/int64(pageSize))+1)
+	if err != nil {
+		return 0, err
+	}
+	return t.out.WriteAt(encrypted, off)
+}
+
+func (t *cipherTarget) Truncate(size int64) error {
+	return t.out.Truncate(size)
+}
+
+// decryptTarget 解密输出, 按顺序写入页, 合并-wal时按偏移覆盖
+type decryptTarget interface {
+	io.Writer
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+type memFile struct {
+	data []byte
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.data = append(f.data, p...)
+	return len(p), nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.Truncate(max(off+int64(len(p)), int64(len(f.data)))); err != nil {
+		return 0, err
+	}
+	return copy(f.data[off:], p), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if size < int64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		f.data = append(f.data, make([]byte, size-int64(len(f.data)))...)
+	}
+	return nil
+}
+
+// decryptDataBase 第一页校验通过后才调用create创建输出, key不对时不会留下空文件
+func decryptDataBase(path string, password []byte, opts DecryptOptions, report *DecryptReport, create func() (decryptTarget, error)) error {
+	profile := opts.Profile
+	if profile == nil {
+		var err error
+		profile, err = DetectCipherProfile(path, password)
+		if err != nil {
+			return err
+		}
+	}
+	report.Profile = profile.Name
+
 	sqliteFileHeader := []byte("SQLite format 3")
 	sqliteFileHeader = append(sqliteFileHeader, byte(0))
 
@@ -27,114 +411,446 @@ func DecryptDataBase(path string, password []byte, expPath string) error {
 	}
 	defer fp.Close()
 
-	fpReader := bufio.NewReaderSize(fp, defaultPageSize*100)
-	// fpReader := bufio.NewReader(fp)
-
-	buffer := make([]byte, defaultPageSize)
+	fpReader := bufio.NewReaderSize(fp, profile.PageSize*100)
 
-	n, err := fpReader.Read(buffer)
-	if err != nil && n != defaultPageSize {
+	buffer := make([]byte, profile.PageSize)
+	if _, err := io.ReadFull(fpReader, buffer); err != nil {
 		return fmt.Errorf("read failed")
 	}
 
-	salt := buffer[:16]
-	key := pbkdf2HMAC(password, salt, defaultIter, keySize)
-
-	page1 := buffer[16:defaultPageSize]
+	salt := buffer[:saltSize]
+	key, macKey := profile.deriveKey(password, salt)
+	if !profile.verifyPage(macKey, buffer[saltSize:], 1) {
+		return ErrIncorrectPassword
+	}
 
-	macSalt := xorBytes(salt, 0x3a)
-	macKey := pbkdf2HMAC(key, macSalt, 2, keySize)
+	out, err := create()
+	if err != nil {
+		return err
+	}
+	outWriter := bufio.NewWriterSize(out, profile.PageSize*100)
 
-	hashMac := hmac.New(sha1.New, macKey)
-	hashMac.Write(page1[:len(page1)-32])
-	hashMac.Write([]byte{1, 0, 0, 0})
+	// Write SQLite file header
+	_, err = outWriter.Write(sqliteFileHeader)
+	if err != nil {
+		return err
+	}
 
-	if !hmac.Equal(hashMac.Sum(nil), page1[len(page1)-32:len(page1)-12]) {
-		return fmt.Errorf("incorrect password")
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
 	}
 
-	outFilePath := expPath
-	outFile, err := os.Create(outFilePath)
+	_, err = outWriter.Write(profile.decryptPage(block, buffer[saltSize:]))
 	if err != nil {
 		return err
 	}
-	defer outFile.Close()
+	report.Pages = 1
+	report.OKPages = 1
 
-	// Write SQLite file header
-	_, err = outFile.Write(sqliteFileHeader)
+	if err := profile.decryptPages(fpReader, outWriter, block, macKey, opts, report); err != nil {
+		return err
+	}
+
+	if err := outWriter.Flush(); err != nil {
+		return err
+	}
+
+	// 最新的消息可能还在-wal里没有写回数据库
+	if _, err := os.Stat(path + "-wal"); err == nil {
+		frames, badPages, err := profile.mergeWal(path+"-wal", out, block, macKey)
+		if err != nil {
+			log.Println("mergeWal failed:", path, err)
+			report.WalError = err.Error()
+		}
+		report.WalFrames = frames
+		report.BadPages = append(report.BadPages, badPages...)
+	}
+
+	return nil
+}
+
+// 每次读取和并发解密的页数
+const decryptChunkPages = 256
+
+type decryptChunk struct {
+	index   int
+	pgno    int
+	data    []byte
+	out     []byte
+	reasons []string
+}
+
+// decryptChunk 解密一段连续的页, 坏页在out里保持全0, reasons记录原因
+func (c *CipherProfile) decryptChunk(block cipher.Block, macKey []byte, chunk *decryptChunk) {
+	pages := (len(chunk.data) + c.PageSize - 1) / c.PageSize
+	chunk.out = make([]byte, pages*c.PageSize)
+	chunk.reasons = make([]string, pages)
+	for i := 0; i < pages; i++ {
+		page := chunk.data[i*c.PageSize : min(len(chunk.data), (i+1)*c.PageSize)]
+		if len(page) < c.PageSize {
+			// 数据库正在写入时拷贝出来的, 最后一页可能不完整
+			chunk.reasons[i] = fmt.Sprintf("read data to short %d", len(page))
+		} else if !c.verifyPage(macKey, page, uint32(chunk.pgno+i)) {
+			chunk.reasons[i] = "hmac mismatch"
+		} else {
+			c.decryptPageTo(chunk.out[i*c.PageSize:], block, page)
+		}
+	}
+}
+
+// decryptPages 从第二页开始流水线解密: 一个协程按块读取, 多个协程并发校验解密, 当前协程按顺序写出
+func (c *CipherProfile) decryptPages(reader io.Reader, writer io.Writer, block cipher.Block, macKey []byte, opts DecryptOptions, report *DecryptReport) error {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	jobs := make(chan *decryptChunk, workers)
+	results := make(chan *decryptChunk, workers)
+	// 限制在途的块数, 某一块解密慢的时候后面的块不会无限堆积在内存里
+	slots := make(chan struct{}, workers*2)
+	done := make(chan struct{})
+	defer close(done)
+
+	var readErr error
+	go func() {
+		defer close(jobs)
+		for index, pgno := 0, 2; ; index, pgno = index+1, pgno+decryptChunkPages {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			data := make([]byte, decryptChunkPages*c.PageSize)
+			n, err := io.ReadFull(reader, data)
+			if n > 0 {
+				select {
+				case jobs <- &decryptChunk{index: index, pgno: pgno, data: data[:n]}:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF && err != io.ErrUnexpectedEOF {
+					readErr = err
+				}
+				return
+			}
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range jobs {
+				c.decryptChunk(block, macKey, chunk)
+				select {
+				case results <- chunk:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pending := make(map[int]*decryptChunk)
+	next := 0
+	for chunk := range results {
+		pending[chunk.index] = chunk
+		for chunk, ok := pending[next]; ok; chunk, ok = pending[next] {
+			delete(pending, next)
+			next += 1
+			if err := c.writeChunk(writer, chunk, opts, report); err != nil {
+				return err
+			}
+			<-slots
+		}
+	}
+
+	return readErr
+}
+
+func (c *CipherProfile) writeChunk(writer io.Writer, chunk *decryptChunk, opts DecryptOptions, report *DecryptReport) error {
+	for i, reason := range chunk.reasons {
+		pgno := chunk.pgno + i
+		page := chunk.out[i*c.PageSize : (i+1)*c.PageSize]
+		report.Pages += 1
+		if len(reason) == 0 {
+			report.OKPages += 1
+			if _, err := writer.Write(page); err != nil {
+				return err
+			}
+			continue
+		}
+
+		offset := int64(pgno-1) * int64(c.PageSize)
+		report.BadPages = append(report.BadPages, DecryptBadPage{Page: pgno, Offset: offset, Reason: reason})
+		switch opts.BadPage {
+		case BadPageFail:
+			return fmt.Errorf("page %d at 0x%X: %s", pgno, offset, reason)
+		case BadPageZero:
+			if _, err := writer.Write(page); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+)
+
+// walChecksum 和sqlite的walChecksumBytes一样, 按32位整数累加
+func walChecksum(bigEndian bool, data []byte, s1 uint32, s2 uint32) (uint32, uint32) {
+	order := binary.ByteOrder(binary.LittleEndian)
+	if bigEndian {
+		order = binary.BigEndian
+	}
+	for i := 0; i+8 <= len(data); i += 8 {
+		s1 += order.Uint32(data[i:]) + s2
+		s2 += order.Uint32(data[i+4:]) + s1
+	}
+	return s1, s2
+}
+
+// mergeWal 解密-wal里已提交的帧并写回解密后的数据库, 相当于做了一次checkpoint
+// WAL的帧头是明文, 校验和是按密文算的, 页数据和数据库里的页一样加密, 第一页同样带盐
+func (c *CipherProfile) mergeWal(walPath string, out decryptTarget, block cipher.Block, macKey []byte) (int, []DecryptBadPage, error) {
+	badPages := make([]DecryptBadPage, 0)
+	wal, err := os.ReadFile(walPath)
+	if err != nil {
+		return 0, badPages, err
+	}
+	if len(wal) < walHeaderSize {
+		return 0, badPages, nil
+	}
+
+	header := wal[:walHeaderSize]
+	magic := binary.BigEndian.Uint32(header[0:4])
+	if magic&0xFFFFFFFE != 0x377F0682 {
+		return 0, badPages, fmt.Errorf("invalid wal magic 0x%X", magic)
+	}
+	if int(binary.BigEndian.Uint32(header[8:12])) != c.PageSize {
+		return 0, badPages, fmt.Errorf("wal page size %d not match", binary.BigEndian.Uint32(header[8:12]))
+	}
+	bigEndian := magic&1 == 1
+	s1, s2 := walChecksum(bigEndian, header[:24], 0, 0)
+	if s1 != binary.BigEndian.Uint32(header[24:28]) || s2 != binary.BigEndian.Uint32(header[28:32]) {
+		// 校验和不对说明WAL已经被checkpoint过或者还没写完, 里面的帧都是无效的
+		return 0, badPages, nil
+	}
+
+	committed := make(map[uint32][]byte)
+	pending := make(map[uint32][]byte)
+	dbSize := uint32(0)
+	frames := 0
+	pendingFrames := 0
+	frameSize := walFrameHeaderSize + c.PageSize
+	for offset := walHeaderSize; offset+frameSize <= len(wal); offset += frameSize {
+		frameHeader := wal[offset : offset+walFrameHeaderSize]
+		page := wal[offset+walFrameHeaderSize : offset+frameSize]
+		if !bytes.Equal(frameHeader[8:16], header[16:24]) {
+			break
+		}
+		s1, s2 = walChecksum(bigEndian, frameHeader[:8], s1, s2)
+		s1, s2 = walChecksum(bigEndian, page, s1, s2)
+		if s1 != binary.BigEndian.Uint32(frameHeader[16:20]) || s2 != binary.BigEndian.Uint32(frameHeader[20:24]) {
+			break
+		}
+
+		pgno := binary.BigEndian.Uint32(frameHeader[0:4])
+		data := page
+		if pgno == 1 {
+			data = page[saltSize:]
+		}
+		if !c.verifyPage(macKey, data, pgno) {
+			// 和SQLite恢复WAL一样停在第一个坏帧, 这个事务里已经读到的页都丢弃, 不会只提交一半
+			badPages = append(badPages, DecryptBadPage{Page: int(pgno), Offset: int64(offset), Reason: "wal frame hmac mismatch"})
+			break
+		}
+		if pgno == 1 {
+			decrypted := make([]byte, 0, c.PageSize)
+			decrypted = append(decrypted, "SQLite format 3\x00"...)
+			pending[pgno] = append(decrypted, c.decryptPage(block, data)...)
+		} else {
+			pending[pgno] = c.decryptPage(block, data)
+		}
+		pendingFrames += 1
+
+		// 提交帧的第二个字段是提交后数据库的页数
+		if commitSize := binary.BigEndian.Uint32(frameHeader[4:8]); commitSize != 0 {
+			for pgno, data := range pending {
+				committed[pgno] = data
+			}
+			pending = make(map[uint32][]byte)
+			dbSize = commitSize
+			frames += pendingFrames
+			pendingFrames = 0
+		}
+	}
+
+	if dbSize == 0 {
+		return 0, badPages, nil
+	}
+
+	for pgno, data := range committed {
+		if pgno > dbSize {
+			continue
+		}
+		if _, err := out.WriteAt(data, int64(pgno-1)*int64(c.PageSize)); err != nil {
+			return 0, badPages, err
+		}
+	}
+	if err := out.Truncate(int64(dbSize) * int64(c.PageSize)); err != nil {
+		return 0, badPages, err
+	}
+
+	return frames, badPages, nil
+}
+
+// dataBaseIntegrityCheck 返回PRAGMA integrity_check的结果, 正常时是"ok"
+func dataBaseIntegrityCheck(path string) string {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err.Error()
+	}
+	defer db.Close()
+
+	return queryIntegrityCheck(db)
+}
+
+func queryIntegrityCheck(db *sql.DB) string {
+	rows, err := db.Query("PRAGMA integrity_check(20);")
+	if err != nil {
+		return err.Error()
+	}
+	defer rows.Close()
+
+	results := make([]string, 0)
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err.Error()
+		}
+		results = append(results, result)
+	}
+	return strings.Join(results, "\n")
+}
+
+// EncryptDataBase 把明文数据库按profile加密成SQLCipher格式, 是DecryptDataBaseWithProfile的逆过程
+// 明文数据库的页大小和每页保留字节数必须和profile一致
+func EncryptDataBase(path string, password []byte, expPath string, profile *CipherProfile) error {
+	fp, err := os.Open(path)
 	if err != nil {
 		return err
 	}
+	defer fp.Close()
+
+	return encryptDataBase(fp, password, expPath, profile)
+}
+
+func encryptDataBase(reader io.Reader, password []byte, expPath string, profile *CipherProfile) error {
+	fpReader := bufio.NewReaderSize(reader, profile.PageSize*100)
 
+	buffer := make([]byte, profile.PageSize)
+	if _, err := io.ReadFull(fpReader, buffer); err != nil {
+		return fmt.Errorf("read failed")
+	}
+
+	if !bytes.HasPrefix(buffer, []byte("SQLite format 3\x00")) {
+		return errors.New("not a sqlite database")
+	}
+	pageSize := int(binary.BigEndian.Uint16(buffer[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize != profile.PageSize || int(buffer[20]) != profile.Reserve {
+		return fmt.Errorf("%w: page size %d reserve %d", ErrPageLayout, pageSize, buffer[20])
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	key, macKey := profile.deriveKey(password, salt)
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return err
 	}
 
-	page1 = buffer[16:defaultPageSize]
-	iv := page1[len(page1)-48 : len(page1)-32]
-	stream := cipher.NewCBCDecrypter(block, iv)
-	decrypted := make([]byte, len(page1)-48)
-	stream.CryptBlocks(decrypted, page1[:len(page1)-48])
-	_, err = outFile.Write(decrypted)
+	outFile, err := os.Create(expPath)
 	if err != nil {
 		return err
 	}
-	_, err = outFile.Write(page1[len(page1)-48:])
+	defer outFile.Close()
+	outWriter := bufio.NewWriterSize(outFile, profile.PageSize*100)
+
+	page, err := profile.encryptPage(block, macKey, buffer[saltSize:], 1)
 	if err != nil {
 		return err
 	}
+	outWriter.Write(salt)
+	if _, err = outWriter.Write(page); err != nil {
+		return err
+	}
 
-	for {
-		n, err = fpReader.Read(buffer)
+	for pgno := uint32(2); ; pgno++ {
+		n, err := io.ReadFull(fpReader, buffer)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
+			if err == io.ErrUnexpectedEOF {
+				return fmt.Errorf("read data to short %d", n)
+			}
 			return err
-		} else if n < defaultPageSize {
-			return fmt.Errorf("read data to short %d", n)
 		}
 
-		iv := buffer[len(buffer)-48 : len(buffer)-32]
-		stream := cipher.NewCBCDecrypter(block, iv)
-		decrypted := make([]byte, len(buffer)-48)
-		stream.CryptBlocks(decrypted, buffer[:len(buffer)-48])
-		_, err = outFile.Write(decrypted)
+		page, err := profile.encryptPage(block, macKey, buffer, pgno)
 		if err != nil {
 			return err
 		}
-		_, err = outFile.Write(buffer[len(buffer)-48:])
-		if err != nil {
+		if _, err = outWriter.Write(page); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return outWriter.Flush()
 }
 
-func pbkdf2HMAC(password, salt []byte, iter, keyLen int) []byte {
+func pbkdf2HMAC(password, salt []byte, iter, keyLen int, h func() hash.Hash) []byte {
+	prf := hmac.New(h, password)
+	hashLen := prf.Size()
 	dk := make([]byte, keyLen)
-	loop := (keyLen + sha1.Size - 1) / sha1.Size
+	loop := (keyLen + hashLen - 1) / hashLen
 	key := make([]byte, 0, len(salt)+4)
-	u := make([]byte, sha1.Size)
+	u := make([]byte, hashLen)
 	for i := 1; i <= loop; i++ {
 		key = key[:0]
 		key = append(key, salt...)
 		key = append(key, byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
-		hmac := hmac.New(sha1.New, password)
-		hmac.Write(key)
-		digest := hmac.Sum(nil)
+		prf.Reset()
+		prf.Write(key)
+		digest := prf.Sum(nil)
 		copy(u, digest)
 		for j := 2; j <= iter; j++ {
-			hmac.Reset()
-			hmac.Write(digest)
-			digest = hmac.Sum(digest[:0])
+			prf.Reset()
+			prf.Write(digest)
+			digest = prf.Sum(digest[:0])
 			for k, di := range digest {
 				u[k] ^= di
 			}
 		}
-		copy(dk[(i-1)*sha1.Size:], u)
+		copy(dk[(i-1)*hashLen:], u)
 	}
 	return dk
 }
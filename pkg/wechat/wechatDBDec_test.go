@@ -0,0 +1,486 @@
+package wechat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestDataBase 生成指定页数的加密数据库, 页内容是随机数据, 返回每页加密前的明文, 第一页的明文不包含盐
+func writeTestDataBase(tb testing.TB, path string, pages int, password []byte, profile *CipherProfile) [][]byte {
+	tb.Helper()
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		tb.Fatal(err)
+	}
+	key, macKey := profile.deriveKey(password, salt)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	outFile, err := os.Create(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer outFile.Close()
+	outWriter := bufio.NewWriterSize(outFile, profile.PageSize*100)
+
+	plains := make([][]byte, 0, pages)
+	for pgno := uint32(1); pgno <= uint32(pages); pgno++ {
+		plain := make([]byte, profile.PageSize)
+		if pgno == 1 {
+			outWriter.Write(salt)
+			plain = plain[saltSize:]
+		}
+		if _, err := rand.Read(plain); err != nil {
+			tb.Fatal(err)
+		}
+		page, err := profile.encryptPage(block, macKey, plain, pgno)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := outWriter.Write(page); err != nil {
+			tb.Fatal(err)
+		}
+		plains = append(plains, plain)
+	}
+
+	if err := outWriter.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+	return plains
+}
+
+func testPassword() []byte {
+	return bytes.Repeat([]byte{0x5a}, keySize)
+}
+
+// 并发解密和单协程顺序解密的结果要完全一致, 并且每页Reserve区之前的内容和加密前一样
+func TestDecryptDataBaseWorkers(t *testing.T) {
+	for _, profile := range CipherProfiles {
+		t.Run(profile.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			password := testPassword()
+			dbPath := filepath.Join(dir, "MSG0.db")
+			// 不是decryptChunkPages的整数倍, 最后一块不满
+			pages := decryptChunkPages*3 + 7
+			plains := writeTestDataBase(t, dbPath, pages, password, profile)
+
+			outputs := make([][]byte, 0)
+			for _, workers := range []int{1, 4, 0} {
+				opts := DecryptOptions{Profile: profile, BadPage: BadPageFail, Workers: workers}
+				expPath := filepath.Join(dir, fmt.Sprintf("MSG0.%d.db", workers))
+				report, err := DecryptDataBaseWithReport(dbPath, password, expPath, opts)
+				if err != nil {
+					t.Fatalf("workers %d: %v", workers, err)
+				}
+				if report.Pages != pages || report.OKPages != pages || report.HasError() {
+					t.Fatalf("workers %d: %s", workers, report)
+				}
+				data, err := os.ReadFile(expPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				outputs = append(outputs, data)
+			}
+
+			sequential := outputs[0]
+			for i, data := range outputs[1:] {
+				if !bytes.Equal(data, sequential) {
+					t.Fatalf("output %d differs from sequential decrypt", i+1)
+				}
+			}
+
+			if len(sequential) != pages*profile.PageSize {
+				t.Fatalf("decrypted size %d, want %d", len(sequential), pages*profile.PageSize)
+			}
+			if !bytes.HasPrefix(sequential, []byte("SQLite format 3\x00")) {
+				t.Fatalf("missing sqlite header")
+			}
+			for i, plain := range plains {
+				page := sequential[i*profile.PageSize : (i+1)*profile.PageSize]
+				if i == 0 {
+					page = page[saltSize:]
+				}
+				if !bytes.Equal(page[:len(page)-profile.Reserve], plain[:len(plain)-profile.Reserve]) {
+					t.Fatalf("page %d not match plain text", i+1)
+				}
+			}
+		})
+	}
+}
+
+// 期望值用Python的hashlib和hmac独立计算
+func TestPbkdf2HMAC(t *testing.T) {
+	cases := []struct {
+		name   string
+		iter   int
+		keyLen int
+		sha512 bool
+		want   string
+	}{
+		// RFC 6070
+		{"sha1-1", 1, 20, false, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{"sha1-4096", 4096, 20, false, "4b007901b765489abead49d926f721d065a429c1"},
+		{"sha512-1", 1, 64, true, "867f70cf1ade02cff3752599a3a53dc4af34c7a669815ae5d513554e1c8cf252c02d470a285a0501bad999bfe943c08f050235d7d68b1da55e63f73b60a57fce"},
+	}
+	for _, c := range cases {
+		h := sha1.New
+		if c.sha512 {
+			h = sha512.New
+		}
+		got := hex.EncodeToString(pbkdf2HMAC([]byte("password"), []byte("salt"), c.iter, c.keyLen, h))
+		if got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCipherProfileKnownAnswer(t *testing.T) {
+	cases := []struct {
+		profile *CipherProfile
+		key     string
+		macKey  string
+		pageMac string
+	}{
+		{&CipherProfileV3,
+			"948d2b65f23c8d96202d5792373edf09f2c1e0562a35dbc9578e7bcfd80aed3d",
+			"3355267ef3080c9aa00ff7507c1ea153c004cdd9ba427f29547d42844804898b",
+			"47a981d4f4ffe4f16f2a64dc226f3385e62d9439"},
+		{&CipherProfileV4,
+			"699f2ac9232d8ea2f443137cb626202ca98943df031715298614a5251ee7d973",
+			"729f34606388116b966ffd5af83bc4a95b0768d83b69b87e98a21c695e9c4880",
+			"c65001f6ffe3f58d13ab9ee7e14214a042b7fca428c6eb50c72ccdc01435dc2940fb9f0c54ec4164e2a6a08c12f29c87525c6cf28f83b8830b3323710ff364d2"},
+	}
+
+	password := make([]byte, keySize)
+	salt := make([]byte, saltSize)
+	for i := range password {
+		password[i] = byte(i)
+	}
+	for i := range salt {
+		salt[i] = byte(0x10 + i)
+	}
+	page := make([]byte, defaultPageSize)
+	for i := range page {
+		page[i] = byte(i)
+	}
+
+	for _, c := range cases {
+		key, macKey := c.profile.deriveKey(password, salt)
+		if hex.EncodeToString(key) != c.key || hex.EncodeToString(macKey) != c.macKey {
+			t.Errorf("%s: deriveKey got %x %x", c.profile, key, macKey)
+		}
+		if got := hex.EncodeToString(c.profile.pageMac(macKey, page, 7)); got != c.pageMac {
+			t.Errorf("%s: pageMac got %s", c.profile, got)
+		}
+	}
+}
+
+// createTestDataBase 建一个按profile预留了IV和HMAC空间的明文数据库, 返回一直打开的连接, 关闭前-wal不会被checkpoint
+func createTestDataBase(t *testing.T, path string, profile *CipherProfile) (*sql.DB, *sql.Conn) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		db.Close()
+	})
+
+	if err := setReserveBytes(conn, profile.Reserve); err != nil {
+		t.Fatal(err)
+	}
+	execTestSql(t, conn, "CREATE TABLE MSG (localId INTEGER PRIMARY KEY, StrContent TEXT);")
+	insertTestRows(t, conn, 0, 200)
+	execTestSql(t, conn, "VACUUM;")
+	return db, conn
+}
+
+func execTestSql(t *testing.T, conn *sql.Conn, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := conn.ExecContext(context.Background(), query, args...); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
+
+// insertTestRows 一个事务插入rows行, 内容足够长, 每个事务会写好几页
+func insertTestRows(t *testing.T, conn *sql.Conn, start int, rows int) {
+	t.Helper()
+	execTestSql(t, conn, "BEGIN;")
+	for i := start; i < start+rows; i++ {
+		execTestSql(t, conn, "INSERT INTO MSG (localId, StrContent) VALUES (?, ?);", i, fmt.Sprintf("%0200d", i))
+	}
+	execTestSql(t, conn, "COMMIT;")
+}
+
+func countTestRows(t *testing.T, data []byte) (int, string) {
+	t.Helper()
+	db, err := openMemDataBase("MSG0.db", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeDataBase(db)
+
+	count := 0
+	if err := db.QueryRow("SELECT count(*) FROM MSG;").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count, queryIntegrityCheck(db)
+}
+
+func TestEncryptDecryptDataBase(t *testing.T) {
+	for _, profile := range CipherProfiles {
+		t.Run(profile.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			plainPath := filepath.Join(dir, "plain.db")
+			createTestDataBase(t, plainPath, profile)
+
+			password := testPassword()
+			encPath := filepath.Join(dir, "MSG0.db")
+			if err := EncryptDataBase(plainPath, password, encPath, profile); err != nil {
+				t.Fatal(err)
+			}
+			if fileHasPrefix(encPath, "SQLite format 3\x00") {
+				t.Fatal("encrypted database has plain header")
+			}
+
+			detected, err := DetectCipherProfile(encPath, password)
+			if err != nil || detected != profile {
+				t.Fatalf("DetectCipherProfile got %v %v", detected, err)
+			}
+			if _, err := DetectCipherProfile(encPath, bytes.Repeat([]byte{1}, keySize)); !errors.Is(err, ErrIncorrectPassword) {
+				t.Fatalf("wrong password got %v", err)
+			}
+
+			decPath := filepath.Join(dir, "MSG0.dec.db")
+			opts := DecryptOptions{BadPage: BadPageFail, IntegrityCheck: true}
+			report, err := DecryptDataBaseWithReport(encPath, password, decPath, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.HasError() || report.Profile != profile.Name {
+				t.Fatalf("report %s profile %s", report, report.Profile)
+			}
+
+			plain, _ := os.ReadFile(plainPath)
+			decrypted, _ := os.ReadFile(decPath)
+			if len(plain) != len(decrypted) {
+				t.Fatalf("decrypted size %d, want %d", len(decrypted), len(plain))
+			}
+			// 解密后每页的Reserve区是原来的IV和HMAC, 其它内容和加密前一样
+			for offset := 0; offset < len(plain); offset += profile.PageSize {
+				end := offset + profile.PageSize - profile.Reserve
+				if !bytes.Equal(plain[offset:end], decrypted[offset:end]) {
+					t.Fatalf("page %d not match", offset/profile.PageSize+1)
+				}
+			}
+		})
+	}
+}
+
+// encryptTestWal 按SQLCipher的方式加密-wal: 帧头不变, 页和数据库里的页一样加密, 校验和按密文重新计算,
+// badFrame大于0时篡改这一帧的密文, 校验和照样重新计算, 只有HMAC能发现
+func encryptTestWal(t *testing.T, walPath string, dbPath string, outPath string, password []byte, profile *CipherProfile, badFrame int) {
+	t.Helper()
+	wal, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page1, err := readFirstPage(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := page1[:saltSize]
+	key, macKey := profile.deriveKey(password, salt)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := wal[:walHeaderSize]
+	bigEndian := binary.BigEndian.Uint32(header[0:4])&1 == 1
+	s1, s2 := walChecksum(bigEndian, header[:24], 0, 0)
+	out := append([]byte{}, header...)
+	frameSize := walFrameHeaderSize + profile.PageSize
+	for frame, offset := 1, walHeaderSize; offset+frameSize <= len(wal); frame, offset = frame+1, offset+frameSize {
+		frameHeader := append([]byte{}, wal[offset:offset+walFrameHeaderSize]...)
+		plain := wal[offset+walFrameHeaderSize : offset+frameSize]
+		pgno := binary.BigEndian.Uint32(frameHeader[0:4])
+
+		var page []byte
+		if pgno == 1 {
+			encrypted, err := profile.encryptPage(block, macKey, plain[saltSize:], 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			page = append(append([]byte{}, salt...), encrypted...)
+		} else if page, err = profile.encryptPage(block, macKey, plain, pgno); err != nil {
+			t.Fatal(err)
+		}
+		if frame == badFrame {
+			page[100] ^= 0xFF
+		}
+
+		s1, s2 = walChecksum(bigEndian, frameHeader[:8], s1, s2)
+		s1, s2 = walChecksum(bigEndian, page, s1, s2)
+		binary.BigEndian.PutUint32(frameHeader[16:20], s1)
+		binary.BigEndian.PutUint32(frameHeader[20:24], s2)
+		out = append(out, frameHeader...)
+		out = append(out, page...)
+	}
+
+	if err := os.WriteFile(outPath, out, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// walCommitFrames 返回-wal里每个提交帧的帧号, 从1开始
+func walCommitFrames(t *testing.T, walPath string, pageSize int) []int {
+	t.Helper()
+	wal, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits := make([]int, 0)
+	frameSize := walFrameHeaderSize + pageSize
+	for frame, offset := 1, walHeaderSize; offset+frameSize <= len(wal); frame, offset = frame+1, offset+frameSize {
+		if binary.BigEndian.Uint32(wal[offset+4:offset+8]) != 0 {
+			commits = append(commits, frame)
+		}
+	}
+	return commits
+}
+
+func TestMergeWal(t *testing.T) {
+	for _, profile := range CipherProfiles {
+		t.Run(profile.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			plainPath := filepath.Join(dir, "plain.db")
+			_, conn := createTestDataBase(t, plainPath, profile)
+			execTestSql(t, conn, "PRAGMA journal_mode=WAL;")
+			execTestSql(t, conn, "PRAGMA wal_autocheckpoint=0;")
+			// 三个事务都只在-wal里
+			insertTestRows(t, conn, 200, 100)
+			insertTestRows(t, conn, 300, 100)
+			insertTestRows(t, conn, 400, 100)
+
+			commits := walCommitFrames(t, plainPath+"-wal", profile.PageSize)
+			if len(commits) != 3 {
+				t.Fatalf("got %d commit frames", len(commits))
+			}
+
+			password := testPassword()
+			encPath := filepath.Join(dir, "MSG0.db")
+			if err := EncryptDataBase(plainPath, password, encPath, profile); err != nil {
+				t.Fatal(err)
+			}
+
+			cases := []struct {
+				name     string
+				badFrame int
+				rows     int
+				frames   int
+			}{
+				{"all committed", 0, 500, commits[2]},
+				// 第三个事务的第一帧HMAC不对, 这个事务整个丢弃, 后面的帧也不再读取
+				{"bad frame in last transaction", commits[1] + 1, 400, commits[1]},
+				// 第二个事务的提交帧坏了, 第二和第三个事务都丢弃
+				{"bad commit frame", commits[1], 300, commits[0]},
+			}
+			for _, c := range cases {
+				encryptTestWal(t, plainPath+"-wal", encPath, encPath+"-wal", password, profile, c.badFrame)
+				data, report, err := DecryptDataBaseToMemory(encPath, password, DecryptOptions{})
+				if err != nil {
+					t.Fatalf("%s: %v", c.name, err)
+				}
+				if report.WalFrames != c.frames {
+					t.Errorf("%s: merged %d frames, want %d", c.name, report.WalFrames, c.frames)
+				}
+				if c.badFrame > 0 && (len(report.BadPages) != 1 || report.BadPages[0].Reason != "wal frame hmac mismatch") {
+					t.Errorf("%s: bad pages %v", c.name, report.BadPages)
+				}
+				if c.badFrame == 0 && len(report.BadPages) > 0 {
+					t.Errorf("%s: bad pages %v", c.name, report.BadPages)
+				}
+				rows, integrity := countTestRows(t, data)
+				if rows != c.rows || integrity != "ok" {
+					t.Errorf("%s: got %d rows integrity %s, want %d rows", c.name, rows, integrity, c.rows)
+				}
+			}
+		})
+	}
+}
+
+// -wal解析失败时要记在报告里, 不能当作解密成功
+func TestMergeWalError(t *testing.T) {
+	profile := &CipherProfileV3
+	dir := t.TempDir()
+	plainPath := filepath.Join(dir, "plain.db")
+	createTestDataBase(t, plainPath, profile)
+
+	password := testPassword()
+	encPath := filepath.Join(dir, "MSG0.db")
+	if err := EncryptDataBase(plainPath, password, encPath, profile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(encPath+"-wal", bytes.Repeat([]byte{0xAB}, walHeaderSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, report, err := DecryptDataBaseToMemory(encPath, password, DecryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.WalError) == 0 || !report.HasError() {
+		t.Fatalf("wal error not reported: %s", report)
+	}
+}
+
+func benchmarkDecryptDataBase(b *testing.B, profile *CipherProfile) {
+	dir := b.TempDir()
+	password := testPassword()
+	dbPath := filepath.Join(dir, "MSG0.db")
+	expPath := filepath.Join(dir, "MSG0.dec.db")
+	pages := 64 * 1024 * 1024 / profile.PageSize
+	writeTestDataBase(b, dbPath, pages, password, profile)
+
+	// 0表示CPU核数
+	for _, workers := range []int{1, 2, 4, 0} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			opts := DecryptOptions{Profile: profile, BadPage: BadPageFail, Workers: workers}
+			b.SetBytes(int64(pages * profile.PageSize))
+			for i := 0; i < b.N; i++ {
+				if _, err := DecryptDataBaseWithReport(dbPath, password, expPath, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecryptDataBaseV3(b *testing.B) {
+	benchmarkDecryptDataBase(b, &CipherProfileV3)
+}
+
+func BenchmarkDecryptDataBaseV4(b *testing.B) {
+	benchmarkDecryptDataBase(b, &CipherProfileV4)
+}
@@ -17,7 +17,6 @@ import (
 
 	"github.com/beevik/etree"
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/pierrec/lz4"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -25,6 +24,7 @@ const (
 	Wechat_Message_Type_Text       = 1
 	Wechat_Message_Type_Picture    = 3
 	Wechat_Message_Type_Voice      = 34
+	Wechat_Message_Type_Verify     = 37
 	Wechat_Message_Type_Visit_Card = 42
 	Wechat_Message_Type_Video      = 43
 	Wechat_Message_Type_Emoji      = 47
@@ -32,6 +32,7 @@ const (
 	Wechat_Message_Type_Misc       = 49
 	Wechat_Message_Type_Voip       = 50
 	Wechat_Message_Type_System     = 10000
+	Wechat_Message_Type_SysNotice  = 10002
 )
 
 const (
@@ -56,6 +57,13 @@ const (
 	Wechat_Misc_Message_RedPacket      = 2003
 )
 
+const (
+	Wechat_Contact_Category_Friend   = "friend"
+	Wechat_Contact_Category_Group    = "group"
+	Wechat_Contact_Category_Stranger = "stranger"
+	Wechat_Contact_Category_OpenIM   = "openim"
+)
+
 const (
 	Wechat_System_Message_Notice  = 1
 	Wechat_System_Message_Tickle  = 4
@@ -82,12 +90,14 @@ type WeChatUserInfo struct {
 }
 
 type WeChatSession struct {
-	UserName string         `json:"UserName"`
-	NickName string         `json:"NickName"`
-	Content  string         `json:"Content"`
-	UserInfo WeChatUserInfo `json:"UserInfo"`
-	Time     uint64         `json:"Time"`
-	IsGroup  bool           `json:"IsGroup"`
+	UserName     string         `json:"UserName"`
+	NickName     string         `json:"NickName"`
+	Content      string         `json:"Content"`
+	UserInfo     WeChatUserInfo `json:"UserInfo"`
+	Time         uint64         `json:"Time"`
+	IsGroup      bool           `json:"IsGroup"`
+	MessageCount int            `json:"MessageCount"`
+	IsOrphan     bool           `json:"IsOrphan"`
 }
 
 type WeChatSessionList struct {
@@ -118,15 +128,27 @@ type ReferInfo struct {
 }
 
 type PayInfo struct {
-	Type      int
-	Memo      string
-	BeginTime string
-	Feedesc   string
+	Type          int
+	Memo          string
+	BeginTime     string
+	Feedesc       string
+	Amount        int64
+	Direction     string
+	Status        string
+	TransferId    string
+	TransactionId string
+	Payer         string
+	Receiver      string
+	InvalidTime   int64
 }
 
 type VoipInfo struct {
-	Type int
-	Msg  string
+	Type      int
+	Msg       string
+	Media     string
+	Direction string
+	Status    string
+	Duration  int
 }
 
 type ChannelsInfo struct {
@@ -153,30 +175,33 @@ type LocationInfo struct {
 }
 
 type WeChatMessage struct {
-	LocalId         int            `json:"LocalId"`
-	MsgSvrId        string         `json:"MsgSvrId"`
-	Type            int            `json:"type"`
-	SubType         int            `json:"SubType"`
-	IsSender        int            `json:"IsSender"`
-	CreateTime      int64          `json:"createTime"`
-	Talker          string         `json:"talker"`
-	Content         string         `json:"content"`
-	ThumbPath       string         `json:"ThumbPath"`
-	ImagePath       string         `json:"ImagePath"`
-	VideoPath       string         `json:"VideoPath"`
-	FileInfo        FileInfo       `json:"fileInfo"`
-	EmojiPath       string         `json:"EmojiPath"`
-	VoicePath       string         `json:"VoicePath"`
-	IsChatRoom      bool           `json:"isChatRoom"`
-	UserInfo        WeChatUserInfo `json:"userInfo"`
-	LinkInfo        LinkInfo       `json:"LinkInfo"`
-	ReferInfo       ReferInfo      `json:"ReferInfo"`
-	PayInfo         PayInfo        `json:"PayInfo"`
-	VoipInfo        VoipInfo       `json:"VoipInfo"`
-	VisitInfo       WeChatUserInfo `json:"VisitInfo"`
-	ChannelsInfo    ChannelsInfo   `json:"ChannelsInfo"`
-	MusicInfo       MusicInfo      `json:"MusicInfo"`
-	LocationInfo    LocationInfo   `json:"LocationInfo"`
+	LocalId         int             `json:"LocalId"`
+	MsgSvrId        string          `json:"MsgSvrId"`
+	Type            int             `json:"type"`
+	SubType         int             `json:"SubType"`
+	IsSender        int             `json:"IsSender"`
+	CreateTime      int64           `json:"createTime"`
+	Talker          string          `json:"talker"`
+	Content         string          `json:"content"`
+	ThumbPath       string          `json:"ThumbPath"`
+	ImagePath       string          `json:"ImagePath"`
+	VideoPath       string          `json:"VideoPath"`
+	FileInfo        FileInfo        `json:"fileInfo"`
+	EmojiPath       string          `json:"EmojiPath"`
+	VoicePath       string          `json:"VoicePath"`
+	IsChatRoom      bool            `json:"isChatRoom"`
+	UserInfo        WeChatUserInfo  `json:"userInfo"`
+	LinkInfo        LinkInfo        `json:"LinkInfo"`
+	ReferInfo       ReferInfo       `json:"ReferInfo"`
+	PayInfo         PayInfo         `json:"PayInfo"`
+	VoipInfo        VoipInfo        `json:"VoipInfo"`
+	VisitInfo       WeChatUserInfo  `json:"VisitInfo"`
+	ChannelsInfo    ChannelsInfo    `json:"ChannelsInfo"`
+	MusicInfo       MusicInfo       `json:"MusicInfo"`
+	LocationInfo    LocationInfo    `json:"LocationInfo"`
+	SystemInfo      SystemInfo      `json:"SystemInfo"`
+	ForwardInfo     ForwardInfo     `json:"ForwardInfo"`
+	Articles        []WeChatArticle `json:"Articles"`
 	compressContent []byte
 	bytesExtra      []byte
 }
@@ -188,6 +213,12 @@ type WeChatMessageList struct {
 	Rows    []WeChatMessage `json:"Rows"`
 }
 
+type WeChatMessageContext struct {
+	Index int             `json:"Index"`
+	Total int             `json:"Total"`
+	Rows  []WeChatMessage `json:"Rows"`
+}
+
 type WeChatMessageDate struct {
 	Date  []string `json:"Date"`
 	Total int      `json:"Total"`
@@ -198,12 +229,25 @@ type WeChatUserList struct {
 	Total int              `json:"Total"`
 }
 
+type WeChatContactLabel struct {
+	LabelId   int    `json:"LabelId"`
+	LabelName string `json:"LabelName"`
+	Count     int    `json:"Count"`
+}
+
+type WeChatContactLabelList struct {
+	Labels []WeChatContactLabel `json:"Labels"`
+	Total  int                  `json:"Total"`
+}
+
 type WeChatContact struct {
 	WeChatUserInfo
 	PYInitial       string
 	QuanPin         string
 	RemarkPYInitial string
 	RemarkQuanPin   string
+	Category        string               `json:"Category"`
+	Labels          []WeChatContactLabel `json:"Labels"`
 }
 
 type WeChatContactList struct {
@@ -211,6 +255,28 @@ type WeChatContactList struct {
 	Total int             `json:"Total"`
 }
 
+// WeChatContactProfile 的Source是加好友的来源: 企业微信联系人取OpenIMContact.Source,
+// 普通联系人的ExtraBuf和Contact表里都没有来源, 从本地保存的好友验证消息里的scene取, 验证消息不在本机时为空
+type WeChatContactProfile struct {
+	WeChatUserInfo
+	WeChatContactExtra
+	Source   string               `json:"Source"`
+	Category string               `json:"Category"`
+	Labels   []WeChatContactLabel `json:"Labels"`
+}
+
+type WeChatContactSearchItem struct {
+	WeChatContact
+	Score      int    `json:"Score"`
+	MatchField string `json:"MatchField"`
+}
+
+type WeChatContactSearchList struct {
+	Query string                    `json:"Query"`
+	Users []WeChatContactSearchItem `json:"Users"`
+	Total int                       `json:"Total"`
+}
+
 type WeChatAccountInfo struct {
 	AccountName     string `json:"AccountName"`
 	AliasName       string `json:"AliasName"`
@@ -219,6 +285,8 @@ type WeChatAccountInfo struct {
 	SmallHeadImgUrl string `json:"SmallHeadImgUrl"`
 	BigHeadImgUrl   string `json:"BigHeadImgUrl"`
 	LocalHeadImgUrl string `json:"LocalHeadImgUrl"`
+	Encrypted       bool   `json:"Encrypted"`
+	Locked          bool   `json:"Locked"`
 }
 
 type WeChatLastTime struct {
@@ -247,23 +315,43 @@ type wechatMsgDB struct {
 
 type WechatDataProvider struct {
 	resPath       string
+	dbPath        string
 	prefixResPath string
 	microMsg      *sql.DB
 	openIMContact *sql.DB
+	emotion       *sql.DB
 	userData      *sql.DB
 	msgDBs        []*wechatMsgDB
 	userInfoMap   map[string]WeChatUserInfo
 	userInfoMtx   sync.Mutex
+	allSessions   *WeChatSessionList
+	allSessionMtx sync.Mutex
+	allContacts   []WeChatContact
+	allContactMtx sync.Mutex
+	labelList     []WeChatContactLabel
+	sns           *SnsProvider
+	snsMtx        sync.Mutex
+	fav           *FavoriteProvider
+	favMtx        sync.Mutex
+	publicMsgDB   *wechatMsgDB
+	publicTalkers map[string]bool
+	emojiPaths    map[string]string
+	emojiMtx      sync.Mutex
+	forwardSrcMap map[string]*WeChatMessage
+	forwardSrcMtx sync.Mutex
 
 	SelfInfo    *WeChatUserInfo
 	ContactList *WeChatContactList
 	IsShareData bool
+	IsInPlace   bool
 }
 
 const (
 	MicroMsgDB      = "MicroMsg.db"
 	OpenIMContactDB = "OpenIMContact.db"
 	UserDataDB      = "UserData.db"
+	PublicMsgDB     = "PublicMsg.db"
+	EmotionDB       = "Emotion.db"
 )
 
 type byTime []*wechatMsgDB
@@ -301,34 +389,49 @@ func CreateWechatDataProvider(resPath string, prefixRes string) (*WechatDataProv
 	log.Println(resPath)
 
 	userName := filepath.Base(resPath)
-	MicroMsgDBPath := resPath + "\\Msg\\" + MicroMsgDB
+	dbPath, err := BackupDataBasePath(resPath)
+	if err != nil {
+		log.Println("CreateWechatDataProvider failed", resPath, err)
+		return provider, err
+	}
+	provider.dbPath = dbPath
+	MicroMsgDBPath := dbPath + "\\Msg\\" + MicroMsgDB
 	if _, err := os.Stat(MicroMsgDBPath); err != nil {
 		log.Println("CreateWechatDataProvider failed", MicroMsgDBPath, err)
 		return provider, err
 	}
-	microMsg, err := sql.Open("sqlite3", MicroMsgDBPath)
+	microMsg, err := openBackupDataBase(MicroMsgDBPath)
 	if err != nil {
 		log.Printf("open db %s error: %v", MicroMsgDBPath, err)
 		return provider, err
 	}
 
 	var openIMContact *sql.DB
-	OpenIMContactDBPath := resPath + "\\Msg\\" + OpenIMContactDB
+	OpenIMContactDBPath := dbPath + "\\Msg\\" + OpenIMContactDB
 	if _, err := os.Stat(OpenIMContactDBPath); err == nil {
-		openIMContact, err = sql.Open("sqlite3", OpenIMContactDBPath)
+		openIMContact, err = openBackupDataBase(OpenIMContactDBPath)
 		if err != nil {
 			log.Printf("open db %s error: %v", OpenIMContactDBPath, err)
 		}
 	}
 
-	UserDataDBPath := resPath + "\\Msg\\" + UserDataDB
+	var emotion *sql.DB
+	EmotionDBPath := dbPath + "\\Msg\\" + EmotionDB
+	if _, err := os.Stat(EmotionDBPath); err == nil {
+		emotion, err = openBackupDataBase(EmotionDBPath)
+		if err != nil {
+			log.Printf("open db %s error: %v", EmotionDBPath, err)
+		}
+	}
+
+	UserDataDBPath := dbPath + "\\Msg\\" + UserDataDB
 	userData := openUserDataDB(UserDataDBPath)
 	if userData == nil {
 		log.Printf("open db %s error: %v", UserDataDBPath, err)
 		return provider, err
 	}
 
-	msgDBPath := fmt.Sprintf("%s\\Msg\\Multi\\MSG.db", provider.resPath)
+	msgDBPath := fmt.Sprintf("%s\\Msg\\Multi\\MSG.db", provider.dbPath)
 	if _, err := os.Stat(msgDBPath); err == nil {
 		log.Println("msgDBPath", msgDBPath)
 		msgDB, err := wechatOpenMsgDB(msgDBPath)
@@ -343,7 +446,7 @@ func CreateWechatDataProvider(resPath string, prefixRes string) (*WechatDataProv
 
 	index := 0
 	for {
-		msgDBPath := fmt.Sprintf("%s\\Msg\\Multi\\MSG%d.db", provider.resPath, index)
+		msgDBPath := fmt.Sprintf("%s\\Msg\\Multi\\MSG%d.db", provider.dbPath, index)
 		if _, err := os.Stat(msgDBPath); err != nil {
 			log.Println("msgDBPath end", msgDBPath)
 			break
@@ -359,6 +462,18 @@ func CreateWechatDataProvider(resPath string, prefixRes string) (*WechatDataProv
 		log.Printf("MSG%d.db start %d - %d end\n", index, msgDB.startTime, msgDB.endTime)
 		index += 1
 	}
+	// 公众号的消息在PublicMsg.db里, 表结构和MSG分库一样
+	publicMsgDBPath := provider.dbPath + "\\Msg\\" + PublicMsgDB
+	if _, err := os.Stat(publicMsgDBPath); err == nil {
+		msgDB, err := wechatOpenMsgDB(publicMsgDBPath)
+		if err != nil {
+			log.Printf("open db %s error: %v", publicMsgDBPath, err)
+		} else {
+			provider.publicMsgDB = msgDB
+			provider.publicTalkers = wechatMsgDBTalkers(msgDB)
+			log.Printf("PublicMsg.db start %d - %d end, %d talkers\n", msgDB.startTime, msgDB.endTime, len(provider.publicTalkers))
+		}
+	}
 	sort.Sort(byTime(provider.msgDBs))
 	for _, db := range provider.msgDBs {
 		log.Printf("%s start %d - %d end\n", db.path, db.startTime, db.endTime)
@@ -366,6 +481,9 @@ func CreateWechatDataProvider(resPath string, prefixRes string) (*WechatDataProv
 	provider.userInfoMap = make(map[string]WeChatUserInfo)
 	provider.microMsg = microMsg
 	provider.openIMContact = openIMContact
+	provider.emotion = emotion
+	provider.emojiPaths = make(map[string]string)
+	provider.forwardSrcMap = make(map[string]*WeChatMessage)
 	provider.userData = userData
 	provider.SelfInfo, err = provider.WechatGetUserInfoByNameOnCache(userName)
 	if err != nil {
@@ -373,6 +491,7 @@ func CreateWechatDataProvider(resPath string, prefixRes string) (*WechatDataProv
 		return provider, err
 	}
 
+	provider.labelList = provider.wechatGetContactLabel()
 	provider.ContactList, err = provider.wechatGetAllContact()
 	if err != nil {
 		log.Println("wechatGetAllContact failed", err)
@@ -385,34 +504,75 @@ func CreateWechatDataProvider(resPath string, prefixRes string) (*WechatDataProv
 	return provider, nil
 }
 
+// CreateWechatDataProviderInPlace 不导出, 用数据库key直接打开微信的账号目录, 数据库读取时才解密, 不会写入账号目录
+// 图片视频还是微信原来的.dat格式, 书签之类的数据只保存在内存里
+func CreateWechatDataProviderInPlace(accountPath string, dbKey string, prefixRes string) (*WechatDataProvider, error) {
+	if err := SetDataBaseKey(accountPath, dbKey); err != nil {
+		return nil, err
+	}
+
+	provider, err := CreateWechatDataProvider(accountPath, prefixRes)
+	provider.IsInPlace = true
+	if err != nil {
+		provider.WechatWechatDataProviderClose()
+		return nil, err
+	}
+	return provider, nil
+}
+
 func (P *WechatDataProvider) WechatWechatDataProviderClose() {
 	if P.microMsg != nil {
-		err := P.microMsg.Close()
+		err := closeDataBase(P.microMsg)
 		if err != nil {
 			log.Println("db close:", err)
 		}
 	}
 
 	if P.openIMContact != nil {
-		err := P.openIMContact.Close()
+		err := closeDataBase(P.openIMContact)
+		if err != nil {
+			log.Println("db close:", err)
+		}
+	}
+
+	if P.emotion != nil {
+		err := closeDataBase(P.emotion)
 		if err != nil {
 			log.Println("db close:", err)
 		}
 	}
 
 	if P.userData != nil {
-		err := P.userData.Close()
+		syncBackupDataBase(P.resPath, UserDataDB, P.userData)
+		err := closeDataBase(P.userData)
 		if err != nil {
 			log.Println("db close:", err)
 		}
 	}
 
 	for _, db := range P.msgDBs {
-		err := db.db.Close()
+		err := closeDataBase(db.db)
 		if err != nil {
 			log.Println("db close:", err)
 		}
 	}
+	if P.publicMsgDB != nil {
+		if err := closeDataBase(P.publicMsgDB.db); err != nil {
+			log.Println("db close:", err)
+		}
+	}
+
+	if P.sns != nil {
+		P.sns.Close()
+	}
+
+	if P.fav != nil {
+		P.fav.Close()
+	}
+
+	if P.IsInPlace {
+		LockBackup(P.resPath)
+	}
 	log.Println("WechatWechatDataProviderClose:", P.resPath)
 }
 
@@ -541,6 +701,207 @@ func (P *WechatDataProvider) WeChatGetSessionList(pageIndex int, pageSize int) (
 	return List, nil
 }
 
+func (P *WechatDataProvider) WeChatGetAllSessionList(pageIndex int, pageSize int) (*WeChatSessionList, error) {
+	List := &WeChatSessionList{}
+	List.Rows = make([]WeChatSession, 0)
+
+	allSessions, err := P.wechatGetAllSession()
+	if err != nil {
+		return List, err
+	}
+
+	if allSessions.Total <= pageIndex*pageSize {
+		return List, nil
+	}
+	end := (pageIndex * pageSize) + pageSize
+	if end > allSessions.Total {
+		end = allSessions.Total
+	}
+
+	List.Rows = append(List.Rows, allSessions.Rows[pageIndex*pageSize:end]...)
+	List.Total = len(List.Rows)
+	return List, nil
+}
+
+type wechatTalkerStat struct {
+	count    int
+	lastTime int64
+}
+
+func (P *WechatDataProvider) wechatGetAllSession() (*WeChatSessionList, error) {
+	P.allSessionMtx.Lock()
+	defer P.allSessionMtx.Unlock()
+	if P.allSessions != nil {
+		return P.allSessions, nil
+	}
+
+	talkerStats := make(map[string]*wechatTalkerStat)
+	msgDBs := P.msgDBs
+	if P.publicMsgDB != nil {
+		msgDBs = append(append([]*wechatMsgDB{}, P.msgDBs...), P.publicMsgDB)
+	}
+	for _, msgDB := range msgDBs {
+		querySql := "select ifnull(StrTalker,'') as StrTalker, count(*), max(CreateTime) from MSG group by StrTalker;"
+		rows, err := msgDB.db.Query(querySql)
+		if err != nil {
+			log.Printf("%s in %s failed %v\n", querySql, msgDB.path, err)
+			continue
+		}
+
+		var talker string
+		var count int
+		var lastTime int64
+		for rows.Next() {
+			if err := rows.Scan(&talker, &count, &lastTime); err != nil {
+				log.Println("rows.Scan failed", err)
+				continue
+			}
+			if talker == "" {
+				continue
+			}
+
+			stat, ok := talkerStats[talker]
+			if !ok {
+				stat = &wechatTalkerStat{}
+				talkerStats[talker] = stat
+			}
+			stat.count += count
+			if lastTime > stat.lastTime {
+				stat.lastTime = lastTime
+			}
+		}
+		rows.Close()
+	}
+
+	List := &WeChatSessionList{}
+	List.Rows = make([]WeChatSession, 0)
+
+	querySql := "select ifnull(strUsrName,'') as strUsrName,ifnull(strNickName,'') as strNickName,ifnull(strContent,'') as strContent, nMsgType, nTime from Session order by nOrder desc;"
+	dbRows, err := P.microMsg.Query(querySql)
+	if err != nil {
+		log.Println(err)
+		return List, err
+	}
+
+	inSession := make(map[string]bool)
+	var strUsrName, strNickName, strContent string
+	var nTime uint64
+	var nMsgType int
+	for dbRows.Next() {
+		err = dbRows.Scan(&strUsrName, &strNickName, &strContent, &nMsgType, &nTime)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		stat, hasMsg := talkerStats[strUsrName]
+		if len(strContent) == 0 && !hasMsg {
+			continue
+		}
+
+		var session WeChatSession
+		session.UserName = strUsrName
+		session.NickName = strNickName
+		session.Content = systemMsgParse(nMsgType, strContent)
+		session.Time = nTime
+		session.IsGroup = strings.HasSuffix(strUsrName, "@chatroom")
+		if hasMsg {
+			session.MessageCount = stat.count
+			if uint64(stat.lastTime) > session.Time {
+				session.Time = uint64(stat.lastTime)
+			}
+		}
+		info, err := P.WechatGetUserInfoByNameOnCache(strUsrName)
+		if err == nil {
+			session.UserInfo = *info
+		} else {
+			session.UserInfo.UserName = strUsrName
+			session.UserInfo.NickName = strNickName
+			session.UserInfo.IsGroup = session.IsGroup
+		}
+		inSession[strUsrName] = true
+		List.Rows = append(List.Rows, session)
+	}
+	dbRows.Close()
+
+	for talker, stat := range talkerStats {
+		if inSession[talker] {
+			continue
+		}
+
+		var session WeChatSession
+		session.UserName = talker
+		session.Time = uint64(stat.lastTime)
+		session.IsGroup = strings.HasSuffix(talker, "@chatroom")
+		session.MessageCount = stat.count
+		session.IsOrphan = true
+		info, err := P.WechatGetUserInfoByNameOnCache(talker)
+		if err == nil {
+			session.UserInfo = *info
+			session.NickName = info.NickName
+		} else {
+			session.UserInfo.UserName = talker
+			session.UserInfo.IsGroup = session.IsGroup
+		}
+
+		lastList, err := P.weChatGetMessageListByTime(talker, stat.lastTime, 1, Message_Search_Forward)
+		if err == nil && lastList.Total > 0 {
+			session.Content = wechatSessionContent(&lastList.Rows[0])
+		}
+		List.Rows = append(List.Rows, session)
+	}
+
+	sort.SliceStable(List.Rows, func(i, j int) bool {
+		return List.Rows[i].Time > List.Rows[j].Time
+	})
+	List.Total = len(List.Rows)
+	log.Printf("wechatGetAllSession %d sessions, %d talkers\n", List.Total, len(talkerStats))
+
+	P.allSessions = List
+	return List, nil
+}
+
+func wechatSessionContent(msg *WeChatMessage) string {
+	switch msg.Type {
+	case Wechat_Message_Type_Text, Wechat_Message_Type_System:
+		return msg.Content
+	case Wechat_Message_Type_Picture:
+		return "[图片]"
+	case Wechat_Message_Type_Voice:
+		return "[语音]"
+	case Wechat_Message_Type_Visit_Card:
+		return "[名片]"
+	case Wechat_Message_Type_Video:
+		return "[视频]"
+	case Wechat_Message_Type_Emoji:
+		return "[动画表情]"
+	case Wechat_Message_Type_Location:
+		return "[位置]"
+	case Wechat_Message_Type_Voip:
+		return "[通话]"
+	case Wechat_Message_Type_Misc:
+		switch msg.SubType {
+		case Wechat_Misc_Message_File:
+			return "[文件]" + msg.FileInfo.FileName
+		case Wechat_Misc_Message_Transfer:
+			return "[转账]"
+		case Wechat_Misc_Message_RedPacket:
+			return "[红包]"
+		case Wechat_Misc_Message_ForwardMessage:
+			return "[聊天记录]" + msg.ForwardInfo.Title
+		case Wechat_Misc_Message_TEXT, Wechat_Misc_Message_Refer:
+			return msg.Content
+		default:
+			if len(msg.LinkInfo.Title) > 0 {
+				return "[链接]" + msg.LinkInfo.Title
+			}
+			return "[消息]"
+		}
+	default:
+		return ""
+	}
+}
+
 func (P *WechatDataProvider) WeChatGetContactList(pageIndex int, pageSize int) (*WeChatUserList, error) {
 	List := &WeChatUserList{}
 	List.Users = make([]WeChatUserInfo, 0)
@@ -637,46 +998,20 @@ func (P *WechatDataProvider) weChatGetMessageListByTime(userName string, time in
 	querySql := fmt.Sprintf(sqlFormat, userName, time, pageSize)
 	log.Println(querySql)
 
-	rows, err := P.msgDBs[index].db.Query(querySql)
+	rows, err := P.wechatUserMsgDBs(userName)[index].db.Query(querySql)
 	if err != nil {
 		log.Printf("%s failed %v\n", querySql, err)
 		return List, nil
 	}
 	defer rows.Close()
-	var localId, Type, SubType, IsSender int
-	var MsgSvrID, CreateTime int64
-	var StrTalker, StrContent string
-	var CompressContent, BytesExtra []byte
 
 	for rows.Next() {
-		message := WeChatMessage{}
-		err = rows.Scan(&localId, &MsgSvrID, &Type, &SubType, &IsSender, &CreateTime,
-			&StrTalker, &StrContent, &CompressContent, &BytesExtra)
+		message, err := P.wechatScanMessage(rows)
 		if err != nil {
 			log.Println("rows.Scan failed", err)
 			return List, err
 		}
 
-		message.LocalId = localId
-		message.MsgSvrId = fmt.Sprintf("%d", MsgSvrID)
-		message.Type = Type
-		message.SubType = SubType
-		message.IsSender = IsSender
-		message.CreateTime = CreateTime
-		message.Talker = StrTalker
-		message.Content = systemMsgParse(Type, StrContent)
-		message.IsChatRoom = strings.HasSuffix(StrTalker, "@chatroom")
-		message.compressContent = make([]byte, len(CompressContent))
-		message.bytesExtra = make([]byte, len(BytesExtra))
-		copy(message.compressContent, CompressContent)
-		copy(message.bytesExtra, BytesExtra)
-		P.wechatMessageExtraHandle(&message)
-		P.wechatMessageGetUserInfo(&message)
-		P.wechatMessageEmojiHandle(&message)
-		P.wechatMessageCompressContentHandle(&message)
-		P.wechatMessageVoipHandle(&message)
-		P.wechatMessageVisitHandke(&message)
-		P.wechatMessageLocationHandke(&message)
 		List.Rows = append(List.Rows, message)
 		List.Total += 1
 	}
@@ -689,6 +1024,155 @@ func (P *WechatDataProvider) weChatGetMessageListByTime(userName string, time in
 	return List, nil
 }
 
+func (P *WechatDataProvider) wechatScanMessage(rows *sql.Rows) (WeChatMessage, error) {
+	message := WeChatMessage{}
+	var localId, Type, SubType, IsSender int
+	var MsgSvrID, CreateTime int64
+	var StrTalker, StrContent string
+	var CompressContent, BytesExtra []byte
+
+	err := rows.Scan(&localId, &MsgSvrID, &Type, &SubType, &IsSender, &CreateTime,
+		&StrTalker, &StrContent, &CompressContent, &BytesExtra)
+	if err != nil {
+		return message, err
+	}
+
+	message.LocalId = localId
+	message.MsgSvrId = fmt.Sprintf("%d", MsgSvrID)
+	message.Type = Type
+	message.SubType = SubType
+	message.IsSender = IsSender
+	message.CreateTime = CreateTime
+	message.Talker = StrTalker
+	message.Content = StrContent
+	message.IsChatRoom = strings.HasSuffix(StrTalker, "@chatroom")
+	message.compressContent = make([]byte, len(CompressContent))
+	message.bytesExtra = make([]byte, len(BytesExtra))
+	copy(message.compressContent, CompressContent)
+	copy(message.bytesExtra, BytesExtra)
+	P.wechatMessageExtraHandle(&message)
+	P.wechatMessageGetUserInfo(&message)
+	P.wechatMessageEmojiHandle(&message)
+	P.wechatMessageCompressContentHandle(&message)
+	P.wechatMessageVoipHandle(&message)
+	P.wechatMessageVisitHandke(&message)
+	P.wechatMessageLocationHandke(&message)
+	P.wechatMessageSystemHandle(&message)
+
+	return message, nil
+}
+
+func (P *WechatDataProvider) WeChatGetMessageBySvrId(userName string, msgSvrId string) (*WeChatMessage, error) {
+	svrId, err := strconv.ParseInt(msgSvrId, 10, 64)
+	if err != nil {
+		log.Println("ParseInt failed:", msgSvrId, err)
+		return nil, err
+	}
+
+	sqlFormat := "select localId,MsgSvrID,Type,SubType,IsSender,CreateTime,ifnull(StrTalker,'') as StrTalker, ifnull(StrContent,'') as StrContent,ifnull(CompressContent,'') as CompressContent,ifnull(BytesExtra,'') as BytesExtra from MSG Where MsgSvrID=%d limit 1;"
+	querySql := fmt.Sprintf(sqlFormat, svrId)
+	if userName != "" {
+		sqlFormat = "select localId,MsgSvrID,Type,SubType,IsSender,CreateTime,ifnull(StrTalker,'') as StrTalker, ifnull(StrContent,'') as StrContent,ifnull(CompressContent,'') as CompressContent,ifnull(BytesExtra,'') as BytesExtra from MSG Where StrTalker='%s' And MsgSvrID=%d limit 1;"
+		querySql = fmt.Sprintf(sqlFormat, userName, svrId)
+	}
+
+	for _, msgDB := range P.wechatUserMsgDBs(userName) {
+		rows, err := msgDB.db.Query(querySql)
+		if err != nil {
+			log.Printf("%s failed %v\n", querySql, err)
+			continue
+		}
+
+		if !rows.Next() {
+			rows.Close()
+			continue
+		}
+
+		message, err := P.wechatScanMessage(rows)
+		rows.Close()
+		if err != nil {
+			log.Println("rows.Scan failed", err)
+			return nil, err
+		}
+
+		log.Printf("found %s in %s\n", msgSvrId, msgDB.path)
+		return &message, nil
+	}
+
+	return nil, fmt.Errorf("message %s not found", msgSvrId)
+}
+
+func (P *WechatDataProvider) WeChatGetMessageContext(userName string, msgSvrId string, before int, after int) (*WeChatMessageContext, error) {
+	msgContext := &WeChatMessageContext{}
+	msgContext.Rows = make([]WeChatMessage, 0)
+	msgContext.Index = -1
+
+	target, err := P.WeChatGetMessageBySvrId(userName, msgSvrId)
+	if err != nil {
+		return msgContext, err
+	}
+	if before < 0 {
+		before = 0
+	}
+	if after < 0 {
+		after = 0
+	}
+
+	// 同一秒内可能有多条消息, Forward 的结果里目标消息前面的是同一秒但更晚的消息
+	var olderList *WeChatMessageList
+	targetIndex := -1
+	pageSize := before + 1
+	for {
+		olderList, err = P.WeChatGetMessageListByTime(userName, target.CreateTime, pageSize, Message_Search_Forward)
+		if err != nil {
+			return msgContext, err
+		}
+
+		targetIndex = -1
+		for i := range olderList.Rows {
+			if olderList.Rows[i].MsgSvrId == target.MsgSvrId {
+				targetIndex = i
+				break
+			}
+		}
+
+		if olderList.Total < pageSize {
+			break
+		}
+		if targetIndex != -1 && olderList.Total-targetIndex-1 >= before {
+			break
+		}
+		pageSize += before + 1
+	}
+
+	if targetIndex == -1 {
+		return msgContext, fmt.Errorf("message %s not found in %s", msgSvrId, userName)
+	}
+
+	newerList, err := P.WeChatGetMessageListByTime(userName, target.CreateTime, after, Message_Search_Backward)
+	if err != nil {
+		return msgContext, err
+	}
+
+	newerRows := append(newerList.Rows, olderList.Rows[:targetIndex]...)
+	if len(newerRows) > after {
+		newerRows = newerRows[len(newerRows)-after:]
+	}
+
+	olderRows := olderList.Rows[targetIndex+1:]
+	if len(olderRows) > before {
+		olderRows = olderRows[:before]
+	}
+
+	msgContext.Rows = append(msgContext.Rows, newerRows...)
+	msgContext.Index = len(msgContext.Rows)
+	msgContext.Rows = append(msgContext.Rows, olderList.Rows[targetIndex])
+	msgContext.Rows = append(msgContext.Rows, olderRows...)
+	msgContext.Total = len(msgContext.Rows)
+
+	return msgContext, nil
+}
+
 func (P *WechatDataProvider) WeChatGetMessageListByKeyWord(userName string, time int64, keyWord string, msgType string, pageSize int) (*WeChatMessageList, error) {
 	List := &WeChatMessageList{}
 	List.Rows = make([]WeChatMessage, 0)
@@ -829,7 +1313,7 @@ func (P *WechatDataProvider) WeChatGetMessageDate(userName string) (*WeChatMessa
 		sqlFormat := " SELECT DISTINCT strftime('%%Y-%%m-%%d', datetime(CreateTime+28800, 'unixepoch')) FROM MSG WHERE StrTalker='%s' order by CreateTime desc;"
 		querySql := fmt.Sprintf(sqlFormat, userName)
 
-		rows, err := P.msgDBs[index].db.Query(querySql)
+		rows, err := P.wechatUserMsgDBs(userName)[index].db.Query(querySql)
 		if err != nil {
 			log.Printf("%s failed %v\n", querySql, err)
 			return messageData, nil
@@ -947,11 +1431,15 @@ type EmojiMsg struct {
 }
 
 type Emoji struct {
-	XMLName  xml.Name `xml:"emoji"`
-	CdnURL   string   `xml:"cdnurl,attr"`
-	Thumburl string   `xml:"thumburl,attr"`
-	Width    string   `xml:"width,attr"`
-	Height   string   `xml:"height,attr"`
+	XMLName    xml.Name `xml:"emoji"`
+	CdnURL     string   `xml:"cdnurl,attr"`
+	Thumburl   string   `xml:"thumburl,attr"`
+	Width      string   `xml:"width,attr"`
+	Height     string   `xml:"height,attr"`
+	Md5        string   `xml:"md5,attr"`
+	AesKey     string   `xml:"aeskey,attr"`
+	EncryptURL string   `xml:"encrypturl,attr"`
+	ExternURL  string   `xml:"externurl,attr"`
 }
 
 func (P *WechatDataProvider) wechatMessageEmojiHandle(msg *WeChatMessage) {
@@ -966,7 +1454,10 @@ func (P *WechatDataProvider) wechatMessageEmojiHandle(msg *WeChatMessage) {
 		return
 	}
 
-	msg.EmojiPath = emojiMsg.Emoji.CdnURL
+	msg.EmojiPath = P.wechatEmojiLocalPath(&emojiMsg.Emoji)
+	if len(msg.EmojiPath) == 0 {
+		msg.EmojiPath = emojiMsg.Emoji.CdnURL
+	}
 }
 
 type xmlDocument struct {
@@ -991,15 +1482,14 @@ func (P *WechatDataProvider) wechatMessageCompressContentHandle(msg *WeChatMessa
 		return
 	}
 
-	unCompressContent := make([]byte, len(msg.compressContent)*10)
-	ulen, err := lz4.UncompressBlock(msg.compressContent, unCompressContent)
+	unCompressContent, err := UncompressContent(msg.compressContent)
 	if err != nil {
 		log.Println("UncompressBlock failed:", err, msg.MsgSvrId)
 		return
 	}
 
 	compMsg := etree.NewDocument()
-	if err := compMsg.ReadFromBytes(unCompressContent[:ulen-1]); err != nil {
+	if err := compMsg.ReadFromBytes(unCompressContent); err != nil {
 		// os.WriteFile("D:\\tmp\\"+string(msg.LocalId)+".xml", unCompressContent[:ulen], 0600)
 		log.Println("ReadFromBytes failed:", err)
 		return
@@ -1018,6 +1508,9 @@ func (P *WechatDataProvider) wechatMessageCompressContentHandle(msg *WeChatMessa
 		if len(msg.ThumbPath) == 0 && len(thumburl) > 0 && strings.HasPrefix(thumburl, "http") {
 			msg.ThumbPath = thumburl
 		}
+		if compMsg.FindElement("/msg/appmsg/mmreader/category") != nil {
+			msg.Articles = ParseArticleList(compMsg)
+		}
 	} else if msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_Refer {
 		msg.Content = root.FindElementValue("/msg/appmsg/title")
 		msg.ReferInfo.Type, _ = strconv.Atoi(root.FindElementValue("/msg/appmsg/refermsg/type"))
@@ -1036,11 +1529,8 @@ func (P *WechatDataProvider) wechatMessageCompressContentHandle(msg *WeChatMessa
 			msg.ReferInfo.Content = root.FindElementValue("/msg/appmsg/title")
 			msg.ReferInfo.SubType, _ = strconv.Atoi(root.FindElementValue("/msg/appmsg/type"))
 		}
-	} else if msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_Transfer {
-		msg.PayInfo.Type, _ = strconv.Atoi(root.FindElementValue("/msg/appmsg/wcpayinfo/paysubtype"))
-		msg.PayInfo.Feedesc = root.FindElementValue("/msg/appmsg/wcpayinfo/feedesc")
-		msg.PayInfo.BeginTime = root.FindElementValue("/msg/appmsg/wcpayinfo/begintransfertime")
-		msg.PayInfo.Memo = root.FindElementValue("/msg/appmsg/wcpayinfo/pay_memo")
+	} else if msg.Type == Wechat_Message_Type_Misc && (msg.SubType == Wechat_Misc_Message_Transfer || msg.SubType == Wechat_Misc_Message_RedPacket) {
+		P.wechatMessagePayHandle(msg, root)
 	} else if msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_TEXT {
 		msg.Content = root.FindElementValue("/msg/appmsg/title")
 	} else if msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_Channels {
@@ -1058,7 +1548,88 @@ func (P *WechatDataProvider) wechatMessageCompressContentHandle(msg *WeChatMessa
 		msg.MusicInfo.Description = root.FindElementValue("/msg/appmsg/des")
 		msg.MusicInfo.DataUrl = root.FindElementValue("/msg/appmsg/dataurl")
 		msg.MusicInfo.DisPlayName = root.FindElementValue("/msg/appinfo/appname")
+	} else if msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_ForwardMessage {
+		msg.ForwardInfo = ParseForwardInfo(string(unCompressContent))
+		msg.Content = msg.ForwardInfo.Title
+		P.wechatForwardItemsHandle(msg.ForwardInfo.Items)
+	}
+}
+
+// 合并转发的条目只带有原消息的svrid, 原消息还在本地时从原消息取媒体文件和头像
+func (P *WechatDataProvider) wechatForwardItemsHandle(items []WeChatMessage) {
+	for i := range items {
+		item := &items[i]
+		if len(item.UserInfo.UserName) > 0 {
+			if info, err := P.WechatGetUserInfoByNameOnCache(item.UserInfo.UserName); err == nil {
+				item.UserInfo.LocalHeadImgUrl = info.LocalHeadImgUrl
+				if len(item.UserInfo.NickName) == 0 {
+					item.UserInfo.NickName = info.NickName
+				}
+			}
+		}
+
+		if item.Type == Wechat_Message_Type_Misc && item.SubType == Wechat_Misc_Message_ForwardMessage {
+			P.wechatForwardItemsHandle(item.ForwardInfo.Items)
+			continue
+		}
+
+		isMedia := item.Type == Wechat_Message_Type_Picture || item.Type == Wechat_Message_Type_Video ||
+			item.Type == Wechat_Message_Type_Voice || (item.Type == Wechat_Message_Type_Misc && item.SubType == Wechat_Misc_Message_File)
+		if !isMedia || len(item.MsgSvrId) == 0 || item.MsgSvrId == "0" {
+			continue
+		}
+
+		src := P.wechatForwardSource(item.MsgSvrId)
+		if src == nil || src.Type != item.Type {
+			continue
+		}
+		item.ThumbPath = src.ThumbPath
+		item.ImagePath = src.ImagePath
+		item.VideoPath = src.VideoPath
+		item.VoicePath = src.VoicePath
+		item.FileInfo.FilePath = src.FileInfo.FilePath
+	}
+}
+
+// wechatForwardSource 不知道原消息在哪个会话, 要查所有MSG数据库, 结果按svrid缓存, 找不到的也缓存
+func (P *WechatDataProvider) wechatForwardSource(msgSvrId string) *WeChatMessage {
+	P.forwardSrcMtx.Lock()
+	src, exists := P.forwardSrcMap[msgSvrId]
+	P.forwardSrcMtx.Unlock()
+	if exists {
+		return src
+	}
+
+	src, err := P.WeChatGetMessageBySvrId("", msgSvrId)
+	if err != nil {
+		src = nil
+	}
+	P.forwardSrcMtx.Lock()
+	P.forwardSrcMap[msgSvrId] = src
+	P.forwardSrcMtx.Unlock()
+	return src
+}
+
+func wechatForwardItemPaths(items []WeChatMessage) []string {
+	paths := make([]string, 0)
+	for _, m := range items {
+		switch m.Type {
+		case Wechat_Message_Type_Picture:
+			paths = append(paths, m.ThumbPath, m.ImagePath)
+		case Wechat_Message_Type_Voice:
+			paths = append(paths, m.VoicePath)
+		case Wechat_Message_Type_Video:
+			paths = append(paths, m.ThumbPath, m.VideoPath)
+		case Wechat_Message_Type_Misc:
+			if m.SubType == Wechat_Misc_Message_File {
+				paths = append(paths, m.FileInfo.FilePath)
+			} else if m.SubType == Wechat_Misc_Message_ForwardMessage {
+				paths = append(paths, wechatForwardItemPaths(m.ForwardInfo.Items)...)
+			}
+		}
+		paths = append(paths, m.UserInfo.LocalHeadImgUrl)
 	}
+	return paths
 }
 
 func (P *WechatDataProvider) wechatMessageVoipHandle(msg *WeChatMessage) {
@@ -1075,6 +1646,19 @@ func (P *WechatDataProvider) wechatMessageVoipHandle(msg *WeChatMessage) {
 	root := NewxmlDocument(xmlMsg)
 	msg.VoipInfo.Type, _ = strconv.Atoi(root.FindElementValue("/voipmsg/VoIPBubbleMsg/room_type"))
 	msg.VoipInfo.Msg = root.FindElementValue("/voipmsg/VoIPBubbleMsg/msg")
+	msg.VoipInfo.Media = Wechat_Voip_Media_Video
+	if msg.VoipInfo.Type == 1 {
+		msg.VoipInfo.Media = Wechat_Voip_Media_Audio
+	}
+	msg.VoipInfo.Direction = Wechat_Voip_Direction_In
+	if msg.IsSender == 1 {
+		msg.VoipInfo.Direction = Wechat_Voip_Direction_Out
+	}
+	msg.VoipInfo.Status = voipStatusParse(msg.VoipInfo.Msg, msg.IsSender == 1)
+	msg.VoipInfo.Duration, _ = strconv.Atoi(root.FindElementValue("/voipmsg/VoIPBubbleMsg/duration"))
+	if msg.VoipInfo.Duration == 0 {
+		msg.VoipInfo.Duration = voipDurationParse(msg.VoipInfo.Msg)
+	}
 }
 
 func (P *WechatDataProvider) wechatMessageVisitHandke(msg *WeChatMessage) {
@@ -1117,6 +1701,33 @@ func (P *WechatDataProvider) wechatMessageLocationHandke(msg *WeChatMessage) {
 	msg.LocationInfo.Y = attr["y"]
 }
 
+func (P *WechatDataProvider) wechatMessageSystemHandle(msg *WeChatMessage) {
+	if msg.Type != Wechat_Message_Type_System && msg.Type != Wechat_Message_Type_SysNotice {
+		return
+	}
+
+	msg.SystemInfo = ParseSystemInfo(msg.Content, P.wechatDisplayName)
+	msg.Content = msg.SystemInfo.Text
+}
+
+func (P *WechatDataProvider) wechatDisplayName(userName string) string {
+	if userName == P.SelfInfo.UserName {
+		return "我"
+	}
+
+	info, err := P.WechatGetUserInfoByNameOnCache(userName)
+	if err != nil {
+		return userName
+	}
+	if info.ReMark != "" {
+		return info.ReMark
+	}
+	if info.NickName != "" {
+		return info.NickName
+	}
+	return userName
+}
+
 func (P *WechatDataProvider) wechatMessageGetUserInfo(msg *WeChatMessage) {
 	who := msg.Talker
 	if msg.IsSender == 1 {
@@ -1134,14 +1745,42 @@ func (P *WechatDataProvider) wechatMessageGetUserInfo(msg *WeChatMessage) {
 	msg.UserInfo = *pinfo
 }
 
+// wechatUserMsgDBs 公众号的消息只在PublicMsg.db里, 其它会话在按时间分的MSG分库里, 返回的下标和wechatFindDBIndex对应
+func (P *WechatDataProvider) wechatUserMsgDBs(userName string) []*wechatMsgDB {
+	if P.publicMsgDB != nil && P.publicTalkers[userName] {
+		return []*wechatMsgDB{P.publicMsgDB}
+	}
+	return P.msgDBs
+}
+
+func wechatMsgDBTalkers(msgDB *wechatMsgDB) map[string]bool {
+	talkers := make(map[string]bool)
+	querySql := "select distinct ifnull(StrTalker,'') from MSG;"
+	rows, err := msgDB.db.Query(querySql)
+	if err != nil {
+		log.Printf("%s in %s failed %v\n", querySql, msgDB.path, err)
+		return talkers
+	}
+	defer rows.Close()
+
+	var talker string
+	for rows.Next() {
+		if err := rows.Scan(&talker); err == nil && len(talker) > 0 {
+			talkers[talker] = true
+		}
+	}
+	return talkers
+}
+
 func (P *WechatDataProvider) wechatFindDBIndex(userName string, time int64, direction Message_Search_Direction) int {
+	msgDBs := P.wechatUserMsgDBs(userName)
 	if direction == Message_Search_Forward {
 		index := 0
 		for {
-			if index >= len(P.msgDBs) {
+			if index >= len(msgDBs) {
 				return -1
 			}
-			msgDB := P.msgDBs[index]
+			msgDB := msgDBs[index]
 
 			if msgDB.startTime > time {
 				index += 1
@@ -1170,12 +1809,12 @@ func (P *WechatDataProvider) wechatFindDBIndex(userName string, time int64, dire
 			return index
 		}
 	} else {
-		index := len(P.msgDBs) - 1
+		index := len(msgDBs) - 1
 		for {
 			if index < 0 {
 				return -1
 			}
-			msgDB := P.msgDBs[index]
+			msgDB := msgDBs[index]
 
 			if msgDB.endTime < time {
 				index -= 1
@@ -1207,13 +1846,14 @@ func (P *WechatDataProvider) wechatFindDBIndex(userName string, time int64, dire
 }
 
 func (P *WechatDataProvider) wechatGetLastMessageCreateTime(userName string, index int) int64 {
-	if index >= len(P.msgDBs) {
+	msgDBs := P.wechatUserMsgDBs(userName)
+	if index >= len(msgDBs) {
 		return -1
 	}
 	sqlFormat := "SELECT CreateTime FROM MSG WHERE StrTalker='%s' order by CreateTime asc limit 1;"
 	querySql := fmt.Sprintf(sqlFormat, userName)
 	var lastTime int64
-	err := P.msgDBs[index].db.QueryRow(querySql).Scan(&lastTime)
+	err := msgDBs[index].db.QueryRow(querySql).Scan(&lastTime)
 	if err != nil {
 		log.Println("select DB lastTime failed:", index, ":", err)
 		return -1
@@ -1229,6 +1869,8 @@ func weChatMessageContains(msg *WeChatMessage, chars string) bool {
 		return strings.Contains(msg.Content, chars)
 	case Wechat_Message_Type_Location:
 		return strings.Contains(msg.LocationInfo.Label, chars) || strings.Contains(msg.LocationInfo.PoiName, chars)
+	case Wechat_Message_Type_System, Wechat_Message_Type_SysNotice:
+		return strings.Contains(msg.Content, chars)
 	case Wechat_Message_Type_Misc:
 		switch msg.SubType {
 		case Wechat_Misc_Message_CardLink, Wechat_Misc_Message_ThirdVideo, Wechat_Misc_Message_Applet, Wechat_Misc_Message_Applet2:
@@ -1237,6 +1879,16 @@ func weChatMessageContains(msg *WeChatMessage, chars string) bool {
 			return strings.Contains(msg.Content, chars)
 		case Wechat_Misc_Message_File:
 			return strings.Contains(msg.FileInfo.FileName, chars)
+		case Wechat_Misc_Message_ForwardMessage:
+			if strings.Contains(msg.ForwardInfo.Title, chars) {
+				return true
+			}
+			for i := range msg.ForwardInfo.Items {
+				if weChatMessageContains(&msg.ForwardInfo.Items[i], chars) {
+					return true
+				}
+			}
+			return false
 		default:
 			return false
 		}
@@ -1259,7 +1911,18 @@ func weChatMessageTypeFilter(msg *WeChatMessage, msgType string) bool {
 		return msg.Type == Wechat_Message_Type_Voice
 	case "通话":
 		return msg.Type == Wechat_Message_Type_Voip
+	case "未接来电":
+		return msg.Type == Wechat_Message_Type_Voip && msg.VoipInfo.Status == Wechat_Voip_Status_Missed
+	case "聊天记录":
+		return msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_ForwardMessage
+	case "系统消息":
+		return msg.Type == Wechat_Message_Type_System || msg.Type == Wechat_Message_Type_SysNotice
 	default:
+		if strings.HasPrefix(msgType, "系统事件") {
+			kind := msgType[len("系统事件"):]
+			return (msg.Type == Wechat_Message_Type_System || msg.Type == Wechat_Message_Type_SysNotice) && msg.SystemInfo.Kind == kind
+		}
+
 		if strings.HasPrefix(msgType, "群成员") {
 			userName := msgType[len("群成员"):]
 			return msg.UserInfo.UserName == userName
@@ -1272,7 +1935,7 @@ func weChatMessageTypeFilter(msg *WeChatMessage, msgType string) bool {
 func wechatOpenMsgDB(path string) (*wechatMsgDB, error) {
 	msgDB := wechatMsgDB{}
 
-	db, err := sql.Open("sqlite3", path)
+	db, err := openBackupDataBase(path)
 	if err != nil {
 		log.Printf("open db %s error: %v", path, err)
 		return nil, err
@@ -1283,7 +1946,7 @@ func wechatOpenMsgDB(path string) (*wechatMsgDB, error) {
 	err = msgDB.db.QueryRow(querySql).Scan(&msgDB.startTime)
 	if err != nil {
 		log.Println("select DB startTime failed:", path, ":", err)
-		msgDB.db.Close()
+		closeDataBase(msgDB.db)
 		return nil, err
 	}
 
@@ -1291,7 +1954,7 @@ func wechatOpenMsgDB(path string) (*wechatMsgDB, error) {
 	err = msgDB.db.QueryRow(querySql).Scan(&msgDB.endTime)
 	if err != nil {
 		log.Println("select DB endTime failed:", path, ":", err)
-		msgDB.db.Close()
+		closeDataBase(msgDB.db)
 		return nil, err
 	}
 
@@ -1331,7 +1994,7 @@ func (P *WechatDataProvider) wechatGetAllContact() (*WeChatContactList, error) {
 	List := &WeChatContactList{}
 	List.Users = make([]WeChatContact, 0)
 
-	querySql := fmt.Sprintf("select ifnull(UserName,'') as UserName,Reserved1,Reserved2,ifnull(PYInitial,'') as PYInitial,ifnull(QuanPin,'') as QuanPin,ifnull(RemarkPYInitial,'') as RemarkPYInitial,ifnull(RemarkQuanPin,'') as RemarkQuanPin from Contact desc;")
+	querySql := fmt.Sprintf("select ifnull(UserName,'') as UserName,Reserved1,Reserved2,ifnull(PYInitial,'') as PYInitial,ifnull(QuanPin,'') as QuanPin,ifnull(RemarkPYInitial,'') as RemarkPYInitial,ifnull(RemarkQuanPin,'') as RemarkQuanPin,ifnull(LabelIDList,'') as LabelIDList from Contact desc;")
 	dbRows, err := P.microMsg.Query(querySql)
 	if err != nil {
 		log.Println(err)
@@ -1339,11 +2002,11 @@ func (P *WechatDataProvider) wechatGetAllContact() (*WeChatContactList, error) {
 	}
 	defer dbRows.Close()
 
-	var UserName string
+	var UserName, LabelIDList string
 	var Reserved1, Reserved2 int
 	for dbRows.Next() {
 		var Contact WeChatContact
-		err = dbRows.Scan(&UserName, &Reserved1, &Reserved2, &Contact.PYInitial, &Contact.QuanPin, &Contact.RemarkPYInitial, &Contact.RemarkQuanPin)
+		err = dbRows.Scan(&UserName, &Reserved1, &Reserved2, &Contact.PYInitial, &Contact.QuanPin, &Contact.RemarkPYInitial, &Contact.RemarkQuanPin, &LabelIDList)
 		if err != nil {
 			log.Println(err)
 			continue
@@ -1363,6 +2026,8 @@ func (P *WechatDataProvider) wechatGetAllContact() (*WeChatContactList, error) {
 			continue
 		}
 		Contact.WeChatUserInfo = *info
+		Contact.Category = wechatContactCategory(UserName, Reserved1, Reserved2)
+		Contact.Labels = P.wechatContactLabels(LabelIDList)
 		List.Users = append(List.Users, Contact)
 		List.Total += 1
 	}
@@ -1370,19 +2035,378 @@ func (P *WechatDataProvider) wechatGetAllContact() (*WeChatContactList, error) {
 	return List, nil
 }
 
+func (P *WechatDataProvider) wechatGetContactLabel() []WeChatContactLabel {
+	labels := make([]WeChatContactLabel, 0)
+	querySql := "select LabelId, ifnull(LabelName,'') as LabelName from ContactLabel order by LabelId asc;"
+	dbRows, err := P.microMsg.Query(querySql)
+	if err != nil {
+		log.Println("ContactLabel:", err)
+		return labels
+	}
+	defer dbRows.Close()
+
+	for dbRows.Next() {
+		var label WeChatContactLabel
+		if err := dbRows.Scan(&label.LabelId, &label.LabelName); err != nil {
+			log.Println(err)
+			continue
+		}
+		labels = append(labels, label)
+	}
+
+	log.Println("Contact label number:", len(labels))
+	return labels
+}
+
+func (P *WechatDataProvider) wechatContactLabels(labelIDList string) []WeChatContactLabel {
+	labels := make([]WeChatContactLabel, 0)
+	for _, id := range strings.Split(labelIDList, ",") {
+		labelId, err := strconv.Atoi(strings.TrimSpace(id))
+		if err != nil {
+			continue
+		}
+		for _, label := range P.labelList {
+			if label.LabelId == labelId {
+				labels = append(labels, WeChatContactLabel{LabelId: label.LabelId, LabelName: label.LabelName})
+				break
+			}
+		}
+	}
+
+	return labels
+}
+
+func (P *WechatDataProvider) WeChatGetContactProfile(userName string) (*WeChatContactProfile, error) {
+	info, err := P.WechatGetUserInfoByNameOnCache(userName)
+	if err != nil {
+		log.Printf("WechatGetUserInfoByName %s failed: %v\n", userName, err)
+		return nil, err
+	}
+
+	profile := &WeChatContactProfile{}
+	profile.WeChatUserInfo = *info
+	profile.Labels = make([]WeChatContactLabel, 0)
+
+	if strings.HasSuffix(userName, "@openim") {
+		profile.WeChatContactExtra = *DecodeContactExtraBuf(nil)
+		profile.Category = Wechat_Contact_Category_OpenIM
+		if P.openIMContact != nil {
+			var sex int
+			var source string
+			querySql := fmt.Sprintf("select ifnull(Sex,0) as Sex, ifnull(Source,'') as Source from OpenIMContact where UserName='%s';", userName)
+			if err := P.openIMContact.QueryRow(querySql).Scan(&sex, &source); err != nil {
+				log.Println("OpenIMContact profile:", err)
+			}
+			profile.Gender = sex
+			profile.Source = source
+		}
+		return profile, nil
+	}
+
+	var ExtraBuf []byte
+	var LabelIDList string
+	var Reserved1, Reserved2 int
+	querySql := fmt.Sprintf("select ifnull(ExtraBuf,'') as ExtraBuf, ifnull(LabelIDList,'') as LabelIDList, Reserved1, Reserved2 from Contact where UserName='%s';", userName)
+	err = P.microMsg.QueryRow(querySql).Scan(&ExtraBuf, &LabelIDList, &Reserved1, &Reserved2)
+	if err != nil {
+		log.Println("Contact profile:", err)
+		return nil, err
+	}
+
+	profile.WeChatContactExtra = *DecodeContactExtraBuf(ExtraBuf)
+	profile.Labels = P.wechatContactLabels(LabelIDList)
+	if !info.IsGroup {
+		profile.Source = P.wechatFriendRequestSource(userName)
+	}
+	profile.Category = wechatContactCategory(userName, Reserved1, Reserved2)
+
+	return profile, nil
+}
+
+// 好友验证消息里的scene
+var wechatFriendSceneNames = map[string]string{
+	"1":  "QQ号搜索",
+	"3":  "微信号搜索",
+	"4":  "QQ好友",
+	"8":  "群聊",
+	"10": "手机通讯录",
+	"12": "QQ好友",
+	"13": "手机通讯录",
+	"14": "群聊",
+	"15": "手机号搜索",
+	"17": "名片分享",
+	"18": "附近的人",
+	"25": "漂流瓶",
+	"29": "摇一摇",
+	"30": "扫一扫",
+}
+
+// wechatFriendRequestSource 对方发来的好友验证消息(Type 37)里有添加来源, 取最近的一条
+func (P *WechatDataProvider) wechatFriendRequestSource(userName string) string {
+	querySql := fmt.Sprintf("select ifnull(StrContent,'') from MSG where Type=%d And StrContent like '%%fromusername=\"%s\"%%' order by CreateTime desc limit 1;", Wechat_Message_Type_Verify, userName)
+	for i := len(P.msgDBs) - 1; i >= 0; i-- {
+		var content string
+		if err := P.msgDBs[i].db.QueryRow(querySql).Scan(&content); err != nil {
+			continue
+		}
+		scene := utils.HtmlMsgGetAttr(content, "msg")["scene"]
+		if name, exists := wechatFriendSceneNames[scene]; exists {
+			return name
+		} else if len(scene) > 0 {
+			return "scene " + scene
+		}
+	}
+	return ""
+}
+
+func (P *WechatDataProvider) WeChatGetContactLabelList() (*WeChatContactLabelList, error) {
+	List := &WeChatContactLabelList{}
+	List.Labels = make([]WeChatContactLabel, 0)
+
+	contacts := P.wechatGetCategoryContact()
+	for _, label := range P.labelList {
+		label.Count = 0
+		for i := range contacts {
+			for _, l := range contacts[i].Labels {
+				if l.LabelId == label.LabelId {
+					label.Count += 1
+					break
+				}
+			}
+		}
+		List.Labels = append(List.Labels, label)
+		List.Total += 1
+	}
+
+	return List, nil
+}
+
+func (P *WechatDataProvider) WeChatGetContactListByLabel(labelId int, pageIndex int, pageSize int) (*WeChatContactList, error) {
+	return P.wechatGetContactListByFilter(pageIndex, pageSize, func(contact *WeChatContact) bool {
+		for _, label := range contact.Labels {
+			if label.LabelId == labelId {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (P *WechatDataProvider) WeChatGetContactListByCategory(category string, pageIndex int, pageSize int) (*WeChatContactList, error) {
+	return P.wechatGetContactListByFilter(pageIndex, pageSize, func(contact *WeChatContact) bool {
+		return category == "" || contact.Category == category
+	})
+}
+
+func (P *WechatDataProvider) wechatGetContactListByFilter(pageIndex int, pageSize int, filter func(contact *WeChatContact) bool) (*WeChatContactList, error) {
+	List := &WeChatContactList{}
+	List.Users = make([]WeChatContact, 0)
+
+	start := pageIndex * pageSize
+	index := 0
+	contacts := P.wechatGetCategoryContact()
+	for i := range contacts {
+		if !filter(&contacts[i]) {
+			continue
+		}
+		if index >= start && List.Total < pageSize {
+			List.Users = append(List.Users, contacts[i])
+			List.Total += 1
+		}
+		index += 1
+	}
+
+	return List, nil
+}
+
+func (P *WechatDataProvider) WeChatSearchContacts(query string) (*WeChatContactSearchList, error) {
+	List := &WeChatContactSearchList{}
+	List.Query = query
+	List.Users = make([]WeChatContactSearchItem, 0)
+
+	key := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(query), " ", ""))
+	if key == "" {
+		return List, nil
+	}
+
+	for _, contact := range P.wechatGetCategoryContact() {
+		if contact.Category == Wechat_Contact_Category_Stranger {
+			continue
+		}
+		score, field := wechatContactMatch(&contact, key)
+		if score == 0 {
+			continue
+		}
+		List.Users = append(List.Users, WeChatContactSearchItem{WeChatContact: contact, Score: score, MatchField: field})
+	}
+
+	sort.SliceStable(List.Users, func(i, j int) bool {
+		if List.Users[i].Score != List.Users[j].Score {
+			return List.Users[i].Score > List.Users[j].Score
+		}
+		if List.Users[i].IsGroup != List.Users[j].IsGroup {
+			return !List.Users[i].IsGroup
+		}
+		return byName{List.Users[i].WeChatContact, List.Users[j].WeChatContact}.Less(0, 1)
+	})
+	List.Total = len(List.Users)
+
+	return List, nil
+}
+
+func wechatContactMatch(contact *WeChatContact, key string) (int, string) {
+	type matchField struct {
+		name   string
+		value  string
+		weight int
+	}
+
+	fields := []matchField{
+		{"ReMark", contact.ReMark, 10},
+		{"NickName", contact.NickName, 8},
+		{"Alias", contact.Alias, 6},
+		{"UserName", contact.UserName, 6},
+		{"RemarkQuanPin", contact.RemarkQuanPin, 4},
+		{"QuanPin", contact.QuanPin, 3},
+		{"RemarkPYInitial", contact.RemarkPYInitial, 4},
+		{"PYInitial", contact.PYInitial, 3},
+	}
+
+	bestScore, bestField := 0, ""
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+
+		value := strings.ToLower(strings.ReplaceAll(f.value, " ", ""))
+		score := 0
+		if value == key {
+			score = 300
+		} else if strings.HasPrefix(value, key) {
+			score = 200
+		} else if strings.Contains(value, key) {
+			score = 100
+		}
+		if score == 0 {
+			continue
+		}
+
+		score += f.weight
+		if score > bestScore {
+			bestScore, bestField = score, f.name
+		}
+	}
+
+	return bestScore, bestField
+}
+
+// wechatContactCategory Contact表里的联系人分类, 群聊的Reserved1/Reserved2也可能是1, 要先判断
+func wechatContactCategory(userName string, reserved1, reserved2 int) string {
+	if strings.HasSuffix(userName, "@chatroom") {
+		return Wechat_Contact_Category_Group
+	} else if reserved1 == 1 && reserved2 == 1 {
+		return Wechat_Contact_Category_Friend
+	}
+	return Wechat_Contact_Category_Stranger
+}
+
+func (P *WechatDataProvider) wechatGetCategoryContact() []WeChatContact {
+	P.allContactMtx.Lock()
+	defer P.allContactMtx.Unlock()
+	if P.allContacts != nil {
+		return P.allContacts
+	}
+
+	contacts := make([]WeChatContact, 0, P.ContactList.Total)
+	querySql := "select ifnull(UserName,'') as UserName,Reserved1,Reserved2,ifnull(PYInitial,'') as PYInitial,ifnull(QuanPin,'') as QuanPin,ifnull(RemarkPYInitial,'') as RemarkPYInitial,ifnull(RemarkQuanPin,'') as RemarkQuanPin,ifnull(LabelIDList,'') as LabelIDList from Contact;"
+	dbRows, err := P.microMsg.Query(querySql)
+	if err != nil {
+		log.Println(err)
+	} else {
+		var UserName, LabelIDList string
+		var Reserved1, Reserved2 int
+		for dbRows.Next() {
+			var Contact WeChatContact
+			err = dbRows.Scan(&UserName, &Reserved1, &Reserved2, &Contact.PYInitial, &Contact.QuanPin, &Contact.RemarkPYInitial, &Contact.RemarkQuanPin, &LabelIDList)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+
+			Contact.Category = wechatContactCategory(UserName, Reserved1, Reserved2)
+
+			info, err := P.WechatGetUserInfoByNameOnCache(UserName)
+			if err != nil {
+				continue
+			}
+			if info.NickName == "" && info.ReMark == "" {
+				continue
+			}
+			Contact.WeChatUserInfo = *info
+			Contact.Labels = P.wechatContactLabels(LabelIDList)
+			contacts = append(contacts, Contact)
+		}
+		dbRows.Close()
+	}
+
+	if P.openIMContact != nil {
+		querySql = "select ifnull(UserName,'') as UserName,ifnull(NickNamePYInit,'') as NickNamePYInit,ifnull(NickNameQuanPin,'') as NickNameQuanPin,ifnull(RemarkPYInit,'') as RemarkPYInit,ifnull(RemarkQuanPin,'') as RemarkQuanPin from OpenIMContact;"
+		dbRows, err := P.openIMContact.Query(querySql)
+		if err != nil {
+			log.Println(err)
+		} else {
+			var UserName string
+			for dbRows.Next() {
+				var Contact WeChatContact
+				err = dbRows.Scan(&UserName, &Contact.PYInitial, &Contact.QuanPin, &Contact.RemarkPYInitial, &Contact.RemarkQuanPin)
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+
+				info, err := P.WechatGetUserInfoByNameOnCache(UserName)
+				if err != nil {
+					continue
+				}
+				Contact.WeChatUserInfo = *info
+				Contact.Category = Wechat_Contact_Category_OpenIM
+				Contact.Labels = make([]WeChatContactLabel, 0)
+				contacts = append(contacts, Contact)
+			}
+			dbRows.Close()
+		}
+	}
+
+	sort.Sort(byName(contacts))
+	log.Println("wechatGetCategoryContact:", len(contacts))
+	P.allContacts = contacts
+	return contacts
+}
+
 func WechatGetAccountInfo(resPath, prefixRes, accountName string) (*WeChatAccountInfo, error) {
-	MicroMsgDBPath := resPath + "\\Msg\\" + MicroMsgDB
+	if IsBackupLocked(resPath) {
+		// 加密的导出没解锁前读不了数据库, 只返回账号名和本地头像
+		info := &WeChatAccountInfo{AccountName: accountName, Encrypted: true, Locked: true}
+		localHeadImgPath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", resPath, accountName)
+		if _, err := os.Stat(localHeadImgPath); err == nil {
+			info.LocalHeadImgUrl = fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", prefixRes, accountName)
+		}
+		return info, nil
+	}
+
+	dbPath, _ := BackupDataBasePath(resPath)
+	MicroMsgDBPath := dbPath + "\\Msg\\" + MicroMsgDB
 	if _, err := os.Stat(MicroMsgDBPath); err != nil {
 		log.Println("MicroMsgDBPath:", MicroMsgDBPath, err)
 		return nil, err
 	}
 
-	microMsg, err := sql.Open("sqlite3", MicroMsgDBPath)
+	microMsg, err := openBackupDataBase(MicroMsgDBPath)
 	if err != nil {
 		log.Printf("open db %s error: %v", MicroMsgDBPath, err)
 		return nil, err
 	}
-	defer microMsg.Close()
+	defer closeDataBase(microMsg)
 
 	info := &WeChatAccountInfo{}
 
@@ -1411,6 +2435,7 @@ func WechatGetAccountInfo(resPath, prefixRes, accountName string) (*WeChatAccoun
 	info.NickName = NickName
 	info.SmallHeadImgUrl = smallHeadImgUrl
 	info.BigHeadImgUrl = bigHeadImgUrl
+	info.Encrypted = IsBackupEncrypted(resPath)
 
 	localHeadImgPath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", resPath, accountName)
 	relativePath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", prefixRes, accountName)
@@ -1422,11 +2447,11 @@ func WechatGetAccountInfo(resPath, prefixRes, accountName string) (*WeChatAccoun
 }
 
 func systemMsgParse(msgType int, content string) string {
-	if msgType != Wechat_Message_Type_System {
+	if msgType != Wechat_Message_Type_System && msgType != Wechat_Message_Type_SysNotice {
 		return content
 	}
 
-	return utils.Html2Text(content)
+	return ParseSystemInfo(content, nil).Text
 }
 
 func (P *WechatDataProvider) urlconvertCacheName(url string, timestamp int64) string {
@@ -1457,7 +2482,7 @@ func isLinkSubType(subType int) bool {
 
 func openUserDataDB(path string) *sql.DB {
 	if _, err := os.Stat(path); err == nil {
-		sql, err := sql.Open("sqlite3", path)
+		sql, err := openBackupDataBase(path)
 		if err != nil {
 			log.Printf("open db %s error: %v", path, err)
 			return nil
@@ -1466,7 +2491,14 @@ func openUserDataDB(path string) *sql.DB {
 		return sql
 	}
 
-	db, err := sql.Open("sqlite3", path)
+	var db *sql.DB
+	var err error
+	if getBackupKeyByPath(path) != nil {
+		// 加密的导出里新建的数据库先放在内存里, 关闭时加密写回
+		db, err = newBackupMemDataBase(path)
+	} else {
+		db, err = sql.Open("sqlite3", path)
+	}
 	if err != nil {
 		log.Printf("open db %s error: %v", path, err)
 		return nil
@@ -1487,7 +2519,7 @@ func openUserDataDB(path string) *sql.DB {
 	_, err = db.Exec(createLastTimeTable)
 	if err != nil {
 		log.Printf("create lastTime table failed: %v", err)
-		db.Close()
+		closeDataBase(db)
 		return nil
 	}
 
@@ -1507,7 +2539,7 @@ func openUserDataDB(path string) *sql.DB {
 	_, err = db.Exec(createBookMarkTable)
 	if err != nil {
 		log.Printf("create bookMark table failed: %v", err)
-		db.Close()
+		closeDataBase(db)
 		return nil
 	}
 
@@ -1807,19 +2839,20 @@ func (P *WechatDataProvider) weChatExportMsgDBByUserName(userName, exportPath st
 	}
 	defer exMsgDB.Close()
 
-	if len(P.msgDBs) == 0 {
+	msgDBs := P.wechatUserMsgDBs(userName)
+	if len(msgDBs) == 0 {
 		return fmt.Errorf("P.msgDBs len = 0")
 	}
 
 	tables := []string{"MSG", "Name2ID"}
-	err = wechatCopyDBTables(exMsgDB, P.msgDBs[0].db, tables)
+	err = wechatCopyDBTables(exMsgDB, msgDBs[0].db, tables)
 	if err != nil {
 		log.Println("wechatCopyDBTables:", err)
 		return err
 	}
 
 	columns := "TalkerId, MsgSvrID, Type, SubType, IsSender, CreateTime, Sequence, StatusEx, FlagEx, Status, MsgServerSeq, MsgSequence, StrTalker, StrContent, DisplayContent, Reserved0, Reserved1, Reserved2, Reserved3, Reserved4, Reserved5, Reserved6, CompressContent, BytesExtra, BytesTrans"
-	for _, msgDB := range P.msgDBs {
+	for _, msgDB := range msgDBs {
 		err = wechatCopyTableData(exMsgDB, msgDB.db, "MSG", columns, "StrTalker", []string{userName})
 		if err != nil {
 			log.Println("wechatCopyTableData MSG:", err)
@@ -1828,7 +2861,7 @@ func (P *WechatDataProvider) weChatExportMsgDBByUserName(userName, exportPath st
 	}
 
 	columns = "UsrName"
-	for _, msgDB := range P.msgDBs {
+	for _, msgDB := range msgDBs {
 		err = wechatCopyTableData(exMsgDB, msgDB.db, "Name2ID", columns, "UsrName", []string{userName})
 		if err != nil {
 			continue
@@ -2087,7 +3120,7 @@ func (P *WechatDataProvider) WeChatExportFileByUserName(userName, exportPath str
 			defer wg.Done()
 			for task := range taskChan {
 				// log.Println("copy: ", task[0], task[1])
-				utils.CopyFile(task[0], task[1])
+				CopyBackupFile(task[0], task[1])
 			}
 		}()
 	}
@@ -2111,6 +3144,8 @@ func (P *WechatDataProvider) WeChatExportFileByUserName(userName, exportPath str
 				paths = append(paths, m.ThumbPath, m.VideoPath)
 			case Wechat_Message_Type_Location:
 				paths = append(paths, m.LocationInfo.ThumbPath)
+			case Wechat_Message_Type_Emoji:
+				paths = append(paths, m.EmojiPath)
 			case Wechat_Message_Type_Misc:
 				switch m.SubType {
 				case Wechat_Misc_Message_Music:
@@ -2133,6 +3168,8 @@ func (P *WechatDataProvider) WeChatExportFileByUserName(userName, exportPath str
 					paths = append(paths, m.ThumbPath)
 				case Wechat_Misc_Message_TingListen:
 					paths = append(paths, m.MusicInfo.ThumbPath)
+				case Wechat_Misc_Message_ForwardMessage:
+					paths = append(paths, wechatForwardItemPaths(m.ForwardInfo.Items)...)
 				}
 			}
 		}
@@ -0,0 +1,159 @@
+package wechat
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// emotionImageExt 根据文件头判断表情的图片格式, 不是图片时返回空
+func emotionImageExt(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return ".gif"
+	case bytes.HasPrefix(data, []byte{0x89, 'P', 'N', 'G'}):
+		return ".png"
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return ".jpg"
+	case len(data) > 12 && bytes.HasPrefix(data, []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return ".webp"
+	}
+	return ""
+}
+
+// DecodeCustomEmotion 还原CustomEmotion缓存文件, 依次尝试明文, 和.dat图片一样的异或, 以及用aeskey做AES-ECB解密
+func DecodeCustomEmotion(data []byte, aesKeys ...string) ([]byte, string, error) {
+	if ext := emotionImageExt(data); ext != "" {
+		return data, ext, nil
+	}
+
+	if len(data) > 10 {
+		if decodeByte, _, err := findDecodeByte(data[:10]); err == nil {
+			plain := make([]byte, len(data))
+			for i := range data {
+				plain[i] = data[i] ^ decodeByte
+			}
+			if ext := emotionImageExt(plain); ext != "" {
+				return plain, ext, nil
+			}
+		}
+	}
+
+	for _, aesKey := range aesKeys {
+		key, err := hex.DecodeString(aesKey)
+		if err != nil || (len(key) != 16 && len(key) != 24 && len(key) != 32) {
+			key = []byte(aesKey)
+		}
+		plain, err := emotionAesEcbDecrypt(data, key)
+		if err != nil {
+			continue
+		}
+		if ext := emotionImageExt(plain); ext != "" {
+			return plain, ext, nil
+		}
+	}
+
+	return nil, "", fmt.Errorf("unknown emotion format")
+}
+
+func emotionAesEcbDecrypt(data []byte, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("invalid data len %d", len(data))
+	}
+
+	plain := make([]byte, len(data))
+	for i := 0; i < len(data); i += block.BlockSize() {
+		block.Decrypt(plain[i:i+block.BlockSize()], data[i:i+block.BlockSize()])
+	}
+
+	padding := int(plain[len(plain)-1])
+	if padding > 0 && padding <= block.BlockSize() && bytes.HasSuffix(plain, bytes.Repeat([]byte{byte(padding)}, padding)) {
+		plain = plain[:len(plain)-padding]
+	}
+	return plain, nil
+}
+
+// wechatEmojiLocalPath 在FileStorage\CustomEmotion里找md5对应的表情, 解码后的文件放在原文件旁边, 找不到时返回空
+func (P *WechatDataProvider) wechatEmojiLocalPath(emoji *Emoji) string {
+	// md5来自消息的xml, 会拼到路径和查询里, 不是32位十六进制的一律不处理
+	if !isEmojiMd5(emoji.Md5) {
+		return ""
+	}
+
+	P.emojiMtx.Lock()
+	path, exists := P.emojiPaths[emoji.Md5]
+	P.emojiMtx.Unlock()
+	if exists {
+		return path
+	}
+
+	path = P.wechatEmojiDecode(emoji)
+	P.emojiMtx.Lock()
+	P.emojiPaths[emoji.Md5] = path
+	P.emojiMtx.Unlock()
+
+	return path
+}
+
+func isEmojiMd5(md5 string) bool {
+	if len(md5) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(md5)
+	return err == nil
+}
+
+func (P *WechatDataProvider) wechatEmojiDecode(emoji *Emoji) string {
+	dir := fmt.Sprintf("%s\\FileStorage\\CustomEmotion\\%s", P.resPath, emoji.Md5[:2])
+	prefixDir := fmt.Sprintf("%s\\FileStorage\\CustomEmotion\\%s", P.prefixResPath, emoji.Md5[:2])
+	for _, ext := range []string{".gif", ".png", ".jpg", ".webp"} {
+		if _, err := os.Stat(dir + "\\" + emoji.Md5 + ext); err == nil {
+			return prefixDir + "\\" + emoji.Md5 + ext
+		}
+	}
+
+	srcFile := dir + "\\" + emoji.Md5
+	data, err := ReadBackupFile(srcFile)
+	if err != nil {
+		matches, _ := filepath.Glob(srcFile + "*")
+		if len(matches) == 0 {
+			return ""
+		}
+		srcFile = matches[0]
+		if data, err = ReadBackupFile(srcFile); err != nil {
+			return ""
+		}
+	}
+
+	aesKeys := make([]string, 0, 2)
+	if len(emoji.AesKey) > 0 {
+		aesKeys = append(aesKeys, emoji.AesKey)
+	}
+	if P.emotion != nil {
+		var aesKey string
+		querySql := "select ifnull(AesKey,'') from CustomEmotion where MD5=?;"
+		if err := P.emotion.QueryRow(querySql, emoji.Md5).Scan(&aesKey); err == nil && len(aesKey) > 0 && aesKey != emoji.AesKey {
+			aesKeys = append(aesKeys, aesKey)
+		}
+	}
+
+	plain, ext, err := DecodeCustomEmotion(data, aesKeys...)
+	if err != nil {
+		log.Println("DecodeCustomEmotion failed:", srcFile, err)
+		return ""
+	}
+	if err := WriteBackupFile(P.resPath, dir+"\\"+emoji.Md5+ext, plain); err != nil {
+		log.Println("WriteFile failed:", err)
+		return ""
+	}
+
+	return prefixDir + "\\" + emoji.Md5 + ext
+}
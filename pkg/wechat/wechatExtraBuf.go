@@ -0,0 +1,149 @@
+package wechat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+/*
+	Contact.ExtraBuf 的字段定义参考: https://github.com/xaoyaoo/PyWxDump
+	每个字段为 4字节tag + 1字节类型 + 值
+*/
+
+const (
+	extraBufTypeInt32  = 0x04
+	extraBufTypeInt64  = 0x05
+	extraBufTypeUTF8   = 0x17
+	extraBufTypeUTF16  = 0x18
+	extraBufTagGender  = "74752C06"
+	extraBufTagSign    = "46CF10C4"
+	extraBufTagCountry = "A4D9024A"
+	extraBufTagProv    = "E2EAA8D1"
+	extraBufTagCity    = "1D025BBF"
+	extraBufTagCompany = "F917BCC0"
+	extraBufTagPhone   = "759378AD"
+	extraBufTagWework  = "4EB96D85"
+	extraBufTagSnsBg   = "81AE19B4"
+	extraBufTagRmkImg  = "0E719F13"
+	extraBufTagRmkImg2 = "945F3190"
+)
+
+var extraBufTagNames = map[string]string{
+	extraBufTagGender:  "Gender",
+	extraBufTagSign:    "Signature",
+	extraBufTagCountry: "Country",
+	extraBufTagProv:    "Province",
+	extraBufTagCity:    "City",
+	extraBufTagCompany: "Company",
+	extraBufTagPhone:   "Phone",
+	extraBufTagWework:  "WeWork",
+	extraBufTagSnsBg:   "SnsBackground",
+	extraBufTagRmkImg:  "RemarkImage",
+	extraBufTagRmkImg2: "RemarkImage2",
+}
+
+type WeChatContactExtra struct {
+	Gender        int               `json:"Gender"`
+	Signature     string            `json:"Signature"`
+	Country       string            `json:"Country"`
+	Province      string            `json:"Province"`
+	City          string            `json:"City"`
+	Company       string            `json:"Company"`
+	PhoneNumbers  []string          `json:"PhoneNumbers"`
+	SnsBackground string            `json:"SnsBackground"`
+	RemarkImages  []string          `json:"RemarkImages"`
+	Fields        map[string]string `json:"Fields"`
+}
+
+func DecodeContactExtraBuf(buf []byte) *WeChatContactExtra {
+	extra := &WeChatContactExtra{}
+	extra.PhoneNumbers = make([]string, 0)
+	extra.RemarkImages = make([]string, 0)
+	extra.Fields = make(map[string]string)
+	if len(buf) == 0 {
+		return extra
+	}
+
+	for tag, name := range extraBufTagNames {
+		value, ok := extraBufFindValue(buf, tag)
+		if !ok {
+			continue
+		}
+		extra.Fields[name] = value
+	}
+
+	fmt.Sscanf(extra.Fields["Gender"], "%d", &extra.Gender)
+	extra.Signature = extra.Fields["Signature"]
+	extra.Country = extra.Fields["Country"]
+	extra.Province = extra.Fields["Province"]
+	extra.City = extra.Fields["City"]
+	extra.Company = extra.Fields["Company"]
+	extra.SnsBackground = extra.Fields["SnsBackground"]
+	phones := strings.FieldsFunc(extra.Fields["Phone"], func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\n' || r == '\x00'
+	})
+	extra.PhoneNumbers = append(extra.PhoneNumbers, phones...)
+	for _, key := range []string{"RemarkImage", "RemarkImage2"} {
+		if img := extra.Fields[key]; img != "" {
+			extra.RemarkImages = append(extra.RemarkImages, img)
+		}
+	}
+
+	return extra
+}
+
+func extraBufFindValue(buf []byte, tag string) (string, bool) {
+	tagBytes, err := hex.DecodeString(tag)
+	if err != nil {
+		return "", false
+	}
+
+	offset := bytes.Index(buf, tagBytes)
+	if offset == -1 {
+		return "", false
+	}
+	offset += len(tagBytes)
+	if offset >= len(buf) {
+		return "", false
+	}
+
+	typeId := buf[offset]
+	offset += 1
+	switch typeId {
+	case extraBufTypeInt32:
+		if offset+4 > len(buf) {
+			return "", false
+		}
+		return fmt.Sprintf("%d", binary.LittleEndian.Uint32(buf[offset:offset+4])), true
+	case extraBufTypeInt64:
+		if offset+8 > len(buf) {
+			return "", false
+		}
+		return fmt.Sprintf("0x%s", hex.EncodeToString(buf[offset:offset+8])), true
+	case extraBufTypeUTF8, extraBufTypeUTF16:
+		if offset+4 > len(buf) {
+			return "", false
+		}
+		length := int(binary.LittleEndian.Uint32(buf[offset : offset+4]))
+		offset += 4
+		if length < 0 || offset+length > len(buf) {
+			return "", false
+		}
+		data := buf[offset : offset+length]
+		if typeId == extraBufTypeUTF8 {
+			return strings.TrimRight(string(data), "\x00"), true
+		}
+
+		u16 := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			u16 = append(u16, binary.LittleEndian.Uint16(data[i:i+2]))
+		}
+		return strings.TrimRight(string(utf16.Decode(u16)), "\x00"), true
+	}
+
+	return "", false
+}
@@ -0,0 +1,560 @@
+package wechat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+const (
+	FavoriteDB = "Favorite.db"
+)
+
+// FavItems Type
+const (
+	Wechat_Fav_Type_Text     = 1
+	Wechat_Fav_Type_Image    = 2
+	Wechat_Fav_Type_Voice    = 3
+	Wechat_Fav_Type_Video    = 4
+	Wechat_Fav_Type_Link     = 5
+	Wechat_Fav_Type_Location = 6
+	Wechat_Fav_Type_File     = 8
+	Wechat_Fav_Type_Record   = 14
+	Wechat_Fav_Type_Note     = 18
+)
+
+type FavItem struct {
+	FavId        int64           `json:"FavId"`
+	Type         int             `json:"Type"`
+	FromUser     string          `json:"FromUser"`
+	FromNickName string          `json:"FromNickName"`
+	RealChatName string          `json:"RealChatName"`
+	CreateTime   int64           `json:"CreateTime"`
+	UpdateTime   int64           `json:"UpdateTime"`
+	Title        string          `json:"Title"`
+	Desc         string          `json:"Desc"`
+	LinkInfo     LinkInfo        `json:"LinkInfo"`
+	LocationInfo LocationInfo    `json:"LocationInfo"`
+	Items        []WeChatMessage `json:"Items"`
+	Tags         []string        `json:"Tags"`
+}
+
+type FavItemList struct {
+	KeyWord string    `json:"KeyWord"`
+	Total   int       `json:"Total"`
+	Rows    []FavItem `json:"Rows"`
+}
+
+type FavTag struct {
+	TagName string `json:"TagName"`
+	Count   int    `json:"Count"`
+}
+
+type FavTagList struct {
+	Total int      `json:"Total"`
+	Tags  []FavTag `json:"Tags"`
+}
+
+type FavoriteProvider struct {
+	db       *sql.DB
+	data     *WechatDataProvider
+	items    []FavItem
+	itemsMtx sync.Mutex
+	files    map[string]string
+	tagNames []string
+}
+
+// WeChatGetFavoriteProvider 第一次使用时打开Favorite.db, 随WechatDataProvider一起关闭
+func (P *WechatDataProvider) WeChatGetFavoriteProvider() (*FavoriteProvider, error) {
+	P.favMtx.Lock()
+	defer P.favMtx.Unlock()
+	if P.fav != nil {
+		return P.fav, nil
+	}
+
+	favDBPath := P.dbPath + "\\Msg\\" + FavoriteDB
+	if _, err := os.Stat(favDBPath); err != nil {
+		log.Println("no exist:", favDBPath)
+		return nil, err
+	}
+	db, err := openBackupDataBase(favDBPath)
+	if err != nil {
+		log.Printf("open db %s error: %v", favDBPath, err)
+		return nil, err
+	}
+
+	P.fav = &FavoriteProvider{db: db, data: P}
+	return P.fav, nil
+}
+
+func (F *FavoriteProvider) Close() {
+	if F.db != nil {
+		if err := closeDataBase(F.db); err != nil {
+			log.Println("db close:", err)
+		}
+	}
+}
+
+// FavGetList 按更新时间倒序分页, favType为0时不限类型, tag为空时不限标签
+func (F *FavoriteProvider) FavGetList(favType int, tag string, pageIndex int, pageSize int) (*FavItemList, error) {
+	List := &FavItemList{}
+	List.Rows = make([]FavItem, 0)
+
+	start := pageIndex * pageSize
+	index := 0
+	for _, item := range F.favGetAllItems() {
+		if favType != 0 && item.Type != favType {
+			continue
+		}
+		if len(tag) > 0 && !favHasTag(&item, tag) {
+			continue
+		}
+		if index >= start && List.Total < pageSize {
+			List.Rows = append(List.Rows, item)
+			List.Total += 1
+		}
+		index += 1
+	}
+
+	return List, nil
+}
+
+func (F *FavoriteProvider) FavSearch(keyWord string) (*FavItemList, error) {
+	List := &FavItemList{KeyWord: keyWord}
+	List.Rows = make([]FavItem, 0)
+	if len(keyWord) == 0 {
+		return List, nil
+	}
+
+	for _, item := range F.favGetAllItems() {
+		if favItemContains(&item, keyWord) {
+			List.Rows = append(List.Rows, item)
+			List.Total += 1
+		}
+	}
+
+	return List, nil
+}
+
+func (F *FavoriteProvider) FavGetTagList() (*FavTagList, error) {
+	List := &FavTagList{}
+	List.Tags = make([]FavTag, 0)
+
+	counts := make(map[string]int)
+	for _, item := range F.favGetAllItems() {
+		for _, tag := range item.Tags {
+			counts[tag] += 1
+		}
+	}
+	// 没有收藏使用的标签也列出来
+	for _, tagName := range F.tagNames {
+		if _, exists := counts[tagName]; !exists {
+			counts[tagName] = 0
+		}
+	}
+
+	for tagName, count := range counts {
+		List.Tags = append(List.Tags, FavTag{TagName: tagName, Count: count})
+	}
+	sort.Slice(List.Tags, func(i, j int) bool { return List.Tags[i].TagName < List.Tags[j].TagName })
+	List.Total = len(List.Tags)
+
+	return List, nil
+}
+
+func favHasTag(item *FavItem, tag string) bool {
+	for _, t := range item.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func favItemContains(item *FavItem, keyWord string) bool {
+	if strings.Contains(item.Title, keyWord) || strings.Contains(item.Desc, keyWord) ||
+		strings.Contains(item.FromNickName, keyWord) || strings.Contains(item.LinkInfo.Title, keyWord) ||
+		strings.Contains(item.LocationInfo.PoiName, keyWord) || favHasTag(item, keyWord) {
+		return true
+	}
+	for i := range item.Items {
+		msg := &item.Items[i]
+		if strings.Contains(msg.Content, keyWord) || weChatMessageContains(msg, keyWord) {
+			return true
+		}
+	}
+	return false
+}
+
+func (F *FavoriteProvider) favGetAllItems() []FavItem {
+	F.itemsMtx.Lock()
+	defer F.itemsMtx.Unlock()
+	if F.items != nil {
+		return F.items
+	}
+
+	F.favIndexFiles()
+	tags := F.favGetTags()
+	dataItems := F.favGetDataItems()
+	items := make([]FavItem, 0)
+	querySql := "select * from FavItems order by UpdateTime desc;"
+	rows, err := F.db.Query(querySql)
+	if err != nil {
+		log.Printf("%s failed %v\n", querySql, err)
+		return items
+	}
+	defer rows.Close()
+
+	// FavItems的列在不同版本里不完全一样, 按列名取值
+	columns, err := rows.Columns()
+	if err != nil {
+		log.Println("rows.Columns failed", err)
+		return items
+	}
+	for rows.Next() {
+		row, err := wechatScanRowMap(rows, columns)
+		if err != nil {
+			log.Println("rows.Scan failed", err)
+			break
+		}
+
+		item := FavItem{}
+		item.FavId, _ = strconv.ParseInt(wechatColumnString(row, "favlocalid", "localid"), 10, 64)
+		item.Type, _ = strconv.Atoi(wechatColumnString(row, "type"))
+		item.FromUser = wechatColumnString(row, "fromuser")
+		item.RealChatName = wechatColumnString(row, "realchatname")
+		item.UpdateTime, _ = strconv.ParseInt(wechatColumnString(row, "updatetime"), 10, 64)
+		item.Tags = tags[item.FavId]
+		F.favItemParse(&item, wechatColumnString(row, "xmlbuf", "xml"), dataItems[item.FavId])
+		if len(item.FromUser) > 0 {
+			item.FromNickName = F.data.wechatDisplayName(item.FromUser)
+		}
+		items = append(items, item)
+	}
+
+	log.Println("favGetAllItems:", len(items))
+	F.items = items
+	return items
+}
+
+// favGetTags 标签名在FavTagDatas里, 收藏和标签的对应关系在FavBindTagDatas里, 返回每个收藏的标签
+func (F *FavoriteProvider) favGetTags() map[int64][]string {
+	names := make(map[string]string)
+	F.tagNames = make([]string, 0)
+	favWalkTable(F.db, "select * from FavTagDatas;", func(row map[string]interface{}) {
+		tagName := wechatColumnString(row, "tagname", "name")
+		if len(tagName) == 0 {
+			return
+		}
+		names[wechatColumnString(row, "localid", "taglocalid")] = tagName
+		F.tagNames = append(F.tagNames, tagName)
+	})
+
+	tags := make(map[int64][]string)
+	favWalkTable(F.db, "select * from FavBindTagDatas order by FavLocalID, rowid;", func(row map[string]interface{}) {
+		favId, _ := strconv.ParseInt(wechatColumnString(row, "favlocalid"), 10, 64)
+		if tagName, exists := names[wechatColumnString(row, "taglocalid")]; exists {
+			tags[favId] = append(tags[favId], tagName)
+		}
+	})
+
+	log.Println("favGetTags:", len(F.tagNames), len(tags))
+	return tags
+}
+
+// favGetDataItems FavDataItem里每行是收藏里的一项内容, 按FavLocalID分组, 转成和xml里一样的dataitem元素
+func (F *FavoriteProvider) favGetDataItems() map[int64][]*etree.Element {
+	dataItems := make(map[int64][]*etree.Element)
+	favWalkTable(F.db, "select * from FavDataItem order by FavLocalID, rowid;", func(row map[string]interface{}) {
+		favId, _ := strconv.ParseInt(wechatColumnString(row, "favlocalid"), 10, 64)
+		dataItem := etree.NewElement("dataitem")
+		dataItem.CreateAttr("datatype", wechatColumnString(row, "type"))
+		dataItem.CreateAttr("dataid", wechatColumnString(row, "dataid"))
+		for _, field := range [][2]string{{"datatitle", "datatitle"}, {"datadesc", "datadesc"}, {"datafmt", "datafmt"}, {"datasize", "fullsize"}, {"sourcename", "sourcename"}} {
+			if value := wechatColumnString(row, field[1]); len(value) > 0 {
+				dataItem.CreateElement(field[0]).SetText(value)
+			}
+		}
+		dataItems[favId] = append(dataItems[favId], dataItem)
+	})
+	return dataItems
+}
+
+// favWalkTable 不同版本的表不一定都有, 查询失败只记录日志
+func favWalkTable(db *sql.DB, querySql string, handle func(row map[string]interface{})) {
+	rows, err := db.Query(querySql)
+	if err != nil {
+		log.Printf("%s failed %v\n", querySql, err)
+		return
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		log.Println("rows.Columns failed", err)
+		return
+	}
+	for rows.Next() {
+		row, err := wechatScanRowMap(rows, columns)
+		if err != nil {
+			log.Println("rows.Scan failed", err)
+			return
+		}
+		handle(row)
+	}
+}
+
+// favItemParse dataRows是FavDataItem里这个收藏的内容, xml里有同一个dataid的项时用xml里更完整的内容
+func (F *FavoriteProvider) favItemParse(item *FavItem, content string, dataRows []*etree.Element) {
+	item.Items = make([]WeChatMessage, 0)
+	if item.Tags == nil {
+		item.Tags = make([]string, 0)
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(content); err != nil {
+		log.Println("ReadFromString failed:", err)
+		return
+	}
+	favitem := doc.FindElement("//favitem")
+	if favitem == nil {
+		favitem = etree.NewElement("favitem")
+	}
+
+	if item.Type == 0 {
+		item.Type, _ = strconv.Atoi(favitem.SelectAttrValue("type", "0"))
+	}
+	item.Title = forwardElementValue(favitem, "title")
+	item.Desc = forwardElementValue(favitem, "desc")
+	if len(item.FromUser) == 0 {
+		item.FromUser = forwardElementValue(favitem, "source/fromusr")
+	}
+	if len(item.RealChatName) == 0 {
+		item.RealChatName = forwardElementValue(favitem, "source/realchatname")
+	}
+	item.CreateTime, _ = strconv.ParseInt(forwardElementValue(favitem, "source/createtime"), 10, 64)
+	if item.CreateTime == 0 {
+		item.CreateTime = item.UpdateTime
+	}
+
+	item.LinkInfo.Url = forwardElementValue(favitem, "weburlitem/clean_url")
+	if len(item.LinkInfo.Url) == 0 {
+		item.LinkInfo.Url = forwardElementValue(favitem, "source/link")
+	}
+	item.LinkInfo.Title = forwardElementValue(favitem, "weburlitem/pagetitle")
+	item.LinkInfo.Description = forwardElementValue(favitem, "weburlitem/pagedesc")
+	item.LinkInfo.DisPlayName = forwardElementValue(favitem, "weburlitem/appmsgshareitem/srcdisplayname")
+
+	item.LocationInfo.PoiName = forwardElementValue(favitem, "locitem/poiname")
+	item.LocationInfo.Label = forwardElementValue(favitem, "locitem/label")
+	item.LocationInfo.X = forwardElementValue(favitem, "locitem/lat")
+	item.LocationInfo.Y = forwardElementValue(favitem, "locitem/lng")
+
+	for _, tag := range favitem.FindElements("./taglist/tag") {
+		if len(tag.Text()) > 0 && !favHasTag(item, tag.Text()) {
+			item.Tags = append(item.Tags, tag.Text())
+		}
+	}
+
+	dataList := favitem.FindElements("./datalist/dataitem")
+	if len(dataRows) > 0 {
+		xmlItems := make(map[string]*etree.Element)
+		for _, dataItem := range dataList {
+			if dataId := dataItem.SelectAttrValue("dataid", ""); len(dataId) > 0 {
+				xmlItems[dataId] = dataItem
+			}
+		}
+		dataList = make([]*etree.Element, 0, len(dataRows))
+		for _, dataItem := range dataRows {
+			if xmlItem, exists := xmlItems[dataItem.SelectAttrValue("dataid", "")]; exists {
+				dataItem = xmlItem
+			}
+			dataList = append(dataList, dataItem)
+		}
+	}
+
+	for _, dataItem := range dataList {
+		msg := forwardDataItemParse(dataItem)
+		if msg.CreateTime == 0 {
+			msg.CreateTime = item.CreateTime
+		}
+		F.favItemMediaResolve(&msg, dataItem.SelectAttrValue("dataid", ""))
+		item.Items = append(item.Items, msg)
+	}
+
+	if len(item.Title) == 0 {
+		if len(item.LinkInfo.Title) > 0 {
+			item.Title = item.LinkInfo.Title
+		} else if len(item.Items) > 0 {
+			item.Title = wechatSessionContent(&item.Items[0])
+		}
+	}
+}
+
+// 收藏的文件放在FileStorage\Fav下, 不同版本目录层级不一样, 按文件名里的dataid查找
+func (F *FavoriteProvider) favIndexFiles() {
+	F.files = make(map[string]string)
+	favPath := F.data.resPath + "\\FileStorage\\Fav"
+	filepath.Walk(favPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(F.data.resPath, path)
+		if err != nil {
+			return nil
+		}
+
+		name := strings.TrimSuffix(info.Name(), filepath.Ext(info.Name()))
+		isThumb := strings.Contains(strings.ToLower(path), "thumb")
+		key := name
+		if pos := strings.Index(name, "_"); pos > 0 {
+			key = name[:pos]
+		}
+		if isThumb {
+			key = "thumb:" + key
+		}
+		if _, exists := F.files[key]; !exists {
+			F.files[key] = F.data.prefixResPath + "\\" + rel
+		}
+		return nil
+	})
+	log.Println("favIndexFiles:", len(F.files))
+}
+
+func (F *FavoriteProvider) favItemMediaResolve(msg *WeChatMessage, dataId string) {
+	if len(dataId) == 0 {
+		return
+	}
+	path := F.files[dataId]
+	thumb := F.files["thumb:"+dataId]
+
+	switch msg.Type {
+	case Wechat_Message_Type_Picture:
+		msg.ImagePath = path
+		msg.ThumbPath = thumb
+	case Wechat_Message_Type_Video:
+		msg.VideoPath = path
+		msg.ThumbPath = thumb
+	case Wechat_Message_Type_Voice:
+		msg.VoicePath = path
+	case Wechat_Message_Type_Misc:
+		if msg.SubType == Wechat_Misc_Message_File {
+			msg.FileInfo.FilePath = path
+		} else {
+			msg.ThumbPath = thumb
+		}
+	}
+}
+
+// FavExport 导出全部收藏到exportPath目录, 包括favorites.json, favorites.html和用到的本地文件
+func (F *FavoriteProvider) FavExport(exportPath string) error {
+	items := F.favGetAllItems()
+	if _, err := os.Stat(exportPath); err != nil {
+		if err := os.MkdirAll(exportPath, os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	topDir := filepath.Dir(filepath.Dir(F.data.resPath))
+	paths := make([]string, 0)
+	for i := range items {
+		for _, msg := range items[i].Items {
+			paths = append(paths, msg.ThumbPath, msg.ImagePath, msg.VideoPath, msg.VoicePath, msg.FileInfo.FilePath)
+			if msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_ForwardMessage {
+				paths = append(paths, wechatForwardItemPaths(msg.ForwardInfo.Items)...)
+			}
+		}
+	}
+	for _, path := range paths {
+		if len(path) == 0 || strings.HasPrefix(path, "http") {
+			continue
+		}
+		dstFile := exportPath + path
+		if _, err := os.Stat(filepath.Dir(dstFile)); err != nil {
+			os.MkdirAll(filepath.Dir(dstFile), os.ModePerm)
+		}
+		if _, err := CopyBackupFile(topDir+path, dstFile); err != nil {
+			log.Println("CopyFile failed:", err)
+		}
+	}
+
+	List := &FavItemList{Total: len(items), Rows: items}
+	data, err := json.MarshalIndent(List, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(exportPath+"\\favorites.json", data, 0644); err != nil {
+		log.Println("WriteFile failed:", err)
+		return err
+	}
+
+	return os.WriteFile(exportPath+"\\favorites.html", []byte(favItemsHTML(items)), 0644)
+}
+
+func favItemsHTML(items []FavItem) string {
+	localPath := func(path string) string {
+		if strings.HasPrefix(path, "http") {
+			return path
+		}
+		return "." + strings.ReplaceAll(path, "\\", "/")
+	}
+
+	var builder strings.Builder
+	builder.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>收藏</title>\n<style>\n")
+	builder.WriteString("body{max-width:720px;margin:0 auto;font-family:sans-serif;background:#f5f5f5}\n")
+	builder.WriteString(".fav{background:#fff;margin:12px 0;padding:12px;border-radius:6px}\n")
+	builder.WriteString(".title{font-weight:bold}.info{color:#999;font-size:12px}.tag{color:#576b95;margin-right:6px}\n")
+	builder.WriteString("img{max-width:240px;margin:2px}\n")
+	builder.WriteString("</style>\n</head>\n<body>\n")
+
+	for _, item := range items {
+		builder.WriteString("<div class=\"fav\">\n")
+		builder.WriteString(fmt.Sprintf("<div class=\"title\">%s</div>\n", html.EscapeString(item.Title)))
+		if len(item.LinkInfo.Url) > 0 {
+			builder.WriteString(fmt.Sprintf("<div><a href=\"%s\">%s</a></div>\n", html.EscapeString(item.LinkInfo.Url), html.EscapeString(item.LinkInfo.Url)))
+		}
+		if len(item.LocationInfo.PoiName) > 0 {
+			builder.WriteString(fmt.Sprintf("<div>%s %s</div>\n", html.EscapeString(item.LocationInfo.PoiName), html.EscapeString(item.LocationInfo.Label)))
+		}
+		for _, msg := range item.Items {
+			switch {
+			case msg.Type == Wechat_Message_Type_Picture && len(msg.ImagePath) > 0:
+				builder.WriteString(fmt.Sprintf("<div><img src=\"%s\"></div>\n", html.EscapeString(localPath(msg.ImagePath))))
+			case msg.Type == Wechat_Message_Type_Video && len(msg.VideoPath) > 0:
+				builder.WriteString(fmt.Sprintf("<div><video controls src=\"%s\"></video></div>\n", html.EscapeString(localPath(msg.VideoPath))))
+			case msg.Type == Wechat_Message_Type_Voice && len(msg.VoicePath) > 0:
+				builder.WriteString(fmt.Sprintf("<div><a href=\"%s\">[语音]</a></div>\n", html.EscapeString(localPath(msg.VoicePath))))
+			case msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_File && len(msg.FileInfo.FilePath) > 0:
+				builder.WriteString(fmt.Sprintf("<div><a href=\"%s\">%s</a></div>\n", html.EscapeString(localPath(msg.FileInfo.FilePath)), html.EscapeString(msg.FileInfo.FileName)))
+			case msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_ForwardMessage:
+				builder.WriteString(ForwardInfoHTML(&msg.ForwardInfo, localPath))
+			default:
+				text := msg.Content
+				if item.Type == Wechat_Fav_Type_Record {
+					text = msg.UserInfo.NickName + ": " + wechatSessionContent(&msg)
+				}
+				builder.WriteString(fmt.Sprintf("<div>%s</div>\n", strings.ReplaceAll(html.EscapeString(text), "\n", "<br>")))
+			}
+		}
+		builder.WriteString("<div class=\"info\">")
+		for _, tag := range item.Tags {
+			builder.WriteString(fmt.Sprintf("<span class=\"tag\">#%s</span>", html.EscapeString(tag)))
+		}
+		builder.WriteString(fmt.Sprintf("%s %s</div>\n", html.EscapeString(item.FromNickName), time.Unix(item.CreateTime, 0).Format("2006-01-02 15:04:05")))
+		builder.WriteString("</div>\n")
+	}
+	builder.WriteString("</body>\n</html>\n")
+
+	return builder.String()
+}
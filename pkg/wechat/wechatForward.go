@@ -0,0 +1,261 @@
+package wechat
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+	"wechatDataBackup/pkg/utils"
+
+	"github.com/beevik/etree"
+	"github.com/pierrec/lz4"
+)
+
+// 聊天记录(recorditem)中dataitem的datatype
+const (
+	Wechat_Record_Data_Text     = 1
+	Wechat_Record_Data_Image    = 2
+	Wechat_Record_Data_Voice    = 3
+	Wechat_Record_Data_Video    = 4
+	Wechat_Record_Data_Link     = 5
+	Wechat_Record_Data_Location = 6
+	Wechat_Record_Data_File     = 8
+	Wechat_Record_Data_Card     = 16
+	Wechat_Record_Data_Record   = 17
+	Wechat_Record_Data_Applet   = 19
+	Wechat_Record_Data_Channels = 22
+)
+
+type ForwardInfo struct {
+	Title string          `json:"Title"`
+	Desc  string          `json:"Desc"`
+	Items []WeChatMessage `json:"Items"`
+}
+
+// UncompressContent 解压MSG表中的CompressContent, 去掉结尾的'\0'
+func UncompressContent(compressContent []byte) ([]byte, error) {
+	if len(compressContent) == 0 {
+		return nil, fmt.Errorf("empty content")
+	}
+
+	size := len(compressContent) * 10
+	for i := 0; i < 4; i++ {
+		unCompressContent := make([]byte, size)
+		ulen, err := lz4.UncompressBlock(compressContent, unCompressContent)
+		if err == lz4.ErrInvalidSourceShortBuffer {
+			size *= 4
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return []byte(strings.TrimRight(string(unCompressContent[:ulen]), "\x00")), nil
+	}
+
+	return nil, lz4.ErrInvalidSourceShortBuffer
+}
+
+// ParseForwardInfo 解析合并转发(subtype 19)消息的appmsg xml, 嵌套的聊天记录会递归展开
+func ParseForwardInfo(content string) ForwardInfo {
+	info := ForwardInfo{Items: make([]WeChatMessage, 0)}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(content); err != nil {
+		return info
+	}
+	root := NewxmlDocument(doc)
+	info.Title = root.FindElementValue("/msg/appmsg/title")
+	info.Desc = root.FindElementValue("/msg/appmsg/des")
+
+	record := root.FindElementValue("/msg/appmsg/recorditem")
+	if len(record) == 0 {
+		return info
+	}
+
+	recordDoc := etree.NewDocument()
+	if err := recordDoc.ReadFromString(record); err != nil {
+		return info
+	}
+	if recordInfo := recordDoc.FindElement("//recordinfo"); recordInfo != nil {
+		forwardRecordParse(recordInfo, &info)
+	}
+
+	return info
+}
+
+func forwardRecordParse(recordInfo *etree.Element, info *ForwardInfo) {
+	if len(info.Title) == 0 {
+		info.Title = forwardElementValue(recordInfo, "title")
+	}
+	if len(info.Desc) == 0 {
+		info.Desc = forwardElementValue(recordInfo, "desc")
+	}
+
+	for _, item := range recordInfo.FindElements("./datalist/dataitem") {
+		info.Items = append(info.Items, forwardDataItemParse(item))
+	}
+}
+
+func forwardDataItemParse(item *etree.Element) WeChatMessage {
+	msg := WeChatMessage{}
+	msg.MsgSvrId = forwardElementValue(item, "fromnewmsgid")
+	msg.Content = forwardElementValue(item, "datadesc")
+	msg.UserInfo.NickName = forwardElementValue(item, "sourcename")
+	msg.UserInfo.SmallHeadImgUrl = forwardElementValue(item, "sourceheadurl")
+	msg.UserInfo.UserName = forwardElementValue(item, "dataitemsource/realchatname")
+	if len(msg.UserInfo.UserName) == 0 {
+		msg.UserInfo.UserName = forwardElementValue(item, "dataitemsource/fromusr")
+	}
+
+	msg.CreateTime, _ = strconv.ParseInt(forwardElementValue(item, "srcMsgCreateTime"), 10, 64)
+	if msg.CreateTime == 0 {
+		msg.CreateTime = forwardParseTime(forwardElementValue(item, "sourcetime"))
+	}
+
+	title := forwardElementValue(item, "datatitle")
+	dataType, _ := strconv.Atoi(item.SelectAttrValue("datatype", "1"))
+	switch dataType {
+	case Wechat_Record_Data_Image:
+		msg.Type = Wechat_Message_Type_Picture
+	case Wechat_Record_Data_Voice:
+		msg.Type = Wechat_Message_Type_Voice
+	case Wechat_Record_Data_Video:
+		msg.Type = Wechat_Message_Type_Video
+	case Wechat_Record_Data_Location:
+		msg.Type = Wechat_Message_Type_Location
+		msg.LocationInfo.PoiName = forwardElementValue(item, "locitem/poiname")
+		msg.LocationInfo.Label = forwardElementValue(item, "locitem/label")
+		msg.LocationInfo.X = forwardElementValue(item, "locitem/lat")
+		msg.LocationInfo.Y = forwardElementValue(item, "locitem/lng")
+	case Wechat_Record_Data_Card:
+		msg.Type = Wechat_Message_Type_Visit_Card
+		attr := utils.HtmlMsgGetAttr(msg.Content, "msg")
+		msg.VisitInfo.UserName = attr["username"]
+		msg.VisitInfo.Alias = attr["alias"]
+		msg.VisitInfo.NickName = attr["nickname"]
+		msg.VisitInfo.SmallHeadImgUrl = attr["smallheadimgurl"]
+		msg.VisitInfo.BigHeadImgUrl = attr["bigheadimgurl"]
+		msg.Content = msg.VisitInfo.NickName
+	case Wechat_Record_Data_Link:
+		msg.Type = Wechat_Message_Type_Misc
+		msg.SubType = Wechat_Misc_Message_CardLink
+		msg.LinkInfo.Title = title
+		msg.LinkInfo.Description = msg.Content
+		msg.LinkInfo.Url = forwardElementValue(item, "link")
+		if len(msg.LinkInfo.Url) == 0 {
+			msg.LinkInfo.Url = forwardElementValue(item, "weburlitem/link")
+		}
+		msg.LinkInfo.DisPlayName = forwardElementValue(item, "weburlitem/appmsgshareitem/srcdisplayname")
+	case Wechat_Record_Data_File:
+		msg.Type = Wechat_Message_Type_Misc
+		msg.SubType = Wechat_Misc_Message_File
+		msg.FileInfo.FileName = title
+		msg.FileInfo.FileExt = forwardElementValue(item, "datafmt")
+		msg.FileInfo.FileSize = forwardElementValue(item, "datasize")
+	case Wechat_Record_Data_Record:
+		msg.Type = Wechat_Message_Type_Misc
+		msg.SubType = Wechat_Misc_Message_ForwardMessage
+		msg.ForwardInfo.Title = title
+		msg.ForwardInfo.Desc = msg.Content
+		msg.ForwardInfo.Items = make([]WeChatMessage, 0)
+		if recordInfo := item.FindElement("./recordxml/recordinfo"); recordInfo != nil {
+			forwardRecordParse(recordInfo, &msg.ForwardInfo)
+		} else if recordXML := forwardElementValue(item, "recordxml"); len(recordXML) > 0 {
+			recordDoc := etree.NewDocument()
+			if err := recordDoc.ReadFromString(recordXML); err == nil {
+				if recordInfo := recordDoc.FindElement("//recordinfo"); recordInfo != nil {
+					forwardRecordParse(recordInfo, &msg.ForwardInfo)
+				}
+			}
+		}
+		msg.Content = msg.ForwardInfo.Title
+	case Wechat_Record_Data_Applet:
+		msg.Type = Wechat_Message_Type_Misc
+		msg.SubType = Wechat_Misc_Message_Applet
+		msg.LinkInfo.Title = title
+		msg.LinkInfo.DisPlayName = forwardElementValue(item, "appbranditem/sourcedisplayname")
+	case Wechat_Record_Data_Channels:
+		msg.Type = Wechat_Message_Type_Misc
+		msg.SubType = Wechat_Misc_Message_Channels
+		msg.ChannelsInfo.NickName = forwardElementValue(item, "finderFeed/nickname")
+		msg.ChannelsInfo.Description = forwardElementValue(item, "finderFeed/desc")
+		msg.ChannelsInfo.ThumbPath = forwardElementValue(item, "finderFeed/mediaList/media/thumbUrl")
+	default:
+		msg.Type = Wechat_Message_Type_Text
+	}
+
+	if len(msg.Content) == 0 {
+		msg.Content = title
+	}
+
+	return msg
+}
+
+func forwardElementValue(e *etree.Element, path string) string {
+	if item := e.FindElement("./" + path); item != nil {
+		return item.Text()
+	}
+	return ""
+}
+
+func forwardParseTime(sourceTime string) int64 {
+	layouts := []string{"2006-1-2 15:04:05", "2006-1-2 15:04", "1-2 15:04", "15:04"}
+	for _, layout := range layouts {
+		t, err := time.ParseInLocation(layout, sourceTime, time.Local)
+		if err == nil {
+			return t.Unix()
+		}
+	}
+	return 0
+}
+
+// ForwardInfoText 把聊天记录展开成多行文本, 嵌套的记录按层级缩进
+func ForwardInfoText(info *ForwardInfo, indent string) string {
+	var builder strings.Builder
+	for i := range info.Items {
+		item := &info.Items[i]
+		builder.WriteString(fmt.Sprintf("%s%s %s: ", indent, time.Unix(item.CreateTime, 0).Format("2006-01-02 15:04:05"), item.UserInfo.NickName))
+		if item.Type == Wechat_Message_Type_Misc && item.SubType == Wechat_Misc_Message_ForwardMessage {
+			builder.WriteString("[聊天记录] " + item.ForwardInfo.Title + "\n")
+			builder.WriteString(ForwardInfoText(&item.ForwardInfo, indent+"    "))
+			continue
+		}
+		builder.WriteString(ForwardItemText(item) + "\n")
+	}
+	return builder.String()
+}
+
+// ForwardItemText 聊天记录里一条消息的简短文本
+func ForwardItemText(item *WeChatMessage) string {
+	return wechatSessionContent(item)
+}
+
+// ForwardInfoHTML 把聊天记录展开成html, 嵌套的记录放在里层的div里, localPath把消息里的文件路径转成页面里的链接
+func ForwardInfoHTML(info *ForwardInfo, localPath func(string) string) string {
+	var builder strings.Builder
+	builder.WriteString("<div class=\"record\" style=\"border-left:3px solid #ddd;padding-left:8px;margin:4px 0\">\n")
+	builder.WriteString(fmt.Sprintf("<div class=\"title\">%s</div>\n", html.EscapeString(info.Title)))
+	for i := range info.Items {
+		item := &info.Items[i]
+		builder.WriteString(fmt.Sprintf("<div class=\"info\">%s %s</div>\n", html.EscapeString(item.UserInfo.NickName), time.Unix(item.CreateTime, 0).Format("2006-01-02 15:04:05")))
+		switch {
+		case item.Type == Wechat_Message_Type_Misc && item.SubType == Wechat_Misc_Message_ForwardMessage:
+			builder.WriteString(ForwardInfoHTML(&item.ForwardInfo, localPath))
+		case item.Type == Wechat_Message_Type_Picture && len(item.ImagePath) > 0:
+			builder.WriteString(fmt.Sprintf("<div><img src=\"%s\"></div>\n", html.EscapeString(localPath(item.ImagePath))))
+		case item.Type == Wechat_Message_Type_Video && len(item.VideoPath) > 0:
+			builder.WriteString(fmt.Sprintf("<div><video controls src=\"%s\"></video></div>\n", html.EscapeString(localPath(item.VideoPath))))
+		case item.Type == Wechat_Message_Type_Voice && len(item.VoicePath) > 0:
+			builder.WriteString(fmt.Sprintf("<div><a href=\"%s\">[语音]</a></div>\n", html.EscapeString(localPath(item.VoicePath))))
+		case item.Type == Wechat_Message_Type_Misc && item.SubType == Wechat_Misc_Message_File && len(item.FileInfo.FilePath) > 0:
+			builder.WriteString(fmt.Sprintf("<div><a href=\"%s\">%s</a></div>\n", html.EscapeString(localPath(item.FileInfo.FilePath)), html.EscapeString(item.FileInfo.FileName)))
+		case item.Type == Wechat_Message_Type_Misc && len(item.LinkInfo.Url) > 0:
+			builder.WriteString(fmt.Sprintf("<div><a href=\"%s\">%s</a></div>\n", html.EscapeString(item.LinkInfo.Url), html.EscapeString(item.LinkInfo.Title)))
+		default:
+			builder.WriteString(fmt.Sprintf("<div>%s</div>\n", strings.ReplaceAll(html.EscapeString(ForwardItemText(item)), "\n", "<br>")))
+		}
+	}
+	builder.WriteString("</div>\n")
+	return builder.String()
+}
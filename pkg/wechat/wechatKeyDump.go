@@ -0,0 +1,307 @@
+package wechat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+// 离线内存转储里找数据库key: 支持Windows的minidump(procdump -ma, 任务管理器创建转储文件),
+// 也支持从某个地址开始的原始内存, 这时需要自己给出WeChatWin.dll的基址和大小
+
+const (
+	miniDumpSignature    = "MDMP"
+	miniDumpModuleList   = 4
+	miniDumpMemoryList   = 5
+	miniDumpMemory64List = 9
+	miniDumpModuleSize   = 108
+	wechatModuleName     = "WeChatWin.dll"
+)
+
+type DumpModule struct {
+	Name     string
+	BaseAddr uint64
+	Size     uint32
+	Version  string
+}
+
+type dumpRegion struct {
+	addr   uint64
+	size   uint64
+	offset int64
+}
+
+// MemoryDump 按虚拟地址读取转储文件里的内存
+type MemoryDump struct {
+	file     *os.File
+	fileSize int64
+	regions  []dumpRegion
+	Modules  []DumpModule
+	Is64Bits bool
+}
+
+// OpenMemoryDump 识别minidump文件, 不是minidump时当作从baseAddr开始的原始内存
+func OpenMemoryDump(path string, baseAddr uint64, is64Bits bool) (*MemoryDump, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	header := make([]byte, 32)
+	if _, err := io.ReadFull(file, header); err == nil && string(header[:4]) == miniDumpSignature {
+		dump := &MemoryDump{file: file, fileSize: fileInfo.Size()}
+		if err := dump.parseMiniDump(header); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return dump, nil
+	}
+
+	dump := &MemoryDump{file: file, fileSize: fileInfo.Size(), Is64Bits: is64Bits}
+	dump.regions = append(dump.regions, dumpRegion{addr: baseAddr, size: uint64(fileInfo.Size())})
+	return dump, nil
+}
+
+func (d *MemoryDump) Close() error {
+	return d.file.Close()
+}
+
+// readAt 大小和偏移都来自转储文件本身, 先和文件大小比较, 损坏的文件不会申请超大的内存
+func (d *MemoryDump) readAt(offset int64, size uint64) ([]byte, error) {
+	if offset < 0 || offset > d.fileSize || size > uint64(d.fileSize-offset) {
+		return nil, fmt.Errorf("read 0x%X bytes at 0x%X out of dump file", size, offset)
+	}
+	buffer := make([]byte, size)
+	if _, err := d.file.ReadAt(buffer, offset); err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// parseMiniDump 只解析用得到的流: 模块列表和内存列表
+func (d *MemoryDump) parseMiniDump(header []byte) error {
+	streams := binary.LittleEndian.Uint32(header[8:12])
+	directoryRva := binary.LittleEndian.Uint32(header[12:16])
+	directory, err := d.readAt(int64(directoryRva), uint64(streams)*12)
+	if err != nil {
+		return fmt.Errorf("read minidump directory failed: %v", err)
+	}
+
+	for i := 0; i < int(streams); i++ {
+		entry := directory[i*12 : (i+1)*12]
+		streamType := binary.LittleEndian.Uint32(entry[0:4])
+		rva := int64(binary.LittleEndian.Uint32(entry[8:12]))
+
+		switch streamType {
+		case miniDumpModuleList:
+			err = d.parseModuleList(rva)
+		case miniDumpMemoryList:
+			err = d.parseMemoryList(rva)
+		case miniDumpMemory64List:
+			err = d.parseMemory64List(rva)
+		}
+		if err != nil {
+			return fmt.Errorf("parse minidump stream %d failed: %v", streamType, err)
+		}
+	}
+
+	if len(d.regions) == 0 {
+		return errors.New("minidump has no memory")
+	}
+	return nil
+}
+
+func (d *MemoryDump) parseModuleList(rva int64) error {
+	buffer, err := d.readAt(rva, 4)
+	if err != nil {
+		return err
+	}
+	count := binary.LittleEndian.Uint32(buffer)
+	modules, err := d.readAt(rva+4, uint64(count)*miniDumpModuleSize)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < int(count); i++ {
+		module := modules[i*miniDumpModuleSize : (i+1)*miniDumpModuleSize]
+		dumpModule := DumpModule{
+			BaseAddr: binary.LittleEndian.Uint64(module[0:8]),
+			Size:     binary.LittleEndian.Uint32(module[8:12]),
+		}
+		nameRva := int64(binary.LittleEndian.Uint32(module[20:24]))
+		if name, err := d.readMiniDumpString(nameRva); err == nil {
+			dumpModule.Name = name
+		}
+		// VS_FIXEDFILEINFO, 和GetWeChatInfo里读到的版本号格式一样
+		if binary.LittleEndian.Uint32(module[24:28]) == 0xFEEF04BD {
+			versionMS := binary.LittleEndian.Uint32(module[32:36])
+			versionLS := binary.LittleEndian.Uint32(module[36:40])
+			dumpModule.Version = fmt.Sprintf("%d.%d.%d.%d",
+				(versionMS>>16)&0xff, (versionMS>>0)&0xff, (versionLS>>16)&0xff, (versionLS>>0)&0xff)
+		}
+		d.Modules = append(d.Modules, dumpModule)
+	}
+	return nil
+}
+
+func (d *MemoryDump) readMiniDumpString(rva int64) (string, error) {
+	buffer, err := d.readAt(rva, 4)
+	if err != nil {
+		return "", err
+	}
+	length := binary.LittleEndian.Uint32(buffer)
+	buffer, err = d.readAt(rva+4, uint64(length))
+	if err != nil {
+		return "", err
+	}
+
+	chars := make([]uint16, len(buffer)/2)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(buffer[i*2:])
+	}
+	return string(utf16.Decode(chars)), nil
+}
+
+func (d *MemoryDump) parseMemoryList(rva int64) error {
+	buffer, err := d.readAt(rva, 4)
+	if err != nil {
+		return err
+	}
+	count := binary.LittleEndian.Uint32(buffer)
+	descriptors, err := d.readAt(rva+4, uint64(count)*16)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < int(count); i++ {
+		descriptor := descriptors[i*16 : (i+1)*16]
+		d.regions = append(d.regions, dumpRegion{
+			addr:   binary.LittleEndian.Uint64(descriptor[0:8]),
+			size:   uint64(binary.LittleEndian.Uint32(descriptor[8:12])),
+			offset: int64(binary.LittleEndian.Uint32(descriptor[12:16])),
+		})
+	}
+	return nil
+}
+
+// parseMemory64List 完整转储用这个流, 所有内存块的数据从baseRva开始依次存放
+func (d *MemoryDump) parseMemory64List(rva int64) error {
+	buffer, err := d.readAt(rva, 16)
+	if err != nil {
+		return err
+	}
+	count := binary.LittleEndian.Uint64(buffer[0:8])
+	offset := int64(binary.LittleEndian.Uint64(buffer[8:16]))
+	if count > uint64(d.fileSize)/16 {
+		return fmt.Errorf("invalid memory64 count %d", count)
+	}
+	descriptors, err := d.readAt(rva+16, count*16)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < int(count); i++ {
+		descriptor := descriptors[i*16 : (i+1)*16]
+		region := dumpRegion{
+			addr:   binary.LittleEndian.Uint64(descriptor[0:8]),
+			size:   binary.LittleEndian.Uint64(descriptor[8:16]),
+			offset: offset,
+		}
+		d.regions = append(d.regions, region)
+		offset += int64(region.size)
+	}
+	return nil
+}
+
+// ReadMemory 读取的范围必须完整地在转储的内存里, 跨越相邻的内存块也可以
+func (d *MemoryDump) ReadMemory(addr uint64, buffer []byte) error {
+	done := 0
+	for done < len(buffer) {
+		region := d.findRegion(addr + uint64(done))
+		if region == nil {
+			return fmt.Errorf("address 0x%X not in dump", addr+uint64(done))
+		}
+		start := addr + uint64(done) - region.addr
+		size := min(uint64(len(buffer)-done), region.size-start)
+		if _, err := d.file.ReadAt(buffer[done:done+int(size)], region.offset+int64(start)); err != nil {
+			return err
+		}
+		done += int(size)
+	}
+	return nil
+}
+
+func (d *MemoryDump) findRegion(addr uint64) *dumpRegion {
+	for i := range d.regions {
+		if addr >= d.regions[i].addr && addr-d.regions[i].addr < d.regions[i].size {
+			return &d.regions[i]
+		}
+	}
+	return nil
+}
+
+func (d *MemoryDump) FindModule(name string) *DumpModule {
+	for i := range d.Modules {
+		if strings.EqualFold(filepath.Base(strings.ReplaceAll(d.Modules[i].Name, "\\", "/")), name) {
+			return &d.Modules[i]
+		}
+	}
+	return nil
+}
+
+// WeChatInfo 用转储里WeChatWin.dll的模块信息填充info, 原始内存没有模块信息时要自己设置DllBaseAddr和DllBaseSize
+func (d *MemoryDump) WeChatInfo(info *WeChatInfo) error {
+	info.Is64Bits = d.Is64Bits
+	if module := d.FindModule(wechatModuleName); module != nil {
+		info.DllBaseAddr = uintptr(module.BaseAddr)
+		info.DllBaseSize = module.Size
+		info.Version = module.Version
+		// 64位系统上32位进程的转储里系统信息也是64位的, 按模块加载的地址判断
+		info.Is64Bits = module.BaseAddr > 0xFFFFFFFF
+	}
+	if info.DllBaseSize == 0 {
+		return fmt.Errorf("%s not found in dump", wechatModuleName)
+	}
+	// 整个模块会读到内存里, 不能比转储文件还大
+	if int64(info.DllBaseSize) > d.fileSize {
+		return fmt.Errorf("%s size 0x%X larger than dump", wechatModuleName, info.DllBaseSize)
+	}
+	return nil
+}
+
+// GetWeChatKeyFromDump 和GetWeChatKey的查找方式一样, 候选key用拷贝出来的Media.db或MicroMsg.db校验
+func GetWeChatKeyFromDump(dump *MemoryDump, info *WeChatInfo, dbPath string) (string, *KeySearchReport, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return "", nil, err
+	}
+	if err := dump.WeChatInfo(info); err != nil {
+		return "", nil, err
+	}
+
+	key, report := searchDBKey(dump, info, dbPath, dumpCipherProfile(info.Version))
+	if len(key) == 0 {
+		return "", report, errors.New(report.Reason)
+	}
+	return key, report, nil
+}
+
+// dumpCipherProfile 按转储里的微信版本只校验对应的加密参数, 版本未知时返回nil两种都试
+func dumpCipherProfile(version string) *CipherProfile {
+	if strings.HasPrefix(version, "3.") {
+		return &CipherProfileV3
+	} else if strings.HasPrefix(version, "4.") {
+		return &CipherProfileV4
+	}
+	return nil
+}
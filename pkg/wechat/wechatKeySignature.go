@@ -0,0 +1,218 @@
+package wechat
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 找key的特征按微信版本配置, 新版本特征变了可以改KeySignatures.json, 不用重新编译
+
+const KeySignatureFile = "KeySignatures.json"
+
+// KeySignature 一种找key的方式: 在WeChatWin.dll里找Patterns中的任意一个,
+// 再往前找一个指针, 指针后面第MarkerSlot个指针大小的位置是key的长度KeyLen
+type KeySignature struct {
+	Name string `json:"Name"`
+	// 适用的WeChatWin.dll版本范围, 为空表示不限
+	MinVersion string `json:"MinVersion"`
+	MaxVersion string `json:"MaxVersion"`
+	// 十六进制的特征字节
+	Patterns   []string `json:"Patterns"`
+	MarkerSlot int      `json:"MarkerSlot"`
+	KeyLen     uint64   `json:"KeyLen"`
+	// 只在特征前面这么多字节内找指针, 0表示一直找到上一个特征
+	MaxDistance int `json:"MaxDistance"`
+
+	patterns [][]byte
+}
+
+type KeySignatureTable struct {
+	Signatures []KeySignature `json:"Signatures"`
+}
+
+// DefaultKeySignatures 设备类型字符串前面是登录信息, 里面有指向key的指针
+var DefaultKeySignatures = KeySignatureTable{
+	Signatures: []KeySignature{
+		{
+			Name: "device-type",
+			Patterns: []string{
+				"616e64726f696400000000000000000007000000", // android
+				"7061642d616e64726f696400000000000b000000", // pad-android
+				"6970686f6e650000000000000000000006000000", // iphone
+				"6970616400000000000000000000000004000000", // ipad
+				"4f484f5300000000000000000000000004000000", // OHOS
+			},
+			MarkerSlot: 1,
+			KeyLen:     0x20,
+		},
+	},
+}
+
+var keySignatures = DefaultKeySignatures
+var keySignatureMtx sync.Mutex
+
+// LoadKeySignatures 从json文件加载找key的特征, 替换内置的特征
+func LoadKeySignatures(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	table := KeySignatureTable{}
+	if err := json.Unmarshal(data, &table); err != nil {
+		return err
+	}
+	if len(table.Signatures) == 0 {
+		return errors.New("no key signature")
+	}
+	for i := range table.Signatures {
+		if err := table.Signatures[i].decode(); err != nil {
+			return err
+		}
+	}
+
+	keySignatureMtx.Lock()
+	keySignatures = table
+	keySignatureMtx.Unlock()
+	return nil
+}
+
+// GetKeySignatures 返回当前使用的特征, 可以保存成json再修改
+func GetKeySignatures() KeySignatureTable {
+	keySignatureMtx.Lock()
+	defer keySignatureMtx.Unlock()
+	return keySignatures
+}
+
+func (s *KeySignature) decode() error {
+	if len(s.Patterns) == 0 {
+		return fmt.Errorf("key signature %s has no pattern", s.Name)
+	}
+	s.patterns = make([][]byte, 0, len(s.Patterns))
+	for _, pattern := range s.Patterns {
+		buffer, err := hex.DecodeString(strings.ReplaceAll(pattern, " ", ""))
+		if err != nil || len(buffer) == 0 {
+			return fmt.Errorf("key signature %s invalid pattern %s", s.Name, pattern)
+		}
+		s.patterns = append(s.patterns, buffer)
+	}
+	if s.MarkerSlot <= 0 {
+		s.MarkerSlot = 1
+	}
+	if s.KeyLen == 0 {
+		s.KeyLen = keySize
+	}
+	return nil
+}
+
+// keySignaturesForVersion 按顺序返回适用于这个版本的特征, 版本未知时全部返回
+func keySignaturesForVersion(version string) []KeySignature {
+	table := GetKeySignatures()
+	signatures := make([]KeySignature, 0, len(table.Signatures))
+	for _, signature := range table.Signatures {
+		if len(version) > 0 && len(signature.MinVersion) > 0 && compareVersion(version, signature.MinVersion) < 0 {
+			continue
+		}
+		if len(version) > 0 && len(signature.MaxVersion) > 0 && compareVersion(version, signature.MaxVersion) > 0 {
+			continue
+		}
+		if signature.decode() != nil {
+			continue
+		}
+		signatures = append(signatures, signature)
+	}
+	return signatures
+}
+
+// compareVersion 按点分隔逐段比较数字, 缺少的段当作0
+func compareVersion(a, b string) int {
+	partsA := strings.Split(a, ".")
+	partsB := strings.Split(b, ".")
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var numA, numB int
+		if i < len(partsA) {
+			numA, _ = strconv.Atoi(partsA[i])
+		}
+		if i < len(partsB) {
+			numB, _ = strconv.Atoi(partsB[i])
+		}
+		if numA != numB {
+			if numA < numB {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// KeyStrategyResult 记录一种特征的查找过程, 方便新版本找不到key时定位是哪一步没对上
+type KeyStrategyResult struct {
+	Name string `json:"Name"`
+	// 特征出现的次数
+	Matches int `json:"Matches"`
+	// 特征前面符合长度标记的指针数
+	Candidates int `json:"Candidates"`
+	// 指针能读到内存, 拿去校验过的key数
+	Checked int  `json:"Checked"`
+	Found   bool `json:"Found"`
+}
+
+type KeySearchReport struct {
+	Version  string              `json:"Version"`
+	Strategy string              `json:"Strategy"`
+	Results  []KeyStrategyResult `json:"Results"`
+	Reason   string              `json:"Reason"`
+}
+
+func (r *KeySearchReport) String() string {
+	str := "WeChatWin.dll unknown version"
+	if len(r.Version) > 0 {
+		str = "WeChatWin.dll v" + r.Version
+	}
+	if len(r.Strategy) > 0 {
+		str += ", key found by " + r.Strategy
+	} else {
+		str += ", key not found: " + r.Reason
+	}
+	for _, result := range r.Results {
+		str += fmt.Sprintf("\n  %s: %d matches, %d candidates, %d checked", result.Name, result.Matches, result.Candidates, result.Checked)
+	}
+	return str
+}
+
+// failReason 找不到key时根据各个特征走到哪一步给出原因
+func (r *KeySearchReport) failReason() string {
+	matches, candidates, checked := 0, 0, 0
+	for _, result := range r.Results {
+		matches += result.Matches
+		candidates += result.Candidates
+		checked += result.Checked
+	}
+
+	switch {
+	case len(r.Results) == 0:
+		return fmt.Sprintf("no key signature for version %s", r.Version)
+	case matches == 0:
+		return "no signature pattern found in WeChatWin.dll"
+	case candidates == 0:
+		return "signature pattern found but no key pointer before it"
+	case checked == 0:
+		return "key pointers point to unreadable memory"
+	}
+	return fmt.Sprintf("%d candidate keys do not match the database", checked)
+}
+
+func readPointer(buffer []byte) uint64 {
+	if len(buffer) == 8 {
+		return binary.LittleEndian.Uint64(buffer)
+	}
+	return uint64(binary.LittleEndian.Uint32(buffer))
+}
@@ -0,0 +1,407 @@
+package wechat
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 验证过的数据库key按账号保存在本地, 微信退出后也能增量导出和离线解密:
+// 设置了口令时用口令派生的key加密, 否则Windows上用DPAPI绑定当前用户, 其它系统用只有当前用户可读的密钥文件
+
+const (
+	KeyStoreFile = "KeyStore.json"
+
+	keyStoreVersion           = 1
+	keyStoreProtectPassphrase = "passphrase"
+)
+
+var (
+	ErrKeyStoreLocked     = errors.New("keystore is protected by passphrase")
+	ErrKeyStorePassphrase = errors.New("incorrect keystore passphrase")
+	ErrKeyNotStored       = errors.New("key not in keystore")
+)
+
+type StoredKey struct {
+	AcountName string `json:"AcountName"`
+	FilePath   string `json:"FilePath"`
+	Cipher     string `json:"Cipher"`
+	// 保存时校验用的数据库的salt, 数据库重建后key会变
+	DBSalt  string `json:"DBSalt"`
+	Key     string `json:"Key"`
+	Updated int64  `json:"Updated"`
+}
+
+type keyStoreData struct {
+	Version int                   `json:"Version"`
+	Protect string                `json:"Protect"`
+	Salt    string                `json:"Salt,omitempty"`
+	Iter    int                   `json:"Iter,omitempty"`
+	KeyID   string                `json:"KeyID,omitempty"`
+	Keys    map[string]*StoredKey `json:"Keys"`
+}
+
+// keyProtector 加密保存的key, aad是账号名, 防止把别的账号的key挪过来用
+type keyProtector interface {
+	seal(plain []byte, aad []byte) ([]byte, error)
+	open(sealed []byte, aad []byte) ([]byte, error)
+}
+
+type KeyStore struct {
+	path      string
+	data      keyStoreData
+	protector keyProtector
+	mtx       sync.Mutex
+}
+
+// DefaultKeyStorePath 放在用户配置目录下, 图形界面和命令行共用
+func DefaultKeyStorePath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return KeyStoreFile
+	}
+	return filepath.Join(configDir, "wechatDataBackup", KeyStoreFile)
+}
+
+// OpenKeyStore 打开keystore, 文件不存在时在第一次保存key时创建,
+// passphrase为空时用系统的保护方式, 已经用口令保护的keystore必须给出口令
+func OpenKeyStore(path string, passphrase string) (*KeyStore, error) {
+	store := &KeyStore{path: path}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		store.data = keyStoreData{Version: keyStoreVersion, Keys: make(map[string]*StoredKey)}
+		if len(passphrase) > 0 {
+			salt, err := randomBytes(saltSize)
+			if err != nil {
+				return nil, err
+			}
+			store.data.Protect = keyStoreProtectPassphrase
+			store.data.Salt = hex.EncodeToString(salt)
+			store.data.Iter = backupKdfIter
+		} else {
+			store.data.Protect = keyStoreProtectOS
+		}
+	} else if err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(data, &store.data); err != nil {
+		return nil, fmt.Errorf("parse %s failed: %v", path, err)
+	}
+	if store.data.Keys == nil {
+		store.data.Keys = make(map[string]*StoredKey)
+	}
+
+	switch store.data.Protect {
+	case keyStoreProtectPassphrase:
+		if len(passphrase) == 0 {
+			return nil, ErrKeyStoreLocked
+		}
+		keyID, protector, err := newPassphraseProtector(passphrase, store.data.Salt, store.data.Iter)
+		if err != nil {
+			return nil, err
+		}
+		if len(store.data.KeyID) == 0 {
+			store.data.KeyID = keyID
+		} else if keyID != store.data.KeyID {
+			return nil, ErrKeyStorePassphrase
+		}
+		store.protector = protector
+	case keyStoreProtectOS:
+		if len(passphrase) > 0 {
+			return nil, errors.New("keystore is not protected by passphrase")
+		}
+		protector, err := newOSKeyProtector(path)
+		if err != nil {
+			return nil, err
+		}
+		store.protector = protector
+	default:
+		return nil, fmt.Errorf("unsupported keystore protection %s", store.data.Protect)
+	}
+
+	return store, nil
+}
+
+func (s *KeyStore) Path() string {
+	return s.path
+}
+
+// Accounts 返回保存了key的账号, 不包含key本身
+func (s *KeyStore) Accounts() []StoredKey {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	accounts := make([]StoredKey, 0, len(s.data.Keys))
+	for _, stored := range s.data.Keys {
+		account := *stored
+		account.Key = ""
+		accounts = append(accounts, account)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].AcountName < accounts[j].AcountName
+	})
+	return accounts
+}
+
+// SaveKey 用账号目录下的数据库校验key后保存, 同一个账号的key会被覆盖
+func (s *KeyStore) SaveKey(info *WeChatInfo) error {
+	if len(info.AcountName) == 0 {
+		return errors.New("empty acount name")
+	}
+	dbKey, err := hex.DecodeString(info.DBKey)
+	if err != nil || len(dbKey) != keySize {
+		return fmt.Errorf("invalid key: %s", info.DBKey)
+	}
+
+	page1, err := readFirstPage(keyCheckDataBase(info.FilePath))
+	if err != nil {
+		return err
+	}
+	profile := detectPageProfile(page1, dbKey)
+	if profile == nil {
+		return ErrIncorrectPassword
+	}
+
+	sealed, err := s.protector.seal(dbKey, []byte(info.AcountName))
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.data.Keys[info.AcountName] = &StoredKey{
+		AcountName: info.AcountName,
+		FilePath:   info.FilePath,
+		Cipher:     profile.Name,
+		DBSalt:     hex.EncodeToString(page1[:saltSize]),
+		Key:        hex.EncodeToString(sealed),
+		Updated:    time.Now().Unix(),
+	}
+	return s.save()
+}
+
+// LoadKey 取出账号的key, 用前用filePath下的数据库重新校验, filePath为空时用保存时的账号目录
+func (s *KeyStore) LoadKey(acountName string, filePath string) (string, error) {
+	s.mtx.Lock()
+	stored, ok := s.data.Keys[acountName]
+	if ok {
+		copied := *stored
+		stored = &copied
+	}
+	s.mtx.Unlock()
+	if !ok {
+		return "", ErrKeyNotStored
+	}
+	if len(filePath) == 0 {
+		filePath = stored.FilePath
+	}
+
+	sealed, err := hex.DecodeString(stored.Key)
+	if err != nil {
+		return "", err
+	}
+	dbKey, err := s.protector.open(sealed, []byte(acountName))
+	if err != nil {
+		return "", fmt.Errorf("open stored key failed: %v", err)
+	}
+
+	page1, err := readFirstPage(keyCheckDataBase(filePath))
+	if err != nil {
+		return "", err
+	}
+	profile, _ := GetCipherProfile(stored.Cipher)
+	if (profile == nil || !profile.checkKey(page1, dbKey)) && detectPageProfile(page1, dbKey) == nil {
+		if hex.EncodeToString(page1[:saltSize]) != stored.DBSalt {
+			return "", errors.New("database salt changed since key was stored, the key is stale")
+		}
+		return "", ErrIncorrectPassword
+	}
+
+	return hex.EncodeToString(dbKey), nil
+}
+
+func (s *KeyStore) DeleteKey(acountName string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.data.Keys[acountName]; !ok {
+		return ErrKeyNotStored
+	}
+	delete(s.data.Keys, acountName)
+	return s.save()
+}
+
+// save 先写临时文件再改名, 中途退出不会损坏已有的keystore
+func (s *KeyStore) save() error {
+	data, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// keyCheckDataBase 用来校验key的数据库, 和DecryptWeChatDataBase一样优先用MicroMsg.db
+func keyCheckDataBase(filePath string) string {
+	for _, name := range []string{MicroMsgDB, "Media.db"} {
+		path := filepath.Join(filePath, "Msg", name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(filePath, "Msg", MicroMsgDB)
+}
+
+func detectPageProfile(page1 []byte, password []byte) *CipherProfile {
+	for _, profile := range CipherProfiles {
+		if profile.checkKey(page1, password) {
+			return profile
+		}
+	}
+	return nil
+}
+
+func randomBytes(size int) ([]byte, error) {
+	buffer := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, buffer); err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+type aeadProtector struct {
+	aead cipher.AEAD
+}
+
+func newAEADProtector(key []byte) (*aeadProtector, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aeadProtector{aead: aead}, nil
+}
+
+// seal 输出 nonce | 密文
+func (p *aeadProtector) seal(plain []byte, aad []byte) ([]byte, error) {
+	nonce, err := randomBytes(p.aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return p.aead.Seal(nonce, nonce, plain, aad), nil
+}
+
+func (p *aeadProtector) open(sealed []byte, aad []byte) ([]byte, error) {
+	if len(sealed) < p.aead.NonceSize() {
+		return nil, errors.New("sealed key too short")
+	}
+	nonceSize := p.aead.NonceSize()
+	return p.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], aad)
+}
+
+// newPassphraseProtector 和导出加密一样用PBKDF2派生key, 返回用来校验口令的keyID
+func newPassphraseProtector(passphrase string, saltHex string, iter int) (string, keyProtector, error) {
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil || len(salt) == 0 || iter <= 0 {
+		return "", nil, errors.New("invalid keystore kdf parameters")
+	}
+
+	master := pbkdf2HMAC([]byte(passphrase), salt, iter, keySize, sha512.New)
+	sum := sha256.Sum256(master)
+	protector, err := newAEADProtector(master)
+	if err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(sum[:backupKeyIDSize]), protector, nil
+}
+
+var defaultKeyStore *KeyStore
+var defaultKeyStoreMtx sync.Mutex
+
+// SetDefaultKeyStore 设置GetWeChatAllInfo使用的keystore, nil表示不保存也不复用key
+func SetDefaultKeyStore(store *KeyStore) {
+	defaultKeyStoreMtx.Lock()
+	defaultKeyStore = store
+	defaultKeyStoreMtx.Unlock()
+}
+
+func getDefaultKeyStore() *KeyStore {
+	defaultKeyStoreMtx.Lock()
+	defer defaultKeyStoreMtx.Unlock()
+	return defaultKeyStore
+}
+
+// storedWeChatKey 从默认keystore取校验过的key, 没有时返回空字符串
+func storedWeChatKey(info *WeChatInfo) string {
+	store := getDefaultKeyStore()
+	if store == nil {
+		return ""
+	}
+	key, err := store.LoadKey(info.AcountName, info.FilePath)
+	if err != nil {
+		if err != ErrKeyNotStored {
+			log.Printf("LoadKey %s failed: %v\n", info.AcountName, err)
+		}
+		return ""
+	}
+	return key
+}
+
+func storeWeChatKey(info *WeChatInfo) {
+	store := getDefaultKeyStore()
+	if store == nil || len(info.DBKey) == 0 {
+		return
+	}
+	if err := store.SaveKey(info); err != nil {
+		log.Printf("SaveKey %s failed: %v\n", info.AcountName, err)
+	}
+}
+
+// appendStoredAccounts 把keystore里没有运行的账号也加到列表里, 微信退出后还能导出
+func appendStoredAccounts(list *WeChatInfoList) {
+	store := getDefaultKeyStore()
+	if store == nil {
+		return
+	}
+
+	for _, account := range store.Accounts() {
+		exist := false
+		for i := range list.Info {
+			if list.Info[i].AcountName == account.AcountName {
+				exist = true
+				break
+			}
+		}
+		if exist {
+			continue
+		}
+
+		info := WeChatInfo{FilePath: account.FilePath, AcountName: account.AcountName}
+		if info.DBKey = storedWeChatKey(&info); len(info.DBKey) == 0 {
+			continue
+		}
+		list.Info = append(list.Info, info)
+		list.Total += 1
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+
+package wechat
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const keyStoreProtectOS = "keyfile"
+
+// newOSKeyProtector 没有系统的密钥保护时, 用keystore旁边只有当前用户可读的随机密钥文件
+func newOSKeyProtector(storePath string) (keyProtector, error) {
+	keyPath := storePath + ".key"
+	key, err := os.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		if key, err = randomBytes(keySize); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(keyPath, key, 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if fileInfo, err := os.Stat(keyPath); err == nil && fileInfo.Mode().Perm()&0077 != 0 {
+		log.Printf("warning: %s can be read by other users\n", keyPath)
+	}
+	return newAEADProtector(key)
+}
@@ -0,0 +1,48 @@
+package wechat
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const keyStoreProtectOS = "dpapi"
+
+// newOSKeyProtector Windows上用DPAPI加密, 只有当前用户在这台机器上能解开
+func newOSKeyProtector(storePath string) (keyProtector, error) {
+	return dpapiProtector{}, nil
+}
+
+type dpapiProtector struct{}
+
+func newDataBlob(data []byte) *windows.DataBlob {
+	if len(data) == 0 {
+		return &windows.DataBlob{}
+	}
+	return &windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+}
+
+func dataBlobBytes(blob *windows.DataBlob) []byte {
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(blob.Data)))
+	data := make([]byte, blob.Size)
+	copy(data, unsafe.Slice(blob.Data, blob.Size))
+	return data
+}
+
+func (dpapiProtector) seal(plain []byte, aad []byte) ([]byte, error) {
+	out := windows.DataBlob{}
+	err := windows.CryptProtectData(newDataBlob(plain), nil, newDataBlob(aad), 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return nil, err
+	}
+	return dataBlobBytes(&out), nil
+}
+
+func (dpapiProtector) open(sealed []byte, aad []byte) ([]byte, error) {
+	out := windows.DataBlob{}
+	err := windows.CryptUnprotectData(newDataBlob(sealed), nil, newDataBlob(aad), 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return nil, err
+	}
+	return dataBlobBytes(&out), nil
+}
@@ -0,0 +1,260 @@
+package wechat
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type WeChatLocationPoint struct {
+	Talker     string  `json:"Talker"`
+	Sender     string  `json:"Sender"`
+	SenderName string  `json:"SenderName"`
+	MsgSvrId   string  `json:"MsgSvrId"`
+	CreateTime int64   `json:"CreateTime"`
+	PoiName    string  `json:"PoiName"`
+	Label      string  `json:"Label"`
+	Latitude   float64 `json:"Latitude"`
+	Longitude  float64 `json:"Longitude"`
+}
+
+type WeChatLocationList struct {
+	UserName string                `json:"UserName"`
+	Total    int                   `json:"Total"`
+	Rows     []WeChatLocationPoint `json:"Rows"`
+}
+
+func locationSenderName(info *WeChatUserInfo) string {
+	if info.ReMark != "" {
+		return info.ReMark
+	}
+	if info.NickName != "" {
+		return info.NickName
+	}
+	return info.UserName
+}
+
+func locationPointAppend(list *WeChatLocationList, talker string, msg *WeChatMessage) {
+	if msg.Type == Wechat_Message_Type_Misc && msg.SubType == Wechat_Misc_Message_ForwardMessage {
+		for i := range msg.ForwardInfo.Items {
+			locationPointAppend(list, talker, &msg.ForwardInfo.Items[i])
+		}
+		return
+	}
+	if msg.Type != Wechat_Message_Type_Location {
+		return
+	}
+
+	lat, err1 := strconv.ParseFloat(msg.LocationInfo.X, 64)
+	lng, err2 := strconv.ParseFloat(msg.LocationInfo.Y, 64)
+	if err1 != nil || err2 != nil || (lat == 0 && lng == 0) {
+		return
+	}
+
+	list.Rows = append(list.Rows, WeChatLocationPoint{
+		Talker:     talker,
+		Sender:     msg.UserInfo.UserName,
+		SenderName: locationSenderName(&msg.UserInfo),
+		MsgSvrId:   msg.MsgSvrId,
+		CreateTime: msg.CreateTime,
+		PoiName:    msg.LocationInfo.PoiName,
+		Label:      msg.LocationInfo.Label,
+		Latitude:   lat,
+		Longitude:  lng,
+	})
+}
+
+// WeChatGetLocationList 收集位置消息(包括聊天记录里转发的位置), userName为空或者"all"时返回整个账号的
+func (P *WechatDataProvider) WeChatGetLocationList(userName string) (*WeChatLocationList, error) {
+	list := &WeChatLocationList{UserName: userName}
+	list.Rows = make([]WeChatLocationPoint, 0)
+	if userName == "all" {
+		userName = ""
+	}
+
+	condition := fmt.Sprintf("(Type=%d Or (Type=%d And SubType=%d))", Wechat_Message_Type_Location, Wechat_Message_Type_Misc, Wechat_Misc_Message_ForwardMessage)
+	if len(userName) > 0 {
+		condition += fmt.Sprintf(" And StrTalker='%s'", userName)
+	}
+	querySql := fmt.Sprintf("select localId,MsgSvrID,Type,SubType,IsSender,CreateTime,ifnull(StrTalker,'') as StrTalker, ifnull(StrContent,'') as StrContent,ifnull(CompressContent,'') as CompressContent,ifnull(BytesExtra,'') as BytesExtra from MSG Where %s order by CreateTime asc;", condition)
+
+	for _, msgDB := range P.msgDBs {
+		rows, err := msgDB.db.Query(querySql)
+		if err != nil {
+			log.Printf("%s failed %v\n", querySql, err)
+			continue
+		}
+
+		for rows.Next() {
+			msg, err := P.wechatScanMessage(rows)
+			if err != nil {
+				log.Println("rows.Scan failed", err)
+				break
+			}
+			locationPointAppend(list, msg.Talker, &msg)
+		}
+		rows.Close()
+	}
+
+	sort.SliceStable(list.Rows, func(i, j int) bool { return list.Rows[i].CreateTime < list.Rows[j].CreateTime })
+	list.Total = len(list.Rows)
+
+	return list, nil
+}
+
+// WeChatExportLocations 导出位置消息, format为"geojson"或者"kml"
+func (P *WechatDataProvider) WeChatExportLocations(userName string, exportPath string, format string) error {
+	list, err := P.WeChatGetLocationList(userName)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if format == "kml" {
+		data = locationListKML(list)
+	} else {
+		data, err = locationListGeoJSON(list)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.WriteFile(exportPath, data, 0644)
+	if err != nil {
+		log.Println("WriteFile failed:", err)
+	}
+	return err
+}
+
+func locationListGeoJSON(list *WeChatLocationList) ([]byte, error) {
+	type feature struct {
+		Type       string                 `json:"type"`
+		Geometry   map[string]interface{} `json:"geometry"`
+		Properties map[string]interface{} `json:"properties"`
+	}
+
+	features := make([]feature, 0, len(list.Rows))
+	for _, point := range list.Rows {
+		lat, lng := gcj02ToWGS84(point.Latitude, point.Longitude)
+		features = append(features, feature{
+			Type: "Feature",
+			Geometry: map[string]interface{}{
+				"type":        "Point",
+				"coordinates": []float64{lng, lat},
+			},
+			Properties: map[string]interface{}{
+				"name":       point.PoiName,
+				"label":      point.Label,
+				"sender":     point.SenderName,
+				"senderId":   point.Sender,
+				"talker":     point.Talker,
+				"time":       time.Unix(point.CreateTime, 0).Format(time.RFC3339),
+				"createTime": point.CreateTime,
+				"msgSvrId":   point.MsgSvrId,
+				"gcj02":      []float64{point.Longitude, point.Latitude},
+			},
+		})
+	}
+
+	collection := map[string]interface{}{
+		"type":     "FeatureCollection",
+		"features": features,
+	}
+	return json.MarshalIndent(collection, "", "  ")
+}
+
+func locationListKML(list *WeChatLocationList) []byte {
+	escape := func(s string) string {
+		var buf bytes.Buffer
+		xml.EscapeText(&buf, []byte(s))
+		return buf.String()
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString("<kml xmlns=\"http://www.opengis.net/kml/2.2\">\n<Document>\n")
+	buf.WriteString(fmt.Sprintf("<name>%s</name>\n", escape("wechat locations "+list.UserName)))
+	for _, point := range list.Rows {
+		name := point.PoiName
+		if name == "" {
+			name = point.Label
+		}
+		stamp := time.Unix(point.CreateTime, 0)
+		buf.WriteString("<Placemark>\n")
+		buf.WriteString(fmt.Sprintf("<name>%s</name>\n", escape(name)))
+		buf.WriteString(fmt.Sprintf("<description>%s</description>\n", escape(fmt.Sprintf("%s %s\n%s", point.SenderName, stamp.Format("2006-01-02 15:04:05"), point.Label))))
+		buf.WriteString(fmt.Sprintf("<TimeStamp><when>%s</when></TimeStamp>\n", stamp.Format(time.RFC3339)))
+		buf.WriteString("<ExtendedData>\n")
+		for _, kv := range [][2]string{{"sender", point.SenderName}, {"senderId", point.Sender}, {"talker", point.Talker}, {"msgSvrId", point.MsgSvrId}} {
+			buf.WriteString(fmt.Sprintf("<Data name=\"%s\"><value>%s</value></Data>\n", kv[0], escape(kv[1])))
+		}
+		buf.WriteString("</ExtendedData>\n")
+		lat, lng := gcj02ToWGS84(point.Latitude, point.Longitude)
+		buf.WriteString(fmt.Sprintf("<Point><coordinates>%s,%s</coordinates></Point>\n", strconv.FormatFloat(lng, 'f', 7, 64), strconv.FormatFloat(lat, 'f', 7, 64)))
+		buf.WriteString("</Placemark>\n")
+	}
+	buf.WriteString("</Document>\n</kml>\n")
+
+	return buf.Bytes()
+}
+
+// 微信位置消息的坐标是GCJ-02, GeoJSON和KML按WGS84解析, 导出时转换回WGS84, 国外的坐标没有偏移
+const (
+	gcj02SemiMajor = 6378245.0
+	gcj02Ee        = 0.00669342162296594323
+)
+
+func gcj02OutOfChina(lat, lng float64) bool {
+	return lng < 72.004 || lng > 137.8347 || lat < 0.8293 || lat > 55.8271
+}
+
+func gcj02Offset(lat, lng float64) (float64, float64) {
+	x, y := lng-105.0, lat-35.0
+	dLat := -100.0 + 2.0*x + 3.0*y + 0.2*y*y + 0.1*x*y + 0.2*math.Sqrt(math.Abs(x))
+	dLat += (20.0*math.Sin(6.0*x*math.Pi) + 20.0*math.Sin(2.0*x*math.Pi)) * 2.0 / 3.0
+	dLat += (20.0*math.Sin(y*math.Pi) + 40.0*math.Sin(y/3.0*math.Pi)) * 2.0 / 3.0
+	dLat += (160.0*math.Sin(y/12.0*math.Pi) + 320*math.Sin(y*math.Pi/30.0)) * 2.0 / 3.0
+	dLng := 300.0 + x + 2.0*y + 0.1*x*x + 0.1*x*y + 0.1*math.Sqrt(math.Abs(x))
+	dLng += (20.0*math.Sin(6.0*x*math.Pi) + 20.0*math.Sin(2.0*x*math.Pi)) * 2.0 / 3.0
+	dLng += (20.0*math.Sin(x*math.Pi) + 40.0*math.Sin(x/3.0*math.Pi)) * 2.0 / 3.0
+	dLng += (150.0*math.Sin(x/12.0*math.Pi) + 300.0*math.Sin(x/30.0*math.Pi)) * 2.0 / 3.0
+
+	radLat := lat / 180.0 * math.Pi
+	magic := 1 - gcj02Ee*math.Sin(radLat)*math.Sin(radLat)
+	sqrtMagic := math.Sqrt(magic)
+	dLat = (dLat * 180.0) / ((gcj02SemiMajor * (1 - gcj02Ee)) / (magic * sqrtMagic) * math.Pi)
+	dLng = (dLng * 180.0) / (gcj02SemiMajor / sqrtMagic * math.Cos(radLat) * math.Pi)
+	return dLat, dLng
+}
+
+func wgs84ToGCJ02(lat, lng float64) (float64, float64) {
+	if gcj02OutOfChina(lat, lng) {
+		return lat, lng
+	}
+	dLat, dLng := gcj02Offset(lat, lng)
+	return lat + dLat, lng + dLng
+}
+
+// gcj02ToWGS84 没有解析的逆变换, 迭代几次误差在厘米级
+func gcj02ToWGS84(lat, lng float64) (float64, float64) {
+	if gcj02OutOfChina(lat, lng) {
+		return lat, lng
+	}
+	wgsLat, wgsLng := lat, lng
+	for i := 0; i < 10; i++ {
+		gcjLat, gcjLng := wgs84ToGCJ02(wgsLat, wgsLng)
+		dLat, dLng := gcjLat-lat, gcjLng-lng
+		wgsLat, wgsLng = wgsLat-dLat, wgsLng-dLng
+		if math.Abs(dLat) < 1e-9 && math.Abs(dLng) < 1e-9 {
+			break
+		}
+	}
+	return wgsLat, wgsLng
+}
@@ -0,0 +1,234 @@
+package wechat
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// 加密的数据库直接解密到内存:
+// 先Deserialize到一个私有的内存连接, 再VACUUM INTO到memdb VFS的共享库里,
+// 这样连接池里的每个连接看到的是同一份数据, 嵌套查询也不会死锁, 明文不会写到磁盘上
+// 支持cgo时SQLCipher数据库通过只读VFS按页解密后VACUUM INTO, 不用先整个解密到Go的内存里,
+// 超过memDataBaseMaxSize的分片不复制到内存, 直接通过VFS查询
+
+var memDataBaseIndex uint64
+
+// memDataBaseMaxSize 超过这个大小的SQLCipher数据库不整个放到内存里
+var memDataBaseMaxSize int64 = 256 * 1024 * 1024
+
+var errCipherVFSUnsupported = errors.New("cipher vfs need cgo")
+
+// 共享的memdb在最后一个连接关闭后释放, keeper保证连接池空闲回收时数据还在
+var memDataBases = make(map[*sql.DB]*sql.Conn)
+var memDataBaseMtx sync.Mutex
+
+// OpenDataBaseInMemory 解密SQLCipher数据库到内存并打开, 可读写, 但是写入不会保存到原文件
+func OpenDataBaseInMemory(path string, password []byte, opts DecryptOptions) (*sql.DB, *DecryptReport, error) {
+	data, report, err := DecryptDataBaseToMemory(path, password, opts)
+	if err != nil {
+		return nil, report, err
+	}
+
+	db, err := openMemDataBase(filepath.Base(path), data)
+	if err != nil {
+		return nil, report, err
+	}
+	if opts.IntegrityCheck {
+		report.Integrity = queryIntegrityCheck(db)
+	}
+	return db, report, nil
+}
+
+func openMemDataBase(name string, data []byte) (*sql.DB, error) {
+	if len(data) < 100 {
+		return nil, errors.New("not a sqlite database")
+	}
+	// memdb不支持WAL, 文件头里的读写版本改回rollback journal
+	data[18], data[19] = 1, 1
+
+	db, memName, err := newMemDataBase(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadMemDataBase(memName, data); err != nil {
+		closeDataBase(db)
+		return nil, err
+	}
+	return db, nil
+}
+
+// newMemDataBase 创建一个空的共享内存数据库
+func newMemDataBase(name string) (*sql.DB, string, error) {
+	index := atomic.AddUint64(&memDataBaseIndex, 1)
+	memName := fmt.Sprintf("file:/wechatDataBackup_%d_%s?vfs=memdb", index, name)
+	db, err := sql.Open(secureSQLiteDriver, memName)
+	if err != nil {
+		return nil, "", err
+	}
+	keeper, err := db.Conn(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, "", err
+	}
+
+	memDataBaseMtx.Lock()
+	memDataBases[db] = keeper
+	memDataBaseMtx.Unlock()
+	return db, memName, nil
+}
+
+// newBackupMemDataBase 创建加密导出里新的数据库, 预留IV和HMAC的空间, 关闭时才能加密写回
+func newBackupMemDataBase(path string) (*sql.DB, error) {
+	key := getBackupKeyByPath(path)
+	if key == nil {
+		return nil, ErrBackupLocked
+	}
+
+	db, _, err := newMemDataBase(filepath.Base(path))
+	if err != nil || key.profile == nil {
+		return db, err
+	}
+
+	memDataBaseMtx.Lock()
+	keeper := memDataBases[db]
+	memDataBaseMtx.Unlock()
+	querySql := fmt.Sprintf("PRAGMA page_size=%d;", key.profile.PageSize)
+	if _, err = keeper.ExecContext(context.Background(), querySql); err == nil {
+		err = setReserveBytes(keeper, key.profile.Reserve)
+	}
+	if err == nil {
+		_, err = keeper.ExecContext(context.Background(), "VACUUM;")
+	}
+	if err != nil {
+		closeDataBase(db)
+		return nil, err
+	}
+	return db, nil
+}
+
+// loadMemDataBase 返回前释放中间的内存连接, data在Deserialize复制之后调用方就不应该再持有
+func loadMemDataBase(memName string, data []byte) error {
+	src, err := sql.Open(secureSQLiteDriver, ":memory:")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	conn, err := src.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = conn.Raw(func(driverConn interface{}) error {
+		// go-sqlite3的SQLiteConn, 用接口判断避免直接依赖cgo才有的方法
+		sqliteConn, ok := driverConn.(interface {
+			Deserialize(b []byte, schema string) error
+		})
+		if !ok {
+			return errors.New("not sqlite3 conn")
+		}
+		return sqliteConn.Deserialize(data, "main")
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(context.Background(), "VACUUM INTO ?;", memName)
+	return err
+}
+
+// copyMemDataBase 把通过VFS打开的数据库复制到共享内存数据库
+func copyMemDataBase(name string, src *sql.DB) (*sql.DB, error) {
+	db, memName, err := newMemDataBase(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := src.Exec("VACUUM INTO ?;", memName); err != nil {
+		closeDataBase(db)
+		return nil, err
+	}
+	return db, nil
+}
+
+// serializeDataBase 导出内存数据库的内容, 不是内存数据库时返回错误
+func serializeDataBase(db *sql.DB) ([]byte, error) {
+	memDataBaseMtx.Lock()
+	keeper := memDataBases[db]
+	memDataBaseMtx.Unlock()
+	if keeper == nil {
+		return nil, errors.New("not memory database")
+	}
+
+	var data []byte
+	err := keeper.Raw(func(driverConn interface{}) error {
+		sqliteConn, ok := driverConn.(interface {
+			Serialize(schema string) ([]byte, error)
+		})
+		if !ok {
+			return errors.New("not sqlite3 conn")
+		}
+		var err error
+		data, err = sqliteConn.Serialize("main")
+		return err
+	})
+	return data, err
+}
+
+// closeDataBase 关闭数据库, 内存数据库同时释放数据
+func closeDataBase(db *sql.DB) error {
+	memDataBaseMtx.Lock()
+	keeper := memDataBases[db]
+	delete(memDataBases, db)
+	memDataBaseMtx.Unlock()
+
+	err := db.Close()
+	if keeper != nil {
+		keeper.Close()
+	}
+	closeCipherDataBase(db)
+	return err
+}
+
+// openBackupDataBase 打开导出目录里的数据库, 已解锁的加密导出和设置了key的微信目录直接解密到内存
+func openBackupDataBase(path string) (*sql.DB, error) {
+	key := getBackupKeyByPath(path)
+	if key == nil || fileHasPrefix(path, "SQLite format 3\x00") {
+		return sql.Open("sqlite3", path)
+	}
+
+	if fileHasPrefix(path, backupFileMagic) {
+		data, err := ReadBackupFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return openMemDataBase(filepath.Base(path), data)
+	}
+
+	src, err := openCipherDataBase(path, key.password)
+	if err == nil {
+		if stat, err := os.Stat(path); err == nil && stat.Size() > memDataBaseMaxSize {
+			return src, nil
+		}
+		defer closeDataBase(src)
+		return copyMemDataBase(filepath.Base(path), src)
+	} else if !errors.Is(err, errCipherVFSUnsupported) {
+		return nil, err
+	}
+
+	db, report, err := OpenDataBaseInMemory(path, key.password, DecryptOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if report.HasError() {
+		log.Println("OpenDataBaseInMemory:", report)
+	}
+	return db, nil
+}
@@ -0,0 +1,333 @@
+package wechat
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// wcpayinfo/paysubtype
+const (
+	Wechat_Pay_SubType_Transfer = 1
+	Wechat_Pay_SubType_Received = 3
+	Wechat_Pay_SubType_Refunded = 4
+	Wechat_Pay_SubType_Expired  = 5
+)
+
+const (
+	Wechat_Pay_Direction_In  = "in"
+	Wechat_Pay_Direction_Out = "out"
+)
+
+const (
+	Wechat_Pay_Status_Pending  = "pending"
+	Wechat_Pay_Status_Received = "received"
+	Wechat_Pay_Status_Refunded = "refunded"
+	Wechat_Pay_Status_Expired  = "expired"
+	Wechat_Pay_Status_Opened   = "opened"
+)
+
+const (
+	Wechat_Pay_Kind_Transfer  = "transfer"
+	Wechat_Pay_Kind_RedPacket = "redpacket"
+)
+
+type WeChatPaymentRecord struct {
+	Kind       string `json:"Kind"`
+	Id         string `json:"Id"`
+	Talker     string `json:"Talker"`
+	MsgSvrId   string `json:"MsgSvrId"`
+	CreateTime int64  `json:"CreateTime"`
+	Direction  string `json:"Direction"`
+	Amount     int64  `json:"Amount"`
+	HasAmount  bool   `json:"HasAmount"`
+	Feedesc    string `json:"Feedesc"`
+	Memo       string `json:"Memo"`
+	Status     string `json:"Status"`
+	SettleTime int64  `json:"SettleTime"`
+	Payer      string `json:"Payer"`
+	Receiver   string `json:"Receiver"`
+}
+
+type WeChatPaymentLedger struct {
+	UserName   string                `json:"UserName"`
+	StartTime  int64                 `json:"StartTime"`
+	EndTime    int64                 `json:"EndTime"`
+	TotalIn    int64                 `json:"TotalIn"`
+	TotalOut   int64                 `json:"TotalOut"`
+	PendingIn  int64                 `json:"PendingIn"`
+	PendingOut int64                 `json:"PendingOut"`
+	NoAmount   int                   `json:"NoAmount"`
+	Total      int                   `json:"Total"`
+	Rows       []WeChatPaymentRecord `json:"Rows"`
+}
+
+var payAmountRegexp = regexp.MustCompile(`(\d+)(?:\.(\d{1,2}))?`)
+
+// 把"￥100.00"这样的金额转换成分
+func payAmountParse(feedesc string) int64 {
+	m := payAmountRegexp.FindStringSubmatch(strings.ReplaceAll(feedesc, ",", ""))
+	if m == nil {
+		return 0
+	}
+	yuan, _ := strconv.ParseInt(m[1], 10, 64)
+	cent := int64(0)
+	if len(m[2]) == 1 {
+		cent, _ = strconv.ParseInt(m[2], 10, 64)
+		cent *= 10
+	} else if len(m[2]) == 2 {
+		cent, _ = strconv.ParseInt(m[2], 10, 64)
+	}
+	return yuan*100 + cent
+}
+
+func (P *WechatDataProvider) wechatMessagePayHandle(msg *WeChatMessage, root *xmlDocument) {
+	pay := &msg.PayInfo
+	pay.Type, _ = strconv.Atoi(root.FindElementValue("/msg/appmsg/wcpayinfo/paysubtype"))
+	pay.Feedesc = root.FindElementValue("/msg/appmsg/wcpayinfo/feedesc")
+	pay.BeginTime = root.FindElementValue("/msg/appmsg/wcpayinfo/begintransfertime")
+	pay.Memo = root.FindElementValue("/msg/appmsg/wcpayinfo/pay_memo")
+	pay.Amount = payAmountParse(pay.Feedesc)
+	pay.InvalidTime, _ = strconv.ParseInt(root.FindElementValue("/msg/appmsg/wcpayinfo/invalidtime"), 10, 64)
+
+	if msg.SubType == Wechat_Misc_Message_Transfer {
+		pay.TransferId = root.FindElementValue("/msg/appmsg/wcpayinfo/transferid")
+		pay.TransactionId = root.FindElementValue("/msg/appmsg/wcpayinfo/transcationid")
+		pay.Payer = root.FindElementValue("/msg/appmsg/wcpayinfo/payer_username")
+		pay.Receiver = root.FindElementValue("/msg/appmsg/wcpayinfo/receiver_username")
+
+		// 收款/退还消息由收款方发出, 转账消息由付款方发出
+		isPayer := msg.IsSender == 1
+		if pay.Type == Wechat_Pay_SubType_Received || pay.Type == Wechat_Pay_SubType_Refunded || pay.Type == Wechat_Pay_SubType_Expired {
+			isPayer = msg.IsSender != 1
+		}
+		if len(pay.Payer) > 0 {
+			isPayer = pay.Payer == P.SelfInfo.UserName
+		} else if len(pay.Receiver) > 0 {
+			isPayer = pay.Receiver != P.SelfInfo.UserName
+		}
+		pay.Direction = Wechat_Pay_Direction_In
+		if isPayer {
+			pay.Direction = Wechat_Pay_Direction_Out
+		}
+
+		switch pay.Type {
+		case Wechat_Pay_SubType_Received:
+			pay.Status = Wechat_Pay_Status_Received
+		case Wechat_Pay_SubType_Refunded:
+			pay.Status = Wechat_Pay_Status_Refunded
+		case Wechat_Pay_SubType_Expired:
+			pay.Status = Wechat_Pay_Status_Expired
+		default:
+			pay.Status = Wechat_Pay_Status_Pending
+		}
+	} else if msg.SubType == Wechat_Misc_Message_RedPacket {
+		pay.Memo = root.FindElementValue("/msg/appmsg/wcpayinfo/receivertitle")
+		if len(pay.Memo) == 0 {
+			pay.Memo = root.FindElementValue("/msg/appmsg/wcpayinfo/sendertitle")
+		}
+		pay.Feedesc = root.FindElementValue("/msg/appmsg/wcpayinfo/scenetext")
+		// 红包消息里没有金额, 领取后也只有通知没有金额
+		pay.Amount = 0
+		nativeUrl := root.FindElementValue("/msg/appmsg/wcpayinfo/nativeurl")
+		if u, err := url.Parse(nativeUrl); err == nil {
+			pay.TransferId = u.Query().Get("sendid")
+			pay.Payer = u.Query().Get("sendusername")
+		}
+		pay.Direction = Wechat_Pay_Direction_In
+		if msg.IsSender == 1 || (len(pay.Payer) > 0 && pay.Payer == P.SelfInfo.UserName) {
+			pay.Direction = Wechat_Pay_Direction_Out
+		}
+		pay.Status = Wechat_Pay_Status_Pending
+	}
+
+	if len(msg.Content) == 0 {
+		msg.Content = pay.Feedesc
+	}
+}
+
+// WeChatGetPaymentLedger 汇总转账和红包, userName为空或者"all"时统计全部会话, startTime/endTime为0表示不限制
+func (P *WechatDataProvider) WeChatGetPaymentLedger(userName string, startTime int64, endTime int64) (*WeChatPaymentLedger, error) {
+	ledger := &WeChatPaymentLedger{UserName: userName, StartTime: startTime, EndTime: endTime}
+	ledger.Rows = make([]WeChatPaymentRecord, 0)
+	if userName == "all" {
+		userName = ""
+	}
+	if endTime <= 0 {
+		endTime = time.Now().Unix()
+	}
+
+	condition := fmt.Sprintf("CreateTime>=%d And CreateTime<=%d", startTime, endTime)
+	if len(userName) > 0 {
+		condition += fmt.Sprintf(" And StrTalker='%s'", userName)
+	}
+	sqlFormat := "select localId,MsgSvrID,Type,SubType,IsSender,CreateTime,ifnull(StrTalker,'') as StrTalker, ifnull(StrContent,'') as StrContent,ifnull(CompressContent,'') as CompressContent,ifnull(BytesExtra,'') as BytesExtra from MSG Where %s And ((Type=%d And SubType in (%d,%d)) Or (Type=%d And StrContent like '%%红包%%')) order by CreateTime asc;"
+	querySql := fmt.Sprintf(sqlFormat, condition, Wechat_Message_Type_Misc, Wechat_Misc_Message_Transfer, Wechat_Misc_Message_RedPacket, Wechat_Message_Type_System)
+
+	messages := make([]WeChatMessage, 0)
+	for _, msgDB := range P.msgDBs {
+		if msgDB.endTime < startTime || msgDB.startTime > endTime {
+			continue
+		}
+
+		rows, err := msgDB.db.Query(querySql)
+		if err != nil {
+			log.Printf("%s failed %v\n", querySql, err)
+			continue
+		}
+
+		for rows.Next() {
+			message, err := P.wechatScanMessage(rows)
+			if err != nil {
+				log.Println("rows.Scan failed", err)
+				break
+			}
+			messages = append(messages, message)
+		}
+		rows.Close()
+	}
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].CreateTime < messages[j].CreateTime })
+
+	index := make(map[string]int)
+	for i := range messages {
+		msg := &messages[i]
+		if msg.Type == Wechat_Message_Type_System {
+			// 红包领取通知
+			if msg.SystemInfo.Kind != Wechat_System_Event_RedPacket || len(msg.SystemInfo.Detail) == 0 {
+				continue
+			}
+			if pos, exists := index[Wechat_Pay_Kind_RedPacket+msg.SystemInfo.Detail]; exists {
+				ledger.Rows[pos].Status = Wechat_Pay_Status_Opened
+				if ledger.Rows[pos].SettleTime == 0 {
+					ledger.Rows[pos].SettleTime = msg.CreateTime
+				}
+			}
+			continue
+		}
+
+		pay := &msg.PayInfo
+		kind := Wechat_Pay_Kind_Transfer
+		if msg.SubType == Wechat_Misc_Message_RedPacket {
+			kind = Wechat_Pay_Kind_RedPacket
+		}
+
+		if pos, exists := index[kind+pay.TransferId]; exists && len(pay.TransferId) > 0 {
+			// 收款或退还的后续消息, 更新原来的那一笔
+			record := &ledger.Rows[pos]
+			if pay.Status != Wechat_Pay_Status_Pending {
+				record.Status = pay.Status
+				record.SettleTime = msg.CreateTime
+			}
+			if record.Amount == 0 && pay.Amount > 0 {
+				record.Amount = pay.Amount
+				record.HasAmount = true
+			}
+			continue
+		}
+
+		record := WeChatPaymentRecord{
+			Kind:       kind,
+			Id:         pay.TransferId,
+			Talker:     msg.Talker,
+			MsgSvrId:   msg.MsgSvrId,
+			CreateTime: msg.CreateTime,
+			Direction:  pay.Direction,
+			Amount:     pay.Amount,
+			HasAmount:  pay.Amount > 0,
+			Feedesc:    pay.Feedesc,
+			Memo:       pay.Memo,
+			Status:     pay.Status,
+			Payer:      pay.Payer,
+			Receiver:   pay.Receiver,
+		}
+		if pay.Status != Wechat_Pay_Status_Pending {
+			record.SettleTime = msg.CreateTime
+		}
+		if len(pay.TransferId) > 0 {
+			index[kind+pay.TransferId] = len(ledger.Rows)
+		}
+		ledger.Rows = append(ledger.Rows, record)
+	}
+
+	// 红包不知道金额, 不计入合计只计数; 还没收款的转账可能还会退还或过期, 两个方向都单独统计
+	for _, record := range ledger.Rows {
+		if record.Status == Wechat_Pay_Status_Refunded || record.Status == Wechat_Pay_Status_Expired {
+			continue
+		}
+		if !record.HasAmount {
+			ledger.NoAmount += 1
+			continue
+		}
+		isPending := record.Status == Wechat_Pay_Status_Pending
+		switch {
+		case record.Direction == Wechat_Pay_Direction_In && isPending:
+			ledger.PendingIn += record.Amount
+		case record.Direction == Wechat_Pay_Direction_In:
+			ledger.TotalIn += record.Amount
+		case isPending:
+			ledger.PendingOut += record.Amount
+		default:
+			ledger.TotalOut += record.Amount
+		}
+	}
+	ledger.Total = len(ledger.Rows)
+
+	return ledger, nil
+}
+
+// WeChatExportPaymentLedger 导出CSV, 带BOM方便Excel直接打开
+func (P *WechatDataProvider) WeChatExportPaymentLedger(userName string, startTime int64, endTime int64, exportPath string) error {
+	ledger, err := P.WeChatGetPaymentLedger(userName, startTime, endTime)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(exportPath)
+	if err != nil {
+		log.Println("os.Create failed:", err)
+		return err
+	}
+	defer file.Close()
+
+	file.WriteString("\xEF\xBB\xBF")
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"时间", "类型", "会话", "方向", "金额", "状态", "到账时间", "备注", "单号", "MsgSvrId"})
+	for _, record := range ledger.Rows {
+		talker := P.wechatDisplayName(record.Talker)
+		settleTime := ""
+		if record.SettleTime > 0 {
+			settleTime = time.Unix(record.SettleTime, 0).Format("2006-01-02 15:04:05")
+		}
+		amount := "未知"
+		if record.HasAmount {
+			amount = fmt.Sprintf("%d.%02d", record.Amount/100, record.Amount%100)
+		}
+		writer.Write([]string{
+			time.Unix(record.CreateTime, 0).Format("2006-01-02 15:04:05"),
+			record.Kind,
+			talker,
+			record.Direction,
+			amount,
+			record.Status,
+			settleTime,
+			record.Memo,
+			record.Id,
+			record.MsgSvrId,
+		})
+	}
+	writer.Write([]string{"", "", "", Wechat_Pay_Direction_In, fmt.Sprintf("%d.%02d", ledger.TotalIn/100, ledger.TotalIn%100)})
+	writer.Write([]string{"", "", "", Wechat_Pay_Direction_Out, fmt.Sprintf("%d.%02d", ledger.TotalOut/100, ledger.TotalOut%100)})
+	writer.Write([]string{"", "", "", Wechat_Pay_Direction_In, fmt.Sprintf("%d.%02d", ledger.PendingIn/100, ledger.PendingIn%100), Wechat_Pay_Status_Pending})
+	writer.Write([]string{"", "", "", Wechat_Pay_Direction_Out, fmt.Sprintf("%d.%02d", ledger.PendingOut/100, ledger.PendingOut%100), Wechat_Pay_Status_Pending})
+	writer.Write([]string{"", "", "", "", fmt.Sprintf("%d", ledger.NoAmount), "未知金额"})
+	writer.Flush()
+
+	return writer.Error()
+}
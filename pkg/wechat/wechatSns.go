@@ -0,0 +1,437 @@
+package wechat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+const (
+	SnsDB = "Sns.db"
+)
+
+// TimelineObject/ContentObject/contentStyle
+const (
+	Wechat_Sns_Style_Image = 1
+	Wechat_Sns_Style_Text  = 2
+	Wechat_Sns_Style_Link  = 3
+	Wechat_Sns_Style_Music = 4
+	Wechat_Sns_Style_Video = 15
+)
+
+// mediaList/media/type
+const (
+	Wechat_Sns_Media_Image = 2
+	Wechat_Sns_Media_Video = 6
+)
+
+// CommentV20 Type
+const (
+	Wechat_Sns_Comment_Like    = 1
+	Wechat_Sns_Comment_Comment = 2
+)
+
+type SnsMedia struct {
+	Id          string `json:"Id"`
+	Type        int    `json:"Type"`
+	Url         string `json:"Url"`
+	Thumb       string `json:"Thumb"`
+	Md5         string `json:"Md5"`
+	Description string `json:"Description"`
+}
+
+type SnsComment struct {
+	CommentId     string `json:"CommentId"`
+	Type          int    `json:"Type"`
+	UserName      string `json:"UserName"`
+	NickName      string `json:"NickName"`
+	ReplyUserName string `json:"ReplyUserName"`
+	ReplyNickName string `json:"ReplyNickName"`
+	Content       string `json:"Content"`
+	CreateTime    int64  `json:"CreateTime"`
+}
+
+type SnsFeed struct {
+	FeedId       string       `json:"FeedId"`
+	UserName     string       `json:"UserName"`
+	NickName     string       `json:"NickName"`
+	CreateTime   int64        `json:"CreateTime"`
+	ContentStyle int          `json:"ContentStyle"`
+	Content      string       `json:"Content"`
+	Title        string       `json:"Title"`
+	Description  string       `json:"Description"`
+	ContentUrl   string       `json:"ContentUrl"`
+	Location     LocationInfo `json:"Location"`
+	Media        []SnsMedia   `json:"Media"`
+	Likes        []SnsComment `json:"Likes"`
+	Comments     []SnsComment `json:"Comments"`
+	feedKey      int64
+	// 数据库里的CreateTime, 分页用, xml里的时间可能和它不一样
+	feedTime int64
+}
+
+type SnsFeedList struct {
+	UserName string    `json:"UserName"`
+	Total    int       `json:"Total"`
+	Rows     []SnsFeed `json:"Rows"`
+	// 最后一条的(CreateTime, FeedId), 下一页原样传回; FeedId超过js的整数精度, 用字符串
+	NextCreateTime int64  `json:"NextCreateTime"`
+	NextFeedKey    string `json:"NextFeedKey"`
+}
+
+type SnsProvider struct {
+	db   *sql.DB
+	data *WechatDataProvider
+}
+
+// WeChatGetSnsProvider 第一次使用时打开Sns.db, 随WechatDataProvider一起关闭
+func (P *WechatDataProvider) WeChatGetSnsProvider() (*SnsProvider, error) {
+	P.snsMtx.Lock()
+	defer P.snsMtx.Unlock()
+	if P.sns != nil {
+		return P.sns, nil
+	}
+
+	snsDBPath := P.dbPath + "\\Msg\\" + SnsDB
+	if _, err := os.Stat(snsDBPath); err != nil {
+		log.Println("no exist:", snsDBPath)
+		return nil, err
+	}
+	db, err := openBackupDataBase(snsDBPath)
+	if err != nil {
+		log.Printf("open db %s error: %v", snsDBPath, err)
+		return nil, err
+	}
+
+	P.sns = &SnsProvider{db: db, data: P}
+	return P.sns, nil
+}
+
+func (S *SnsProvider) Close() {
+	if S.db != nil {
+		if err := closeDataBase(S.db); err != nil {
+			log.Println("db close:", err)
+		}
+	}
+}
+
+// SnsGetTimeline 按时间倒序分页, 返回createTime之前的pageSize条, createTime为0时从最新开始, userName为空时返回所有人的
+// feedKey是上一页返回的NextFeedKey, 为空时只按createTime分页
+func (S *SnsProvider) SnsGetTimeline(userName string, createTime int64, feedKey string, pageSize int) (*SnsFeedList, error) {
+	if len(feedKey) == 0 {
+		return S.snsGetTimeline(userName, createTime, nil, pageSize)
+	}
+	key, err := strconv.ParseInt(feedKey, 10, 64)
+	if err != nil {
+		log.Println("ParseInt failed:", feedKey, err)
+		return nil, err
+	}
+	return S.snsGetTimeline(userName, createTime, &key, pageSize)
+}
+
+// snsGetTimeline feedKey不为空时从(createTime, feedKey)之后继续, 同一秒的朋友圈在分页边界上不会丢
+func (S *SnsProvider) snsGetTimeline(userName string, createTime int64, feedKey *int64, pageSize int) (*SnsFeedList, error) {
+	List := &SnsFeedList{UserName: userName}
+	List.Rows = make([]SnsFeed, 0)
+	if createTime <= 0 {
+		createTime = time.Now().Unix() + 1
+	}
+
+	condition := fmt.Sprintf("CreateTime<%d", createTime)
+	if feedKey != nil {
+		condition = fmt.Sprintf("(CreateTime<%d or (CreateTime=%d And FeedId<%d))", createTime, createTime, *feedKey)
+	}
+	if len(userName) > 0 {
+		condition += fmt.Sprintf(" And UserName='%s'", userName)
+	}
+	querySql := fmt.Sprintf("select FeedId, CreateTime, ifnull(UserName,'') as UserName, ifnull(Content,'') as Content from FeedsV20 where %s order by CreateTime desc, FeedId desc limit %d;", condition, pageSize)
+
+	rows, err := S.db.Query(querySql)
+	if err != nil {
+		log.Printf("%s failed %v\n", querySql, err)
+		return List, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var feedKey, feedTime int64
+		var feedUser, content string
+		if err := rows.Scan(&feedKey, &feedTime, &feedUser, &content); err != nil {
+			log.Println("rows.Scan failed", err)
+			return List, err
+		}
+
+		feed := S.snsFeedParse(content)
+		feed.feedKey = feedKey
+		feed.feedTime = feedTime
+		if len(feed.FeedId) == 0 {
+			feed.FeedId = strconv.FormatUint(uint64(feedKey), 10)
+		}
+		if feed.CreateTime == 0 {
+			feed.CreateTime = feedTime
+		}
+		if len(feed.UserName) == 0 {
+			feed.UserName = feedUser
+		}
+		feed.NickName = S.data.wechatDisplayName(feed.UserName)
+		List.Rows = append(List.Rows, feed)
+		List.Total += 1
+	}
+	rows.Close()
+	if List.Total > 0 {
+		last := &List.Rows[List.Total-1]
+		List.NextCreateTime = last.feedTime
+		List.NextFeedKey = strconv.FormatInt(last.feedKey, 10)
+	}
+
+	for i := range List.Rows {
+		S.snsGetComments(&List.Rows[i])
+	}
+
+	return List, nil
+}
+
+func (S *SnsProvider) snsFeedParse(content string) SnsFeed {
+	feed := SnsFeed{}
+	feed.Media = make([]SnsMedia, 0)
+	feed.Likes = make([]SnsComment, 0)
+	feed.Comments = make([]SnsComment, 0)
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(content); err != nil {
+		log.Println("ReadFromString failed:", err)
+		return feed
+	}
+	root := NewxmlDocument(doc)
+	feed.FeedId = root.FindElementValue("/TimelineObject/id")
+	feed.UserName = root.FindElementValue("/TimelineObject/username")
+	feed.CreateTime, _ = strconv.ParseInt(root.FindElementValue("/TimelineObject/createTime"), 10, 64)
+	feed.Content = root.FindElementValue("/TimelineObject/contentDesc")
+	feed.ContentStyle, _ = strconv.Atoi(root.FindElementValue("/TimelineObject/ContentObject/contentStyle"))
+	feed.Title = root.FindElementValue("/TimelineObject/ContentObject/title")
+	feed.Description = root.FindElementValue("/TimelineObject/ContentObject/description")
+	feed.ContentUrl = root.FindElementValue("/TimelineObject/ContentObject/contentUrl")
+
+	if location := doc.FindElement("/TimelineObject/location"); location != nil {
+		feed.Location.PoiName = location.SelectAttrValue("poiName", "")
+		feed.Location.Label = location.SelectAttrValue("poiAddress", "")
+		if len(feed.Location.Label) == 0 {
+			feed.Location.Label = location.SelectAttrValue("city", "")
+		}
+		feed.Location.X = location.SelectAttrValue("latitude", "")
+		feed.Location.Y = location.SelectAttrValue("longitude", "")
+	}
+
+	for _, media := range doc.FindElements("/TimelineObject/ContentObject/mediaList/media") {
+		m := SnsMedia{}
+		if e := media.FindElement("./id"); e != nil {
+			m.Id = e.Text()
+		}
+		if e := media.FindElement("./type"); e != nil {
+			m.Type, _ = strconv.Atoi(e.Text())
+		}
+		if e := media.FindElement("./description"); e != nil {
+			m.Description = e.Text()
+		}
+		if e := media.FindElement("./url"); e != nil {
+			m.Url = e.Text()
+			m.Md5 = e.SelectAttrValue("md5", "")
+		}
+		if e := media.FindElement("./thumb"); e != nil {
+			m.Thumb = e.Text()
+		}
+		feed.Media = append(feed.Media, m)
+	}
+
+	return feed
+}
+
+func (S *SnsProvider) snsGetComments(feed *SnsFeed) {
+	querySql := fmt.Sprintf("select * from CommentV20 where FeedId=%d order by CreateTime asc;", feed.feedKey)
+	rows, err := S.db.Query(querySql)
+	if err != nil {
+		log.Printf("%s failed %v\n", querySql, err)
+		return
+	}
+	defer rows.Close()
+
+	// CommentV20的列在不同版本里不完全一样, 按列名取值
+	columns, err := rows.Columns()
+	if err != nil {
+		log.Println("rows.Columns failed", err)
+		return
+	}
+	for rows.Next() {
+		row, err := wechatScanRowMap(rows, columns)
+		if err != nil {
+			log.Println("rows.Scan failed", err)
+			return
+		}
+
+		comment := SnsComment{}
+		comment.CommentId = wechatColumnString(row, "commentid", "strid")
+		comment.Type, _ = strconv.Atoi(wechatColumnString(row, "type"))
+		comment.UserName = wechatColumnString(row, "username", "fromusername")
+		comment.ReplyUserName = wechatColumnString(row, "refusername", "replyusername", "tousername")
+		comment.Content = wechatColumnString(row, "content", "strcontent")
+		comment.CreateTime, _ = strconv.ParseInt(wechatColumnString(row, "createtime"), 10, 64)
+		comment.NickName = S.data.wechatDisplayName(comment.UserName)
+		if len(comment.ReplyUserName) > 0 {
+			comment.ReplyNickName = S.data.wechatDisplayName(comment.ReplyUserName)
+		}
+
+		if comment.Type == Wechat_Sns_Comment_Like {
+			feed.Likes = append(feed.Likes, comment)
+		} else {
+			feed.Comments = append(feed.Comments, comment)
+		}
+	}
+}
+
+// wechatScanRowMap 把一行按小写列名转成map, 用于不同版本列不一致的表
+func wechatScanRowMap(rows *sql.Rows, columns []string) (map[string]interface{}, error) {
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	if err := rows.Scan(pointers...); err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]interface{}, len(columns))
+	for i, column := range columns {
+		row[strings.ToLower(column)] = values[i]
+	}
+	return row, nil
+}
+
+func wechatColumnString(row map[string]interface{}, names ...string) string {
+	for _, name := range names {
+		value, exists := row[name]
+		if !exists || value == nil {
+			continue
+		}
+		switch v := value.(type) {
+		case []byte:
+			return string(v)
+		case string:
+			return v
+		default:
+			return fmt.Sprintf("%v", v)
+		}
+	}
+	return ""
+}
+
+// SnsExportTimeline 导出userName的朋友圈(为空时导出全部), format为"json"或者"html"
+func (S *SnsProvider) SnsExportTimeline(userName string, exportPath string, format string) error {
+	all := &SnsFeedList{UserName: userName}
+	all.Rows = make([]SnsFeed, 0)
+	createTime := int64(0)
+	var feedKey *int64
+	pageSize := 500
+	for {
+		List, err := S.snsGetTimeline(userName, createTime, feedKey, pageSize)
+		if err != nil {
+			return err
+		}
+		all.Rows = append(all.Rows, List.Rows...)
+		all.Total += List.Total
+		if List.Total < pageSize {
+			break
+		}
+		last := List.Rows[List.Total-1]
+		createTime = last.feedTime
+		feedKey = &last.feedKey
+	}
+
+	var data []byte
+	if format == "html" {
+		data = []byte(snsTimelineHTML(all))
+	} else {
+		var err error
+		data, err = json.MarshalIndent(all, "", "  ")
+		if err != nil {
+			return err
+		}
+	}
+
+	err := os.WriteFile(exportPath, data, 0644)
+	if err != nil {
+		log.Println("WriteFile failed:", err)
+	}
+	return err
+}
+
+func snsTimelineHTML(List *SnsFeedList) string {
+	var builder strings.Builder
+	builder.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>朋友圈</title>\n<style>\n")
+	builder.WriteString("body{max-width:720px;margin:0 auto;font-family:sans-serif;background:#f5f5f5}\n")
+	builder.WriteString(".feed{background:#fff;margin:12px 0;padding:12px;border-radius:6px}\n")
+	builder.WriteString(".name{color:#576b95;font-weight:bold}.time{color:#999;font-size:12px}\n")
+	builder.WriteString(".media img{width:120px;height:120px;object-fit:cover;margin:2px}\n")
+	builder.WriteString(".social{background:#f7f7f7;padding:6px;margin-top:6px;font-size:14px}\n")
+	builder.WriteString("</style>\n</head>\n<body>\n")
+
+	for _, feed := range List.Rows {
+		builder.WriteString("<div class=\"feed\">\n")
+		builder.WriteString(fmt.Sprintf("<div class=\"name\">%s</div>\n", html.EscapeString(feed.NickName)))
+		if len(feed.Content) > 0 {
+			builder.WriteString(fmt.Sprintf("<div class=\"content\">%s</div>\n", strings.ReplaceAll(html.EscapeString(feed.Content), "\n", "<br>")))
+		}
+		if len(feed.ContentUrl) > 0 && feed.ContentStyle != Wechat_Sns_Style_Image {
+			title := feed.Title
+			if len(title) == 0 {
+				title = feed.ContentUrl
+			}
+			builder.WriteString(fmt.Sprintf("<div class=\"link\"><a href=\"%s\">%s</a></div>\n", html.EscapeString(feed.ContentUrl), html.EscapeString(title)))
+		}
+		if len(feed.Media) > 0 {
+			builder.WriteString("<div class=\"media\">\n")
+			for _, media := range feed.Media {
+				thumb := media.Thumb
+				if len(thumb) == 0 {
+					thumb = media.Url
+				}
+				builder.WriteString(fmt.Sprintf("<a href=\"%s\"><img src=\"%s\" referrerpolicy=\"no-referrer\"></a>\n", html.EscapeString(media.Url), html.EscapeString(thumb)))
+			}
+			builder.WriteString("</div>\n")
+		}
+		if len(feed.Location.PoiName) > 0 {
+			builder.WriteString(fmt.Sprintf("<div class=\"time\">%s</div>\n", html.EscapeString(feed.Location.PoiName)))
+		}
+		builder.WriteString(fmt.Sprintf("<div class=\"time\">%s</div>\n", time.Unix(feed.CreateTime, 0).Format("2006-01-02 15:04:05")))
+
+		if len(feed.Likes) > 0 || len(feed.Comments) > 0 {
+			builder.WriteString("<div class=\"social\">\n")
+			if len(feed.Likes) > 0 {
+				names := make([]string, 0, len(feed.Likes))
+				for _, like := range feed.Likes {
+					names = append(names, html.EscapeString(like.NickName))
+				}
+				builder.WriteString(fmt.Sprintf("<div>♡ %s</div>\n", strings.Join(names, ", ")))
+			}
+			for _, comment := range feed.Comments {
+				who := html.EscapeString(comment.NickName)
+				if len(comment.ReplyNickName) > 0 {
+					who += " 回复 " + html.EscapeString(comment.ReplyNickName)
+				}
+				builder.WriteString(fmt.Sprintf("<div><span class=\"name\">%s</span>: %s</div>\n", who, html.EscapeString(comment.Content)))
+			}
+			builder.WriteString("</div>\n")
+		}
+		builder.WriteString("</div>\n")
+	}
+	builder.WriteString("</body>\n</html>\n")
+
+	return builder.String()
+}
@@ -0,0 +1,227 @@
+package wechat
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"wechatDataBackup/pkg/utils"
+
+	"github.com/beevik/etree"
+)
+
+const (
+	Wechat_System_Event_Notice    = "notice"
+	Wechat_System_Event_Pat       = "pat"
+	Wechat_System_Event_Revoke    = "revoke"
+	Wechat_System_Event_Invite    = "invite"
+	Wechat_System_Event_Join      = "join"
+	Wechat_System_Event_Kick      = "kick"
+	Wechat_System_Event_Rename    = "rename"
+	Wechat_System_Event_RedPacket = "redpacket"
+)
+
+type SystemInfo struct {
+	Kind    string   `json:"Kind"`
+	Actors  []string `json:"Actors"`
+	Targets []string `json:"Targets"`
+	Detail  string   `json:"Detail"`
+	Text    string   `json:"Text"`
+}
+
+var (
+	sysPatRegexp       = regexp.MustCompile(`^"?(.+?)"?\s*拍了拍\s*"?(.+?)"?(?:\s|的|$)`)
+	sysRevokeRegexp    = regexp.MustCompile(`^"?(.+?)"?\s*撤回了一条消息`)
+	sysInviteRegexp    = regexp.MustCompile(`^"?(.+?)"?\s*邀请\s*"?(.+?)"?\s*加入了群聊`)
+	sysQRCodeRegexp    = regexp.MustCompile(`^"?(.+?)"?\s*通过扫描\s*"?(.+?)"?\s*分享的二维码加入群聊`)
+	sysJoinRegexp      = regexp.MustCompile(`^"?(.+?)"?\s*加入了群聊`)
+	sysKickRegexp      = regexp.MustCompile(`^"?(.+?)"?\s*将\s*"?(.+?)"?\s*移出了群聊`)
+	sysRenameRegexp    = regexp.MustCompile(`^"?(.+?)"?\s*修改群名为\s*[“"](.+?)[”"]`)
+	sysRedPacketRegexp = regexp.MustCompile(`^(.+?)领取了(.+?)的红包`)
+	sysTemplateRegexp  = regexp.MustCompile(`\$\{([^}]+)\}`)
+	sysSendIdRegexp    = regexp.MustCompile(`sendid=(\d+)`)
+)
+
+// ParseSystemInfo 解析10000/10002类型的系统消息, nameOf用于把wxid转换成显示名称, 可以为nil
+func ParseSystemInfo(content string, nameOf func(userName string) string) SystemInfo {
+	info := SystemInfo{Kind: Wechat_System_Event_Notice}
+	info.Actors = make([]string, 0)
+	info.Targets = make([]string, 0)
+	if nameOf == nil {
+		nameOf = func(userName string) string { return userName }
+	}
+
+	content = strings.TrimSpace(content)
+	if strings.HasPrefix(content, "<") && strings.Contains(content, "<sysmsg") {
+		if sysMsgXMLParse(content, nameOf, &info) {
+			return info
+		}
+	}
+
+	info.Text = utils.Html2Text(content)
+	sysMsgTextParse(&info)
+	if info.Kind == Wechat_System_Event_RedPacket {
+		// 红包领取通知的链接里带有红包的sendid
+		if m := sysSendIdRegexp.FindStringSubmatch(content); m != nil {
+			info.Detail = m[1]
+		}
+	}
+	return info
+}
+
+func sysMsgXMLParse(content string, nameOf func(string) string, info *SystemInfo) bool {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(content); err != nil {
+		return false
+	}
+	sysmsg := doc.FindElement("//sysmsg")
+	if sysmsg == nil {
+		return false
+	}
+	root := NewxmlDocument(doc)
+
+	switch sysmsg.SelectAttrValue("type", "") {
+	case "pat":
+		info.Kind = Wechat_System_Event_Pat
+		from := root.FindElementValue("//pat/fromusername")
+		patted := root.FindElementValue("//pat/pattedusername")
+		if from != "" {
+			info.Actors = append(info.Actors, from)
+		}
+		if patted != "" {
+			info.Targets = append(info.Targets, patted)
+		}
+		template := root.FindElementValue("//pat/template")
+		info.Text = sysTemplateRegexp.ReplaceAllStringFunc(template, func(s string) string {
+			return nameOf(sysTemplateRegexp.FindStringSubmatch(s)[1])
+		})
+	case "revokemsg":
+		info.Kind = Wechat_System_Event_Revoke
+		info.Detail = root.FindElementValue("//revokemsg/newmsgid")
+		info.Text = utils.Html2Text(root.FindElementValue("//revokemsg/replacemsg"))
+		if m := sysRevokeRegexp.FindStringSubmatch(info.Text); m != nil {
+			info.Actors = append(info.Actors, m[1])
+		}
+	case "sysmsgtemplate":
+		sysMsgTemplateParse(doc, info)
+	default:
+		return false
+	}
+
+	if info.Text == "" {
+		return false
+	}
+	return true
+}
+
+func sysMsgTemplateParse(doc *etree.Document, info *SystemInfo) {
+	template := ""
+	if item := doc.FindElement("//sysmsgtemplate/content_template/template"); item != nil {
+		template = item.Text()
+	}
+
+	type linkInfo struct {
+		pos     int
+		text    string
+		members []string
+	}
+	links := make([]linkInfo, 0)
+	for _, link := range doc.FindElements("//sysmsgtemplate/content_template/link_list/link") {
+		name := link.SelectAttrValue("name", "")
+		placeholder := "$" + name + "$"
+		pos := strings.Index(template, placeholder)
+		if name == "" || pos == -1 {
+			continue
+		}
+
+		l := linkInfo{pos: pos}
+		names := make([]string, 0)
+		for _, member := range link.FindElements("./memberlist/member") {
+			userName, nickName := "", ""
+			if e := member.FindElement("./username"); e != nil {
+				userName = e.Text()
+			}
+			if e := member.FindElement("./nickname"); e != nil {
+				nickName = e.Text()
+			}
+			if nickName == "" {
+				nickName = userName
+			}
+			l.members = append(l.members, userName)
+			names = append(names, nickName)
+		}
+		if len(names) > 0 {
+			l.text = strings.Join(names, "、")
+		} else if e := link.FindElement("./plain"); e != nil {
+			l.text = e.Text()
+			if l.text != "" {
+				l.members = append(l.members, l.text)
+			}
+		} else if e := link.FindElement("./title"); e != nil {
+			l.text = e.Text()
+		}
+		template = strings.Replace(template, placeholder, l.text, -1)
+		links = append(links, l)
+	}
+	info.Text = template
+
+	sort.Slice(links, func(i, j int) bool { return links[i].pos < links[j].pos })
+	for i, l := range links {
+		if i == 0 {
+			info.Actors = append(info.Actors, l.members...)
+		} else {
+			info.Targets = append(info.Targets, l.members...)
+		}
+	}
+
+	switch {
+	case strings.Contains(template, "邀请"):
+		info.Kind = Wechat_System_Event_Invite
+	case strings.Contains(template, "移出"):
+		info.Kind = Wechat_System_Event_Kick
+	case strings.Contains(template, "修改群名"):
+		info.Kind = Wechat_System_Event_Rename
+	case strings.Contains(template, "加入"):
+		info.Kind = Wechat_System_Event_Join
+	case strings.Contains(template, "撤回"):
+		info.Kind = Wechat_System_Event_Revoke
+	}
+}
+
+func sysMsgTextParse(info *SystemInfo) {
+	text := strings.TrimSpace(strings.TrimPrefix(info.Text, "\U0001F9E7"))
+	splitNames := func(names string) []string {
+		return strings.FieldsFunc(names, func(r rune) bool { return r == '、' || r == '"' })
+	}
+
+	if m := sysPatRegexp.FindStringSubmatch(text); m != nil {
+		info.Kind = Wechat_System_Event_Pat
+		info.Actors = append(info.Actors, m[1])
+		info.Targets = append(info.Targets, m[2])
+	} else if m := sysRevokeRegexp.FindStringSubmatch(text); m != nil {
+		info.Kind = Wechat_System_Event_Revoke
+		info.Actors = append(info.Actors, m[1])
+	} else if m := sysInviteRegexp.FindStringSubmatch(text); m != nil {
+		info.Kind = Wechat_System_Event_Invite
+		info.Actors = append(info.Actors, m[1])
+		info.Targets = append(info.Targets, splitNames(m[2])...)
+	} else if m := sysQRCodeRegexp.FindStringSubmatch(text); m != nil {
+		info.Kind = Wechat_System_Event_Join
+		info.Actors = append(info.Actors, m[1])
+		info.Detail = m[2]
+	} else if m := sysKickRegexp.FindStringSubmatch(text); m != nil {
+		info.Kind = Wechat_System_Event_Kick
+		info.Actors = append(info.Actors, m[1])
+		info.Targets = append(info.Targets, splitNames(m[2])...)
+	} else if m := sysRenameRegexp.FindStringSubmatch(text); m != nil {
+		info.Kind = Wechat_System_Event_Rename
+		info.Actors = append(info.Actors, m[1])
+		info.Detail = m[2]
+	} else if m := sysJoinRegexp.FindStringSubmatch(text); m != nil {
+		info.Kind = Wechat_System_Event_Join
+		info.Actors = append(info.Actors, splitNames(m[1])...)
+	} else if m := sysRedPacketRegexp.FindStringSubmatch(text); m != nil {
+		info.Kind = Wechat_System_Event_RedPacket
+		info.Actors = append(info.Actors, m[1])
+		info.Targets = append(info.Targets, m[2])
+	}
+}
@@ -0,0 +1,187 @@
+package wechat
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	Wechat_VCard_Scope_Contact = "contact"
+	Wechat_VCard_Scope_Label   = "label"
+	Wechat_VCard_Scope_Group   = "group"
+	Wechat_VCard_Scope_Chat    = "chat"
+)
+
+// WeChatExportVCard 导出vCard 4.0, scope为contact时导出整个通讯录, label时target为标签id,
+// group时target为群聊名, chat时导出target会话中分享过的名片, 返回导出的联系人数量
+func (P *WechatDataProvider) WeChatExportVCard(scope string, target string, exportPath string) (int, error) {
+	users := make([]WeChatUserInfo, 0)
+	switch scope {
+	case Wechat_VCard_Scope_Contact:
+		for _, contact := range P.ContactList.Users {
+			if !contact.IsGroup {
+				users = append(users, contact.WeChatUserInfo)
+			}
+		}
+	case Wechat_VCard_Scope_Label:
+		labelId, err := strconv.Atoi(target)
+		if err != nil {
+			return 0, fmt.Errorf("invalid label id: %s", target)
+		}
+		list, _ := P.WeChatGetContactListByLabel(labelId, 0, math.MaxInt32)
+		for _, contact := range list.Users {
+			users = append(users, contact.WeChatUserInfo)
+		}
+	case Wechat_VCard_Scope_Group:
+		list, err := P.WeChatGetChatRoomUserList(target)
+		if err != nil {
+			return 0, err
+		}
+		users = append(users, list.Users...)
+	case Wechat_VCard_Scope_Chat:
+		users = P.wechatGetSharedCards(target)
+	default:
+		return 0, fmt.Errorf("unknown scope: %s", scope)
+	}
+
+	var builder strings.Builder
+	for i := range users {
+		builder.WriteString(P.wechatVCard(&users[i]))
+	}
+
+	if err := os.WriteFile(exportPath, []byte(builder.String()), 0644); err != nil {
+		log.Println("WriteFile failed:", err)
+		return 0, err
+	}
+
+	log.Printf("WeChatExportVCard %s %s: %d\n", scope, target, len(users))
+	return len(users), nil
+}
+
+func (P *WechatDataProvider) wechatGetSharedCards(userName string) []WeChatUserInfo {
+	users := make([]WeChatUserInfo, 0)
+	seen := make(map[string]bool)
+
+	querySql := fmt.Sprintf("select localId,MsgSvrID,Type,SubType,IsSender,CreateTime,ifnull(StrTalker,'') as StrTalker, ifnull(StrContent,'') as StrContent,ifnull(CompressContent,'') as CompressContent,ifnull(BytesExtra,'') as BytesExtra from MSG Where StrTalker='%s' And Type=%d order by CreateTime asc;", userName, Wechat_Message_Type_Visit_Card)
+	for _, msgDB := range P.msgDBs {
+		rows, err := msgDB.db.Query(querySql)
+		if err != nil {
+			log.Printf("%s failed %v\n", querySql, err)
+			continue
+		}
+
+		for rows.Next() {
+			msg, err := P.wechatScanMessage(rows)
+			if err != nil {
+				log.Println("rows.Scan failed", err)
+				break
+			}
+			if len(msg.VisitInfo.UserName) == 0 || seen[msg.VisitInfo.UserName] {
+				continue
+			}
+			seen[msg.VisitInfo.UserName] = true
+			users = append(users, msg.VisitInfo)
+		}
+		rows.Close()
+	}
+
+	return users
+}
+
+func (P *WechatDataProvider) wechatVCard(info *WeChatUserInfo) string {
+	lines := make([]string, 0, 16)
+	lines = append(lines, "BEGIN:VCARD", "VERSION:4.0")
+
+	fn := info.ReMark
+	if fn == "" {
+		fn = info.NickName
+	}
+	if fn == "" {
+		fn = info.UserName
+	}
+	lines = append(lines, "FN:"+vcardEscape(fn))
+	if info.NickName != "" {
+		lines = append(lines, "NICKNAME:"+vcardEscape(info.NickName))
+	}
+	lines = append(lines, "IMPP:weixin:"+info.UserName)
+	lines = append(lines, "X-WECHAT-ID:"+vcardEscape(info.UserName))
+	if info.Alias != "" {
+		lines = append(lines, "X-WECHAT-ALIAS:"+vcardEscape(info.Alias))
+	}
+	if info.ReMark != "" && info.NickName != "" && info.ReMark != info.NickName {
+		lines = append(lines, "NOTE:"+vcardEscape(info.NickName))
+	}
+
+	// 只有通讯录里的联系人才有ExtraBuf
+	if profile, err := P.WeChatGetContactProfile(info.UserName); err == nil {
+		for _, phone := range profile.PhoneNumbers {
+			lines = append(lines, "TEL;TYPE=cell:"+vcardEscape(phone))
+		}
+		if profile.Gender == 1 {
+			lines = append(lines, "GENDER:M")
+		} else if profile.Gender == 2 {
+			lines = append(lines, "GENDER:F")
+		}
+		if profile.Country != "" || profile.Province != "" || profile.City != "" {
+			lines = append(lines, fmt.Sprintf("ADR:;;;%s;%s;;%s", vcardEscape(profile.City), vcardEscape(profile.Province), vcardEscape(profile.Country)))
+		}
+		if profile.Company != "" {
+			lines = append(lines, "ORG:"+vcardEscape(profile.Company))
+		}
+		if profile.Signature != "" {
+			lines = append(lines, "X-WECHAT-SIGNATURE:"+vcardEscape(profile.Signature))
+		}
+		if len(profile.Labels) > 0 {
+			labels := make([]string, 0, len(profile.Labels))
+			for _, label := range profile.Labels {
+				labels = append(labels, vcardEscape(label.LabelName))
+			}
+			lines = append(lines, "CATEGORIES:"+strings.Join(labels, ","))
+		}
+	}
+
+	headImgPath := fmt.Sprintf("%s\\FileStorage\\HeadImage\\%s.headimg", P.resPath, info.UserName)
+	if data, err := ReadBackupFile(headImgPath); err == nil && len(data) > 0 {
+		lines = append(lines, fmt.Sprintf("PHOTO:data:%s;base64,%s", http.DetectContentType(data), base64.StdEncoding.EncodeToString(data)))
+	} else if info.BigHeadImgUrl != "" {
+		lines = append(lines, "PHOTO:"+info.BigHeadImgUrl)
+	} else if info.SmallHeadImgUrl != "" {
+		lines = append(lines, "PHOTO:"+info.SmallHeadImgUrl)
+	}
+	lines = append(lines, "END:VCARD")
+
+	var builder strings.Builder
+	for _, line := range lines {
+		builder.WriteString(vcardFold(line))
+	}
+	return builder.String()
+}
+
+func vcardEscape(text string) string {
+	replacer := strings.NewReplacer("\\", "\\\\", ";", "\\;", ",", "\\,", "\r\n", "\\n", "\n", "\\n")
+	return replacer.Replace(text)
+}
+
+// vcardFold 按RFC 6350每行不超过75字节折行, 不拆开UTF-8字符
+func vcardFold(line string) string {
+	var builder strings.Builder
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		builder.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	builder.WriteString(line + "\r\n")
+	return builder.String()
+}
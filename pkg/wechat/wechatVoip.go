@@ -0,0 +1,226 @@
+package wechat
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Wechat_Voip_Media_Audio = "audio"
+	Wechat_Voip_Media_Video = "video"
+)
+
+const (
+	Wechat_Voip_Direction_In  = "in"
+	Wechat_Voip_Direction_Out = "out"
+)
+
+const (
+	Wechat_Voip_Status_Answered  = "answered"
+	Wechat_Voip_Status_Missed    = "missed"
+	Wechat_Voip_Status_Cancelled = "cancelled"
+	Wechat_Voip_Status_Declined  = "declined"
+	Wechat_Voip_Status_Busy      = "busy"
+	Wechat_Voip_Status_Failed    = "failed"
+	Wechat_Voip_Status_Unknown   = "unknown"
+)
+
+type WeChatCallRecord struct {
+	Talker     string `json:"Talker"`
+	NickName   string `json:"NickName"`
+	MsgSvrId   string `json:"MsgSvrId"`
+	CreateTime int64  `json:"CreateTime"`
+	Direction  string `json:"Direction"`
+	Media      string `json:"Media"`
+	Status     string `json:"Status"`
+	Duration   int    `json:"Duration"`
+}
+
+type WeChatCallHistory struct {
+	UserName      string             `json:"UserName"`
+	Total         int                `json:"Total"`
+	TotalDuration int                `json:"TotalDuration"`
+	Rows          []WeChatCallRecord `json:"Rows"`
+}
+
+var voipDurationRegexp = regexp.MustCompile(`(\d+):(\d{2})(?::(\d{2}))?`)
+
+// voipDurationParse 把"通话时长 03:21"或者"通话时长 1:03:21"转换成秒
+func voipDurationParse(text string) int {
+	m := voipDurationRegexp.FindStringSubmatch(text)
+	if m == nil {
+		return 0
+	}
+	a, _ := strconv.Atoi(m[1])
+	b, _ := strconv.Atoi(m[2])
+	if len(m[3]) > 0 {
+		c, _ := strconv.Atoi(m[3])
+		return a*3600 + b*60 + c
+	}
+	return a*60 + b
+}
+
+func voipStatusParse(text string, isSender bool) string {
+	switch {
+	case strings.Contains(text, "通话时长"):
+		return Wechat_Voip_Status_Answered
+	case strings.Contains(text, "对方已取消"):
+		return Wechat_Voip_Status_Missed
+	case strings.Contains(text, "已取消"):
+		if isSender {
+			return Wechat_Voip_Status_Cancelled
+		}
+		return Wechat_Voip_Status_Missed
+	case strings.Contains(text, "拒绝"):
+		return Wechat_Voip_Status_Declined
+	case strings.Contains(text, "忙线"):
+		return Wechat_Voip_Status_Busy
+	case strings.Contains(text, "无应答"), strings.Contains(text, "未接听"):
+		return Wechat_Voip_Status_Missed
+	case strings.Contains(text, "失败"), strings.Contains(text, "中断"):
+		return Wechat_Voip_Status_Failed
+	default:
+		return Wechat_Voip_Status_Unknown
+	}
+}
+
+// WeChatGetCallHistory 列出音视频通话记录, userName为空或者"all"时返回全部联系人, 按联系人和时间排序
+func (P *WechatDataProvider) WeChatGetCallHistory(userName string) (*WeChatCallHistory, error) {
+	history := &WeChatCallHistory{UserName: userName}
+	history.Rows = make([]WeChatCallRecord, 0)
+	if userName == "all" {
+		userName = ""
+	}
+
+	condition := fmt.Sprintf("Type=%d", Wechat_Message_Type_Voip)
+	if len(userName) > 0 {
+		condition += fmt.Sprintf(" And StrTalker='%s'", userName)
+	}
+	querySql := fmt.Sprintf("select localId,MsgSvrID,Type,SubType,IsSender,CreateTime,ifnull(StrTalker,'') as StrTalker, ifnull(StrContent,'') as StrContent,ifnull(CompressContent,'') as CompressContent,ifnull(BytesExtra,'') as BytesExtra from MSG Where %s order by CreateTime asc;", condition)
+
+	for _, msgDB := range P.msgDBs {
+		rows, err := msgDB.db.Query(querySql)
+		if err != nil {
+			log.Printf("%s failed %v\n", querySql, err)
+			continue
+		}
+
+		for rows.Next() {
+			msg, err := P.wechatScanMessage(rows)
+			if err != nil {
+				log.Println("rows.Scan failed", err)
+				break
+			}
+
+			record := WeChatCallRecord{
+				Talker:     msg.Talker,
+				NickName:   P.wechatDisplayName(msg.Talker),
+				MsgSvrId:   msg.MsgSvrId,
+				CreateTime: msg.CreateTime,
+				Direction:  msg.VoipInfo.Direction,
+				Media:      msg.VoipInfo.Media,
+				Status:     msg.VoipInfo.Status,
+				Duration:   msg.VoipInfo.Duration,
+			}
+			history.Rows = append(history.Rows, record)
+			history.TotalDuration += record.Duration
+		}
+		rows.Close()
+	}
+
+	sort.SliceStable(history.Rows, func(i, j int) bool {
+		if history.Rows[i].Talker != history.Rows[j].Talker {
+			return history.Rows[i].Talker < history.Rows[j].Talker
+		}
+		return history.Rows[i].CreateTime < history.Rows[j].CreateTime
+	})
+	history.Total = len(history.Rows)
+
+	return history, nil
+}
+
+// WeChatExportCallHistory 导出通话记录, format为"csv"或者"ics"
+func (P *WechatDataProvider) WeChatExportCallHistory(userName string, exportPath string, format string) error {
+	history, err := P.WeChatGetCallHistory(userName)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(exportPath)
+	if err != nil {
+		log.Println("os.Create failed:", err)
+		return err
+	}
+	defer file.Close()
+
+	if format == "ics" {
+		return callHistoryWriteICS(file, history)
+	}
+
+	file.WriteString("\xEF\xBB\xBF")
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"联系人", "wxid", "时间", "方向", "类型", "状态", "时长(秒)", "时长", "MsgSvrId"})
+	for _, record := range history.Rows {
+		writer.Write([]string{
+			record.NickName,
+			record.Talker,
+			time.Unix(record.CreateTime, 0).Format("2006-01-02 15:04:05"),
+			record.Direction,
+			record.Media,
+			record.Status,
+			strconv.Itoa(record.Duration),
+			callDurationText(record.Duration),
+			record.MsgSvrId,
+		})
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
+
+func callDurationText(duration int) string {
+	if duration >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", duration/3600, duration%3600/60, duration%60)
+	}
+	return fmt.Sprintf("%02d:%02d", duration/60, duration%60)
+}
+
+func callICSEscape(text string) string {
+	replacer := strings.NewReplacer("\\", "\\\\", ";", "\\;", ",", "\\,", "\n", "\\n")
+	return replacer.Replace(text)
+}
+
+func callHistoryWriteICS(file *os.File, history *WeChatCallHistory) error {
+	const layout = "20060102T150405Z"
+	var builder strings.Builder
+	builder.WriteString("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//wechatDataBackup//CallHistory//CN\r\nCALSCALE:GREGORIAN\r\n")
+
+	media := map[string]string{Wechat_Voip_Media_Audio: "语音通话", Wechat_Voip_Media_Video: "视频通话"}
+	for _, record := range history.Rows {
+		// 通话记录的时间是通话结束的时间
+		end := time.Unix(record.CreateTime, 0).UTC()
+		start := end.Add(-time.Duration(record.Duration) * time.Second)
+		summary := fmt.Sprintf("%s %s (%s)", media[record.Media], record.NickName, record.Status)
+		desc := fmt.Sprintf("direction: %s\nduration: %s\nwxid: %s", record.Direction, callDurationText(record.Duration), record.Talker)
+
+		builder.WriteString("BEGIN:VEVENT\r\n")
+		builder.WriteString(fmt.Sprintf("UID:%s-%d@wechatDataBackup\r\n", record.MsgSvrId, record.CreateTime))
+		builder.WriteString("DTSTAMP:" + end.Format(layout) + "\r\n")
+		builder.WriteString("DTSTART:" + start.Format(layout) + "\r\n")
+		builder.WriteString("DTEND:" + end.Format(layout) + "\r\n")
+		builder.WriteString("SUMMARY:" + callICSEscape(summary) + "\r\n")
+		builder.WriteString("DESCRIPTION:" + callICSEscape(desc) + "\r\n")
+		builder.WriteString("END:VEVENT\r\n")
+	}
+	builder.WriteString("END:VCALENDAR\r\n")
+
+	_, err := file.WriteString(builder.String())
+	return err
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+
+package wechat
+
+import "errors"
+
+// 非Windows平台读取不了微信进程, 只能用已知的key做离线解密
+
+func GetWeChatAllInfo() *WeChatInfoList {
+	list := GetWeChatInfo()
+	appendStoredAccounts(list)
+	return list
+}
+
+func GetWeChatInfo() (list *WeChatInfoList) {
+	list = &WeChatInfoList{}
+	list.Info = make([]WeChatInfo, 0)
+	return
+}
+
+func Is64BitProcess(pid uint32) (bool, error) {
+	return false, errors.New("not supported")
+}
+
+func GetWeChatKey(info *WeChatInfo) string {
+	return ""
+}
@@ -0,0 +1,188 @@
+package wechat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/shirou/gopsutil/v3/process"
+	"golang.org/x/sys/windows"
+)
+
+func GetWeChatAllInfo() *WeChatInfoList {
+	list := GetWeChatInfo()
+
+	for i := range list.Info {
+		// keystore里校验通过的key直接用, 不用再扫描内存
+		if list.Info[i].DBKey = storedWeChatKey(&list.Info[i]); len(list.Info[i].DBKey) > 0 {
+			continue
+		}
+		list.Info[i].DBKey = GetWeChatKey(&list.Info[i])
+		storeWeChatKey(&list.Info[i])
+	}
+	appendStoredAccounts(list)
+
+	return list
+}
+
+func GetWeChatInfo() (list *WeChatInfoList) {
+	list = &WeChatInfoList{}
+	list.Info = make([]WeChatInfo, 0)
+	list.Total = 0
+
+	processes, err := process.Processes()
+	if err != nil {
+		log.Println("Error getting processes:", err)
+		return
+	}
+
+	for _, p := range processes {
+		name, err := p.Name()
+		if err != nil {
+			continue
+		}
+		info := WeChatInfo{}
+		if name == "WeChat.exe" {
+			info.ProcessID = uint32(p.Pid)
+			info.Is64Bits, _ = Is64BitProcess(info.ProcessID)
+			log.Println("ProcessID", info.ProcessID)
+			files, err := p.OpenFiles()
+			if err != nil {
+				log.Println("OpenFiles failed")
+				continue
+			}
+
+			for _, f := range files {
+				if strings.HasSuffix(f.Path, "\\Media.db") {
+					// fmt.Printf("opened %s\n", f.Path[4:])
+					filePath := f.Path
+					parts := strings.Split(filePath, string(filepath.Separator))
+					if len(parts) < 4 {
+						log.Println("Error filePath " + filePath)
+						break
+					}
+					info.FilePath = strings.Join(parts[:len(parts)-2], string(filepath.Separator))
+					info.AcountName = strings.Join(parts[len(parts)-3:len(parts)-2], string(filepath.Separator))
+				}
+
+			}
+
+			if len(info.FilePath) == 0 {
+				log.Println("wechat not log in")
+				continue
+			}
+
+			hModuleSnap, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPMODULE|windows.TH32CS_SNAPMODULE32, uint32(p.Pid))
+			if err != nil {
+				log.Println("CreateToolhelp32Snapshot failed", err)
+				continue
+			}
+			defer windows.CloseHandle(hModuleSnap)
+
+			var me32 windows.ModuleEntry32
+			me32.Size = uint32(windows.SizeofModuleEntry32)
+
+			err = windows.Module32First(hModuleSnap, &me32)
+			if err != nil {
+				log.Println("Module32First failed", err)
+				continue
+			}
+
+			for ; err == nil; err = windows.Module32Next(hModuleSnap, &me32) {
+				if windows.UTF16ToString(me32.Module[:]) == "WeChatWin.dll" {
+					// fmt.Printf("MODULE NAME: %s\n", windows.UTF16ToString(me32.Module[:]))
+					// fmt.Printf("executable NAME: %s\n", windows.UTF16ToString(me32.ExePath[:]))
+					// fmt.Printf("base address: 0x%08X\n", me32.ModBaseAddr)
+					// fmt.Printf("base ModBaseSize: %d\n", me32.ModBaseSize)
+					info.DllBaseAddr = me32.ModBaseAddr
+					info.DllBaseSize = me32.ModBaseSize
+
+					var zero windows.Handle
+					driverPath := windows.UTF16ToString(me32.ExePath[:])
+					infoSize, err := windows.GetFileVersionInfoSize(driverPath, &zero)
+					if err != nil {
+						log.Println("GetFileVersionInfoSize failed", err)
+						break
+					}
+					versionInfo := make([]byte, infoSize)
+					if err = windows.GetFileVersionInfo(driverPath, 0, infoSize, unsafe.Pointer(&versionInfo[0])); err != nil {
+						log.Println("GetFileVersionInfo failed", err)
+						break
+					}
+					var fixedInfo *windows.VS_FIXEDFILEINFO
+					fixedInfoLen := uint32(unsafe.Sizeof(*fixedInfo))
+					err = windows.VerQueryValue(unsafe.Pointer(&versionInfo[0]), `\`, (unsafe.Pointer)(&fixedInfo), &fixedInfoLen)
+					if err != nil {
+						log.Println("VerQueryValue failed", err)
+						break
+					}
+					// fmt.Printf("%s: v%d.%d.%d.%d\n", windows.UTF16ToString(me32.Module[:]),
+					// 	(fixedInfo.FileVersionMS>>16)&0xff,
+					// 	(fixedInfo.FileVersionMS>>0)&0xff,
+					// 	(fixedInfo.FileVersionLS>>16)&0xff,
+					// 	(fixedInfo.FileVersionLS>>0)&0xff)
+
+					info.Version = fmt.Sprintf("%d.%d.%d.%d",
+						(fixedInfo.FileVersionMS>>16)&0xff,
+						(fixedInfo.FileVersionMS>>0)&0xff,
+						(fixedInfo.FileVersionLS>>16)&0xff,
+						(fixedInfo.FileVersionLS>>0)&0xff)
+					list.Info = append(list.Info, info)
+					list.Total += 1
+					break
+				}
+			}
+		}
+	}
+	return
+}
+
+func Is64BitProcess(pid uint32) (bool, error) {
+	is64Bit := false
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_INFORMATION, false, pid)
+	if err != nil {
+		log.Println("Error opening process:", err)
+		return is64Bit, errors.New("OpenProcess failed")
+	}
+	defer windows.CloseHandle(handle)
+
+	err = windows.IsWow64Process(handle, &is64Bit)
+	if err != nil {
+		log.Println("Error IsWow64Process:", err)
+	}
+	return !is64Bit, err
+}
+
+func GetWeChatKey(info *WeChatInfo) string {
+	mediaDB := info.FilePath + "\\Msg\\Media.db"
+	if _, err := os.Stat(mediaDB); err != nil {
+		log.Printf("open db %s error: %v", mediaDB, err)
+		return ""
+	}
+
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_INFORMATION|windows.PROCESS_VM_READ, false, uint32(info.ProcessID))
+	if err != nil {
+		log.Println("Error opening process:", err)
+		return ""
+	}
+	defer windows.CloseHandle(handle)
+
+	// WeChatWin.dll是3.x版本, 只会是SQLCipher 3的参数
+	key, report := searchDBKey(processMemory{handle: handle}, info, mediaDB, &CipherProfileV3)
+	log.Println(report)
+	info.KeyReport = report
+	return key
+}
+
+// processMemory 读取运行中的微信进程内存
+type processMemory struct {
+	handle windows.Handle
+}
+
+func (p processMemory) ReadMemory(addr uint64, buffer []byte) error {
+	return windows.ReadProcessMemory(p.handle, uintptr(addr), &buffer[0], uintptr(len(buffer)), nil)
+}